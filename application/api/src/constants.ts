@@ -19,6 +19,7 @@ export const PartsChaincodeName = envOrDefault('fabric_parts_contract', 'parts')
 export const SLA2ChannelName = envOrDefault('fabric_sla2_channel', 'sla2.0');
 
 export const SLA2Peer = envOrDefault('sla2_peer', 'grpc://org4-peer1:8051');
+export const SLA2RegistryURL = envOrDefault('sla2_registry_endpoint', 'http://localhost:8081');
 
 export const org1MSPId = envOrDefault('ORG1_MSP_ID', 'Org1MSP');
 export const org2MSPId = envOrDefault('ORG2_MSP_ID', 'Org2MSP');
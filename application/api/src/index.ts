@@ -238,11 +238,11 @@ app.post('/balance-sla2', async (req, res) => {
 
   let ccs: Array<string> = [];
   try {
-    ccs = await utils.connectWithPeer();
+    ccs = await utils.querySLA2Chaincodes();
     console.log(`Chaincodes: ${ccs}`);
-  } catch (e: any) {
+  } catch (e: unknown) {
     console.error(e);
-    res.status(e).send({ success: false, error: 'Could not connect with peer' });
+    return res.send({ success: false, error: 'Could not query the SLA registry' });
   }
 
   const gt: GatewayAndKeys = gatewayOrError.gateway!;
@@ -1,12 +1,18 @@
 import * as crypto from 'crypto';
 import * as grpc from '@grpc/grpc-js';
 import { Identity, Signer, signers } from '@hyperledger/fabric-gateway';
-import { spawn } from 'node:child_process';
+import axios from 'axios';
 import { promises as fs } from 'fs';
 
 import * as errors from './errors';
 import * as constants from './constants';
 
+type RegistryEntry = {
+  slaId: string,
+  chaincode: string,
+  status: string,
+};
+
 export type KeysWithStatus = {
   keyPEM: string,
   certPEM: string,
@@ -138,38 +144,13 @@ export function verifyKeys(key: string, cert: string): KeysWithStatus {
   };
 }
 
-export async function connectWithPeer(): Promise<Array<string>> {
-  const env = {
-    ...process.env,
-    FABRIC_CFG_PATH: '/fabric',
-    CORE_PEER_MSPCONFIGPATH: '/msp',
-  };
-
-  return new Promise((resolve, reject) => {
-    const fabricQuery = spawn('peer', [
-      'lifecycle',
-      'chaincode',
-      'queryinstalled',
-      '--peerAddresses', constants.org4PeerEndpoint,
-      '--tlsRootCertFiles', constants.org4TlsCertPath,
-    ], {
-      env,
-    });
-
-    let ccs: Array<string> = [];
-    fabricQuery.stdout.on('data', (data: Buffer) => {
-      const label = data.toString().match(/Label: .*/g);
-      if (label !== null) {
-        ccs = ccs.concat(label.map((val) => val.split(' ')[1]));
-      }
-    });
-
-    fabricQuery.on('close', (code) => {
-      if (code === 0) {
-        resolve(ccs);
-      } else {
-        reject(code);
-      }
-    });
-  });
+/**
+ * querySLA2Chaincodes() returns the chaincodes of the running SLAs from the
+ * registry of the SLA 2.0 client.
+ */
+export async function querySLA2Chaincodes(): Promise<Array<string>> {
+  const result = await axios.get<Array<RegistryEntry>>(`${constants.SLA2RegistryURL}/slas`);
+  return result.data
+    .filter((entry) => entry.status === 'running' || entry.status === 'upgrading')
+    .map((entry) => entry.chaincode);
 }
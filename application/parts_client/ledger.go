@@ -1,27 +1,42 @@
 package main
 
 import (
-	"log"
+	"encoding/json"
 
 	"github.com/hyperledger/fabric-gateway/pkg/client"
 
 	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib"
 )
 
-func createContract(contract *client.Contract, value string) error {
-	log.Println(lib.Green(`--> Submit Transaction:
-    CreateContract, creates new parts entry with ID, Timestamp
-    and all Document details`))
-	_, err := contract.SubmitTransaction("CreateContract", value)
+// createContracts queues a batch of parts on the pipeline. The key can be
+// the timestamp of any part of the batch, since they share a worker. done is
+// called once the batch was submitted.
+func createContracts(pipeline *lib.Pipeline, contract *client.Contract, key string, batch []json.RawMessage, done func()) {
+	lib.Info("submitting transaction", "name", "CreateContracts", "parts", len(batch))
+
+	tx, err := lib.NewBatchTransaction(key, contract, "CreateContracts", batch, func(results []lib.BatchResult, err error) {
+		defer done()
+		if err != nil {
+			lib.HandleError(err)
+			return
+		}
+		for _, result := range results {
+			if result.Error != "" {
+				lib.Warn("part was rejected", "index", result.Index, "timestamp", result.Key, "error", result.Error)
+			}
+		}
+	})
 	if err != nil {
-		return err
+		lib.Error("failed to create batch", "error", err)
+		done()
+		return
 	}
-	return nil
+	pipeline.Submit(tx)
 }
 
 func initLedger(contract *client.Contract) error {
 
-	log.Println(lib.Green("--> Submit Transaction: InitLedger, function the connection with the ledger"))
+	lib.Info("submitting transaction", "name", "InitLedger")
 
 	_, err := contract.SubmitTransaction("InitLedger")
 	if err != nil {
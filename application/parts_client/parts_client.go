@@ -1,164 +1,189 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"log"
-	"os"
-	"os/signal"
-	"path/filepath"
-	"syscall"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib"
 	"github.com/confluentinc/confluent-kafka-go/kafka"
-	"github.com/hyperledger/fabric-gateway/pkg/client"
 )
 
-func loadConfig() *lib.Config {
-	conf := lib.Config{}
-	conf.TlsCertPath = "/fabric/tlscacerts/tlsca-signcert.pem"
-	conf.PeerEndpoint = os.Getenv("fabric_gateway_hostport")
-	conf.GatewayPeer = os.Getenv("fabric_gateway_sslHostOverride")
-	conf.ChannelName = os.Getenv("fabric_channel")
-	conf.ChaincodeName = os.Getenv("fabric_contract")
-	conf.IdentityEndpoint = os.Getenv("identity_endpoint")
-	conf.ConsumerGroup = os.Getenv("consumer_group")
-	conf.DataFolder = os.Getenv("data_folder")
-	conf.JSONFiles = make([]string, 1)
-	conf.JSONFiles[0] = filepath.Join(conf.DataFolder, "parts.json")
-
-	b, err := os.ReadFile("/fabric/application/wallet/appuser_org3.id")
+func loadConfig(path string) *lib.Config {
+	conf, err := lib.LoadConfig(path, lib.Config{
+		OrgNr:     3,
+		JSONFiles: []string{"parts.jsonl"},
+	})
 	if err != nil {
-		log.Fatalf("failed to load config: %v", err)
-	}
-	var userConf lib.UserConfig
-	err = json.Unmarshal(b, &userConf)
-	if err != nil {
-		log.Fatalf("failed to unmarsal userConf: %v", err)
+		lib.Fatal("failed to load config", "error", err)
 	}
 
-	conf.UserConf = &userConf
+	lib.SetupLogging(conf.Log)
+	lib.Info("loaded configuration", "config", conf, "user", conf.UserConf)
 
-	log.Print(conf)
-	log.Print(userConf)
-
-	return &conf
+	return conf
 }
 
 func main() {
-	conf := loadConfig()
+	// The shutdown steps run before run returns, and so before the exit.
+	if err := run(); err != nil {
+		lib.Fatal("client failed", "error", err)
+	}
+}
+
+// run runs the client until it is shut down, or returns the error that
+// stopped it once everything it started was stopped.
+func run() error {
+	configFile := lib.ParseArgs()
+	conf := loadConfig(*configFile[2])
 
 	// The topics that will be used
-	topics := make([]string, 1)
-	topics[0] = "uc3-dlt"
+	topics := []string{conf.Topics.Parts}
 
-	log.Println("============ application-golang starts ============")
+	lib.Info("client starts")
 
-	configFile := lib.ParseArgs()
+	// Everything started below registers its cleanup on shutdown, which runs
+	// on SIGINT or SIGTERM, or when run returns.
+	shutdown := lib.NewShutdown(conf.ShutdownTimeout)
+	defer shutdown.Stop()
 
-	c_parts, err := lib.CreateConsumer(*configFile[0], conf.ConsumerGroup, "beginning")
+	// The offsets are committed once the batches of their records were
+	// submitted, so that a crash does not lose the records being batched.
+	c_parts, offsets, err := lib.CreateTrackedConsumer(*configFile[0], conf.ConsumerGroup, conf.Offsets.Reset)
 	if err != nil {
-		log.Fatalf("failed to create consumer: %v", err)
+		return fmt.Errorf("failed to create consumer: %w", err)
 	}
+	stopConsumer := lib.StopConsumer(c_parts)
+	shutdown.OnStop("kafka consumer", stopConsumer)
 
 	// Subscribe to topic
-	err = c_parts.SubscribeTopics(topics, nil)
+	err = lib.SubscribeTopics(c_parts, topics, conf.Offsets.StartTime())
 	if err != nil {
-		log.Fatalf("failed to connect to topics: %v", err)
+		return fmt.Errorf("failed to connect to topics: %w", err)
 	}
 
-	// Cleanup for when the service terminates
-	sigchan := make(chan os.Signal, 1)
-	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
-
-	clientConnection, err := lib.NewGrpcConnection(*conf)
-	if err != nil {
-		log.Fatalf("failed to establish GRPC connection: %v", err)
+	if conf.Metrics.Listen != "" {
+		metrics := lib.ServeMetrics(conf.Metrics.Listen)
+		shutdown.OnStop("metrics endpoint", metrics.Shutdown)
 	}
-	defer clientConnection.Close()
 
-	id, err := lib.NewIdentity(*conf)
+	connection, err := lib.NewConnectionManager(*conf)
 	if err != nil {
-		log.Fatalf("failed to create new identity: %v", err)
+		return fmt.Errorf("failed to connect to the gateway: %w", err)
 	}
+	shutdown.OnStop("gateway connection", func(context.Context) error {
+		connection.Close()
+		return nil
+	})
 
-	sign, err := lib.NewSign(*conf)
-	if err != nil {
-		log.Fatalf("failed to create new signature: %v", err)
+	contract := connection.Contract()
 
+	err = initLedger(contract)
+	if err != nil {
+		lib.HandleError(err)
+		return fmt.Errorf("failed to initialise the ledger: %w", err)
 	}
 
-	// Create a Gateway connection for a specific client identity
-	gw, err := client.Connect(
-		id,
-		client.WithSign(sign),
-		client.WithClientConnection(clientConnection),
-		// Default timeouts for different gRPC calls
-		client.WithEvaluateTimeout(5*time.Second),
-		client.WithEndorseTimeout(15*time.Second),
-		client.WithSubmitTimeout(5*time.Second),
-		client.WithCommitStatusTimeout(1*time.Minute),
-	)
+	// Open the archive of the incoming json objects
+	f, err := lib.OpenArchive(conf.JSONFiles[0], conf.Archive)
 	if err != nil {
-		log.Fatalf("failed to connect to gateway: %v", err)
+		return fmt.Errorf("failed to open archive: %w", err)
+	}
+	shutdown.OnClose("archive", f)
+
+	// Parts are submitted asynchronously in micro-batches. Each worker of the
+	// pipeline has its own batcher, so parts that share a timestamp are always
+	// submitted in order by the same worker.
+	pipeline := lib.NewPipeline(conf.SubmitWorkers, conf.SubmitQueueSize)
+	shutdown.OnStop("submit pipeline", pipeline.Drain)
+
+	if *reconcile {
+		stopConsumer(shutdown.Context())
+		err = runReconcile(pipeline, contract, *conf)
+		if err != nil {
+			return fmt.Errorf("failed to reconcile: %w", err)
+		}
+		return nil
 	}
-	defer gw.Close()
-
-	network := gw.GetNetwork(conf.ChannelName)
-	contract := network.GetContract(conf.ChaincodeName)
 
-	err = initLedger(contract)
-	if err != nil {
-		lib.HandleError(err)
-		os.Exit(1)
+	// The health endpoint is served only by the running client, since the
+	// one-shot modes above close the consumer that it checks.
+	health := lib.NewHealth(conf.Health.MaxStall)
+	health.AddCheck("gateway", lib.GatewayCheck(connection, contract))
+	health.AddCheck("kafka", lib.ConsumerCheck(c_parts))
+	health.AddCheck("shutdown", shutdown.Check)
+	if conf.Health.Listen != "" {
+		server := lib.ServeHealth(conf.Health.Listen, health)
+		shutdown.OnStop("health endpoint", server.Shutdown)
 	}
 
-	// Open file for logging incoming json objects
-	f, err := lib.OpenJsonFile(conf.JSONFiles[0])
-	if err != nil {
-		log.Fatalf("%v", err)
+	batchers := make([]*lib.Batcher, pipeline.Workers())
+	batchKeys := make([]string, pipeline.Workers())
+	for i := range batchers {
+		batchers[i] = lib.NewBatcher(conf.BatchSize, conf.BatchTimeout)
 	}
-	defer lib.CloseJsonFile(f)
+	shutdown.OnStop("pending batches", func(context.Context) error {
+		for i, batcher := range batchers {
+			if batcher.Len() > 0 {
+				batch, done := batcher.Flush()
+				createContracts(pipeline, contract, batchKeys[i], batch, done)
+			}
+		}
+		return nil
+	})
 
 	var run bool = true
 	for run {
+		health.Beat()
+		for i, batcher := range batchers {
+			if batcher.Ready() {
+				batch, done := batcher.Flush()
+				createContracts(pipeline, contract, batchKeys[i], batch, done)
+			}
+		}
+
 		select {
-		case <-sigchan:
+		case <-shutdown.Done():
 			run = false
 
 		default:
 			msg, err := c_parts.ReadMessage(100 * time.Millisecond)
 			if err != nil {
-				if err.(kafka.Error).Code() == kafka.ErrTimedOut {
+				var kafkaErr kafka.Error
+				if errors.As(err, &kafkaErr) && kafkaErr.Code() == kafka.ErrTimedOut {
 					continue
 				}
-				log.Printf("consumer failed to read: %v", err)
+				lib.Error("consumer failed to read", "error", err)
 				continue
 			}
-			// Print object as json
-			log.Println(string(msg.Value))
+			lib.ObserveMessage(c_parts, msg)
+			logger := lib.MessageLogger(msg)
+			logger.Debug("received message", "value", string(msg.Value))
 
 			var part lib.Part
 
-			// Unmarshal object and print it to stdout
+			// Unmarshal object
 			err = json.Unmarshal(msg.Value, &part)
 			if err != nil {
-				log.Printf("failed to unmarshal: %v", err)
+				lib.ObserveUnmarshalFailure(*msg.TopicPartition.Topic)
+				logger.Error("failed to unmarshal part", "error", err)
+				offsets.Track(msg, 0)
 				continue
 			}
-			log.Println(part)
+			logger.Info("received part", "timestamp", part.Timestamp)
 
 			// Write json object to file
-			jsonToFile, _ := json.MarshalIndent(part, "", " ")
-			if err = lib.WriteJsonObjectToFile(f, jsonToFile); err != nil {
-				log.Printf("%v", err)
+			jsonToFile, _ := json.Marshal(part)
+			if err = f.Write(jsonToFile); err != nil {
+				logger.Error("failed to archive part", "timestamp", part.Timestamp, "error", err)
 			}
 
-			createContract(contract, string(msg.Value))
-			if err != nil {
-				lib.HandleError(err)
-				continue
-			}
+			shard := pipeline.Shard(part.Timestamp)
+			batchKeys[shard] = part.Timestamp
+			batchers[shard].Add(msg.Value, offsets.Track(msg, 1))
 		}
 	}
+	return nil
 }
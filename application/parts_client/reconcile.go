@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+
+	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+var reconcile = flag.Bool("reconcile", false, "Compare the local archive with the ledger, report the differences and exit")
+var resubmit = flag.Bool("resubmit", false, "With -reconcile, submit the records missing from the ledger again")
+
+// runReconcile reports the differences between the archive and the ledger.
+// With -resubmit, the missing parts are submitted again in batches.
+func runReconcile(pipeline *lib.Pipeline, contract *client.Contract, conf lib.Config) error {
+	report, err := lib.ReconcileParts(conf.JSONFiles[0], contract)
+	if err != nil {
+		return err
+	}
+	report.Print(os.Stdout)
+
+	if !*resubmit {
+		return nil
+	}
+	// As when consuming, a batch only holds parts of the same worker.
+	batches := make([][]json.RawMessage, pipeline.Workers())
+	batchKeys := make([]string, pipeline.Workers())
+	for _, item := range report.Missing {
+		shard := pipeline.Shard(item.Key)
+		batchKeys[shard] = item.Key
+		batches[shard] = append(batches[shard], item.Records[0])
+		if len(batches[shard]) >= conf.BatchSize {
+			createContracts(pipeline, contract, batchKeys[shard], batches[shard], func() {})
+			batches[shard] = nil
+		}
+	}
+	for i, batch := range batches {
+		if len(batch) > 0 {
+			createContracts(pipeline, contract, batchKeys[i], batch, func() {})
+		}
+	}
+	lib.Info("resubmitted missing parts", "parts", len(report.Missing))
+	return nil
+}
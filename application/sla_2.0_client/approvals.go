@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib"
+	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib/lifecycle"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// approvalRequest asks the organisations of an SLA to approve its chaincode.
+// Every organisation builds the same package for the chaincode, so the package
+// ID of the request is checked before the chaincode is approved.
+type approvalRequest struct {
+	Chaincode   string   `json:"chaincode"`
+	PackageID   string   `json:"packageId"`
+	Version     string   `json:"version"`
+	Sequence    int64    `json:"sequence"`
+	Orgs        []string `json:"orgs"`
+	RequestedBy string   `json:"requestedBy"`
+}
+
+// requestApprovals publishes the request and waits until Kafka stored it.
+func (d *Deployer) requestApprovals(ctx context.Context, req approvalRequest) error {
+	value, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	delivery := make(chan kafka.Event, 1)
+	err = d.producer.Produce(&kafka.Message{
+		TopicPartition: kafka.TopicPartition{Topic: &d.approvalsTopic, Partition: kafka.PartitionAny},
+		Key:            []byte(req.Chaincode),
+		Value:          value,
+	}, delivery)
+	if err != nil {
+		return fmt.Errorf("failed to request approvals of %s: %w", req.Chaincode, err)
+	}
+
+	select {
+	case e := <-delivery:
+		if m, ok := e.(*kafka.Message); ok && m.TopicPartition.Error != nil {
+			return fmt.Errorf("failed to request approvals of %s: %w", req.Chaincode, m.TopicPartition.Error)
+		}
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to request approvals of %s: %w", req.Chaincode, ctx.Err())
+	}
+}
+
+// approvalsGroup is the consumer group of the approval requests of the
+// organisation.
+func approvalsGroup(conf lib.Config) string {
+	return fmt.Sprintf("%s-%s", conf.ConsumerGroup, conf.UserConf.MspID)
+}
+
+// consumeApprovals hands the approval requests that consumer reads to the
+// deployer, until done is closed.
+func consumeApprovals(done <-chan struct{}, consumer *kafka.Consumer, deployer *Deployer) {
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+
+		msg, err := consumer.ReadMessage(100 * time.Millisecond)
+		if err != nil {
+			var kafkaErr kafka.Error
+			if errors.As(err, &kafkaErr) && kafkaErr.Code() == kafka.ErrTimedOut {
+				continue
+			}
+			lib.Error("approvals consumer failed to read", "error", err)
+			continue
+		}
+		lib.ObserveMessage(consumer, msg)
+		logger := lib.MessageLogger(msg)
+
+		var req approvalRequest
+		if err = json.Unmarshal(msg.Value, &req); err != nil {
+			lib.ObserveUnmarshalFailure(*msg.TopicPartition.Topic)
+			logger.Error("failed to unmarshal approval request", "error", err)
+			continue
+		}
+		logger.Info("received approval request", "chaincode", req.Chaincode, "requested_by", req.RequestedBy)
+		deployer.HandleApprovalRequest(req)
+	}
+}
+
+// HandleApprovalRequest runs the chaincode of the request on the peers of the
+// organisation and approves it, in the background. Requests that are not
+// addressed to the organisation are ignored.
+func (d *Deployer) HandleApprovalRequest(req approvalRequest) {
+	own := d.lc.MspID()
+	if req.RequestedBy == own || !contains(req.Orgs, own) {
+		return
+	}
+
+	d.running.Add(1)
+	go func() {
+		defer d.running.Done()
+		if err := d.join(req); err != nil {
+			lib.Error("failed to approve chaincode", "chaincode", req.Chaincode, "requested_by", req.RequestedBy, "error", err)
+			return
+		}
+		lib.Info("approved chaincode", "chaincode", req.Chaincode, "requested_by", req.RequestedBy)
+	}()
+}
+
+// join takes the steps of a deployment up to the approval of the chaincode,
+// if the request matches the chaincode the organisation would deploy.
+func (d *Deployer) join(req approvalRequest) error {
+	if !strings.HasPrefix(req.Chaincode, d.prefix) {
+		return fmt.Errorf("%s is not the chaincode of an SLA", req.Chaincode)
+	}
+	unlock := d.lock(req.Chaincode)
+	defer unlock()
+
+	ccPackage, ccID, err := d.chaincodePackage(req.Chaincode)
+	if err != nil {
+		return err
+	}
+	// The organisation approves the version it runs the image of.
+	if req.PackageID != ccID || req.Version != d.version || req.Sequence < 1 {
+		return fmt.Errorf("requested package %s, version %s, instead of package %s, version %s",
+			req.PackageID, req.Version, ccID, d.version)
+	}
+	def := lifecycle.Definition{Name: req.Chaincode, Version: req.Version, Sequence: req.Sequence, PackageID: ccID}
+
+	progress, err := d.load(req.Chaincode, ccID)
+	if err != nil || (progress.Sequence >= def.Sequence && progress.done(ccID)) {
+		return err
+	}
+	if progress.ended() {
+		return fmt.Errorf("%s was decommissioned", req.Chaincode)
+	}
+	if def.Sequence > progress.Sequence {
+		progress.Version, progress.Sequence = def.Version, def.Sequence
+	}
+	return d.run(progress, d.joinSteps(ccPackage, def))
+}
+
+// Wait waits for the approval requests being handled.
+func (d *Deployer) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		d.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
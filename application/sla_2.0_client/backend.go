@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib"
+	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib/kube"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Backend runs the chaincode servers of the SLAs. Every method is safe to
+// call again, and only does what is missing.
+type Backend interface {
+	// Address is where the peers reach the chaincode server of a chaincode,
+	// as written in its package. {{.peername}} is replaced by the name of
+	// the peer.
+	Address(ccName string) (string, error)
+	// Launch runs the chaincode servers of a chaincode with the package, or
+	// points the running ones to the package.
+	Launch(ctx context.Context, ccName, ccID string) error
+	// TearDown deletes the chaincode servers of a chaincode, or only stops
+	// them with mode "scale".
+	TearDown(ctx context.Context, ccName, mode string) error
+	// Images returns what the chaincode servers of a chaincode run, per
+	// server: "-" if a server is missing and "?" if it could not be read.
+	Images(ctx context.Context, ccName string) map[string]string
+	// Image is what Launch runs, as Images reports it.
+	Image() string
+	// Objects are the objects of the chaincode servers of a chaincode, as
+	// kind/name.
+	Objects(ccName string) []string
+}
+
+// newBackend creates the backend of the configuration.
+func newBackend(conf lib.Config) (Backend, error) {
+	switch conf.Lifecycle.Backend {
+	case "local":
+		return newLocalBackend(conf.Lifecycle.Local, filepath.Join(conf.DataFolder, "local"))
+	default:
+		config, err := kube.Config(conf.Lifecycle.Kubernetes.Kubeconfig)
+		if err != nil {
+			return nil, fmt.Errorf("lifecycle.kubernetes: %w", err)
+		}
+		clientset, err := kubernetes.NewForConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		return newKubernetesBackend(clientset, conf)
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib"
+	appsv1 "k8s.io/api/apps/v1"
+	apiv1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+)
+
+func int32Ptr(i int32) *int32 { return &i }
+
+// kubernetesBackend runs a chaincode server next to each peer of the
+// organisation, as a Deployment and a Service in the namespace of the peers.
+type kubernetesBackend struct {
+	k8s       kubernetes.Interface
+	namespace string
+	image     string
+	orgNr     int
+	labels    map[string]string
+	resources apiv1.ResourceRequirements
+}
+
+func newKubernetesBackend(clientset kubernetes.Interface, conf lib.Config) (*kubernetesBackend, error) {
+	k := conf.Lifecycle.Kubernetes
+	b := &kubernetesBackend{
+		k8s:       clientset,
+		namespace: k.Namespace,
+		image:     conf.Lifecycle.Image,
+		orgNr:     conf.OrgNr,
+		labels:    make(map[string]string, len(k.Labels)),
+		resources: apiv1.ResourceRequirements{Requests: apiv1.ResourceList{}, Limits: apiv1.ResourceList{}},
+	}
+	for _, label := range k.Labels {
+		b.labels[label.Key] = label.Value
+	}
+
+	for _, r := range []struct {
+		list  apiv1.ResourceList
+		name  apiv1.ResourceName
+		value string
+	}{
+		{b.resources.Requests, apiv1.ResourceCPU, k.Resources.CPURequest},
+		{b.resources.Requests, apiv1.ResourceMemory, k.Resources.MemoryRequest},
+		{b.resources.Limits, apiv1.ResourceCPU, k.Resources.CPULimit},
+		{b.resources.Limits, apiv1.ResourceMemory, k.Resources.MemoryLimit},
+	} {
+		if r.value == "" {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(r.value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s resources of the chaincode servers: %w", r.name, err)
+		}
+		r.list[r.name] = quantity
+	}
+	return b, nil
+}
+
+// Address is the Service next to the peer.
+func (b *kubernetesBackend) Address(ccName string) (string, error) {
+	return fmt.Sprintf("{{.peername}}-ccaas-%s:8999", ccName), nil
+}
+
+func (b *kubernetesBackend) Launch(ctx context.Context, ccName, ccID string) error {
+	for _, peer := range []string{"peer1", "peer2"} {
+		if err := b.launch(ctx, peer, ccName, ccID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *kubernetesBackend) TearDown(ctx context.Context, ccName, mode string) error {
+	for _, peer := range []string{"peer1", "peer2"} {
+		if err := b.tearDown(ctx, peer, ccName, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Images returns the images of the Deployments, per peer.
+func (b *kubernetesBackend) Images(ctx context.Context, ccName string) map[string]string {
+	images := map[string]string{}
+	for _, peer := range []string{"peer1", "peer2"} {
+		deployment, err := b.k8s.AppsV1().Deployments(b.namespace).Get(ctx, b.serverName(peer, ccName), metav1.GetOptions{})
+		switch {
+		case apierrors.IsNotFound(err):
+			images[peer] = "-"
+		case err != nil:
+			images[peer] = "?"
+		default:
+			images[peer] = chaincodeImage(deployment)
+		}
+	}
+	return images
+}
+
+func (b *kubernetesBackend) Image() string {
+	return b.image
+}
+
+func (b *kubernetesBackend) Objects(ccName string) []string {
+	var objects []string
+	for _, peer := range []string{"peer1", "peer2"} {
+		name := b.serverName(peer, ccName)
+		objects = append(objects, "deployment/"+name, "service/"+name)
+	}
+	return objects
+}
+
+// serverName is the name of the Deployment and the Service of the chaincode
+// server of a peer.
+func (b *kubernetesBackend) serverName(peer, ccName string) string {
+	return fmt.Sprintf("org%d%s-ccaas-%s", b.orgNr, peer, ccName)
+}
+
+// withLabels returns the configured labels and labels.
+func (b *kubernetesBackend) withLabels(labels map[string]string) map[string]string {
+	all := make(map[string]string, len(b.labels)+len(labels))
+	for k, v := range b.labels {
+		all[k] = v
+	}
+	for k, v := range labels {
+		all[k] = v
+	}
+	return all
+}
+
+// launch creates the Deployment and the Service of the chaincode server of a
+// peer, or points an existing Deployment to the package and the image.
+func (b *kubernetesBackend) launch(ctx context.Context, peer, ccName, ccID string) error {
+	deploymentName := b.serverName(peer, ccName)
+	deploymentsClient := b.k8s.AppsV1().Deployments(b.namespace)
+	servicesClient := b.k8s.CoreV1().Services(b.namespace)
+
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   deploymentName,
+			Labels: b.withLabels(nil),
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: int32Ptr(1),
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"app": deploymentName,
+				},
+			},
+			Template: apiv1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: b.withLabels(map[string]string{
+						"app": deploymentName,
+					}),
+				},
+				Spec: apiv1.PodSpec{
+					Containers: []apiv1.Container{
+						{
+							Name:            "main",
+							Image:           b.image,
+							ImagePullPolicy: apiv1.PullIfNotPresent,
+							Env: []apiv1.EnvVar{
+								{
+									Name:  "CHAINCODE_SERVER_ADDRESS",
+									Value: "0.0.0.0:8999",
+								},
+								{
+									Name:  "CHAINCODE_ID",
+									Value: ccID,
+								},
+								{
+									Name:  "CORE_CHAINCODE_ID_NAME",
+									Value: ccID,
+								},
+								{
+									Name:  "CHAINCODE_HEALTH_ADDRESS",
+									Value: "0.0.0.0:8998",
+								},
+							},
+							Ports: []apiv1.ContainerPort{
+								{
+									ContainerPort: 8999,
+								},
+								{
+									Name:          "health",
+									ContainerPort: 8998,
+								},
+							},
+							Resources: b.resources,
+							ReadinessProbe: &apiv1.Probe{
+								ProbeHandler: apiv1.ProbeHandler{
+									HTTPGet: &apiv1.HTTPGetAction{Path: "/readyz", Port: intstr.FromString("health")},
+								},
+							},
+							LivenessProbe: &apiv1.Probe{
+								ProbeHandler: apiv1.ProbeHandler{
+									HTTPGet: &apiv1.HTTPGetAction{Path: "/livez", Port: intstr.FromString("health")},
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+
+	service := &apiv1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   deploymentName,
+			Labels: b.withLabels(nil),
+		},
+		Spec: apiv1.ServiceSpec{
+			Ports: []apiv1.ServicePort{
+				{
+					Name:     "chaincode",
+					Port:     8999,
+					Protocol: apiv1.ProtocolTCP,
+				},
+			},
+			Selector: map[string]string{
+				"app": deploymentName,
+			},
+		},
+	}
+
+	existing, err := deploymentsClient.Get(ctx, deploymentName, metav1.GetOptions{})
+	switch {
+	case apierrors.IsNotFound(err):
+		lib.Info("creating deployment", "deployment", deploymentName)
+		if _, err = deploymentsClient.Create(ctx, deployment, metav1.CreateOptions{}); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	case chaincodeID(existing) != ccID || chaincodeImage(existing) != b.image:
+		lib.Info("updating deployment", "deployment", deploymentName, "package_id", ccID, "image", b.image)
+		existing.Spec = deployment.Spec
+		if _, err = deploymentsClient.Update(ctx, existing, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+	}
+
+	_, err = servicesClient.Get(ctx, deploymentName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		lib.Info("creating service", "service", deploymentName)
+		_, err = servicesClient.Create(ctx, service, metav1.CreateOptions{})
+	}
+	return err
+}
+
+// tearDown deletes the Deployment and the Service of the chaincode server of a
+// peer, or scales the Deployment to zero, depending on mode.
+func (b *kubernetesBackend) tearDown(ctx context.Context, peer, ccName, mode string) error {
+	name := b.serverName(peer, ccName)
+	deploymentsClient := b.k8s.AppsV1().Deployments(b.namespace)
+	servicesClient := b.k8s.CoreV1().Services(b.namespace)
+
+	if mode == "scale" {
+		deployment, err := deploymentsClient.Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		lib.Info("scaling deployment to zero", "deployment", name)
+		deployment.Spec.Replicas = int32Ptr(0)
+		_, err = deploymentsClient.Update(ctx, deployment, metav1.UpdateOptions{})
+		return err
+	}
+
+	lib.Info("deleting deployment and service", "deployment", name)
+	err := deploymentsClient.Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	err = servicesClient.Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// chaincodeID returns the package the chaincode server of a Deployment serves.
+func chaincodeID(deployment *appsv1.Deployment) string {
+	for _, container := range deployment.Spec.Template.Spec.Containers {
+		for _, env := range container.Env {
+			if env.Name == "CHAINCODE_ID" {
+				return env.Value
+			}
+		}
+	}
+	return ""
+}
+
+// chaincodeImage returns the image of the chaincode server of a Deployment.
+func chaincodeImage(deployment *appsv1.Deployment) string {
+	for _, container := range deployment.Spec.Template.Spec.Containers {
+		return container.Image
+	}
+	return ""
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib"
+)
+
+// localBackend runs one chaincode server per chaincode as a process next to
+// the client, which both peers connect to. The port of every chaincode is
+// kept in the state folder, so that its package, which holds the address,
+// stays the same. The servers stop with the client and are started again by
+// Resume.
+type localBackend struct {
+	command   string
+	host      string
+	firstPort int
+	lastPort  int
+	dir       string
+
+	mu        sync.Mutex
+	processes map[string]*localProcess
+}
+
+// localServer is the state of the chaincode server of a chaincode.
+type localServer struct {
+	Chaincode string `json:"chaincode"`
+	Port      int    `json:"port"`
+	PackageID string `json:"packageId,omitempty"`
+	Stopped   bool   `json:"stopped,omitempty"`
+}
+
+type localProcess struct {
+	cmd  *exec.Cmd
+	ccID string
+	done chan struct{}
+}
+
+func newLocalBackend(conf lib.LocalBackend, dir string) (*localBackend, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create local backend folder: %w", err)
+	}
+	b := &localBackend{
+		command:   conf.Command,
+		host:      conf.Host,
+		firstPort: conf.FirstPort,
+		lastPort:  conf.LastPort,
+		dir:       dir,
+		processes: map[string]*localProcess{},
+	}
+	return b, nil
+}
+
+// Resume starts the chaincode servers that ran when the client stopped.
+func (b *localBackend) Resume() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	servers, err := b.servers()
+	if err != nil {
+		return err
+	}
+	for _, s := range servers {
+		if _, ok := b.processes[s.Chaincode]; ok || s.PackageID == "" || s.Stopped {
+			continue
+		}
+		if err = b.start(s); err != nil {
+			lib.Error("failed to start chaincode server", "chaincode", s.Chaincode, "error", err)
+		}
+	}
+	return nil
+}
+
+// Address allocates a port to the chaincode the first time.
+func (b *localBackend) Address(ccName string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, found, err := b.load(ccName)
+	if err != nil {
+		return "", err
+	}
+	if found {
+		return fmt.Sprintf("%s:%d", b.host, s.Port), nil
+	}
+
+	servers, err := b.servers()
+	if err != nil {
+		return "", err
+	}
+	used := map[int]bool{}
+	for _, s := range servers {
+		used[s.Port] = true
+	}
+	for port := b.firstPort; port <= b.lastPort; port++ {
+		if !used[port] {
+			if err = b.save(localServer{Chaincode: ccName, Port: port}); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("%s:%d", b.host, port), nil
+		}
+	}
+	return "", fmt.Errorf("no free port for %s in %d-%d", ccName, b.firstPort, b.lastPort)
+}
+
+func (b *localBackend) Launch(ctx context.Context, ccName, ccID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	s, found, err := b.load(ccName)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("%s has no port", ccName)
+	}
+	if p, ok := b.processes[ccName]; ok {
+		if p.ccID == ccID {
+			return nil
+		}
+		if err = b.stop(ctx, ccName); err != nil {
+			return err
+		}
+	}
+
+	s.PackageID, s.Stopped = ccID, false
+	if err = b.save(s); err != nil {
+		return err
+	}
+	return b.start(s)
+}
+
+func (b *localBackend) TearDown(ctx context.Context, ccName, mode string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.stop(ctx, ccName); err != nil {
+		return err
+	}
+	if mode == "scale" {
+		s, found, err := b.load(ccName)
+		if err != nil || !found {
+			return err
+		}
+		s.Stopped = true
+		return b.save(s)
+	}
+	err := os.Remove(b.path(ccName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Images returns the command of the running chaincode server.
+func (b *localBackend) Images(ctx context.Context, ccName string) map[string]string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.processes[ccName]; ok {
+		return map[string]string{"local": b.command}
+	}
+	return map[string]string{"local": "-"}
+}
+
+func (b *localBackend) Image() string {
+	return b.command
+}
+
+func (b *localBackend) Objects(ccName string) []string {
+	return []string{"process/" + ccName}
+}
+
+// Close stops the chaincode servers.
+func (b *localBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for ccName := range b.processes {
+		if err := b.stop(ctx, ccName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// start runs the chaincode server, with its output appended to its log file.
+func (b *localBackend) start(s localServer) error {
+	log, err := os.OpenFile(filepath.Join(b.dir, s.Chaincode+".log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(b.command)
+	cmd.Env = append(os.Environ(),
+		"CHAINCODE_ID="+s.PackageID,
+		"CORE_CHAINCODE_ID_NAME="+s.PackageID,
+		fmt.Sprintf("CHAINCODE_SERVER_ADDRESS=:%d", s.Port),
+	)
+	cmd.Stdout, cmd.Stderr = log, log
+	if err = cmd.Start(); err != nil {
+		log.Close()
+		return fmt.Errorf("failed to start chaincode server of %s: %w", s.Chaincode, err)
+	}
+	lib.Info("started chaincode server", "chaincode", s.Chaincode, "port", s.Port, "pid", cmd.Process.Pid)
+
+	p := &localProcess{cmd: cmd, ccID: s.PackageID, done: make(chan struct{})}
+	b.processes[s.Chaincode] = p
+	go func() {
+		err := cmd.Wait()
+		log.Close()
+		close(p.done)
+		lib.Info("chaincode server exited", "chaincode", s.Chaincode, "error", err)
+
+		b.mu.Lock()
+		if b.processes[s.Chaincode] == p {
+			delete(b.processes, s.Chaincode)
+		}
+		b.mu.Unlock()
+	}()
+	return nil
+}
+
+// stop terminates the chaincode server, and kills it if it does not exit
+// before ctx is done.
+func (b *localBackend) stop(ctx context.Context, ccName string) error {
+	p, ok := b.processes[ccName]
+	if !ok {
+		return nil
+	}
+	delete(b.processes, ccName)
+
+	lib.Info("stopping chaincode server", "chaincode", ccName)
+	if err := p.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		return p.cmd.Process.Kill()
+	}
+	select {
+	case <-p.done:
+		return nil
+	case <-ctx.Done():
+		return p.cmd.Process.Kill()
+	}
+}
+
+func (b *localBackend) path(ccName string) string {
+	return filepath.Join(b.dir, ccName+".json")
+}
+
+func (b *localBackend) load(ccName string) (localServer, bool, error) {
+	var s localServer
+	data, err := os.ReadFile(b.path(ccName))
+	if errors.Is(err, os.ErrNotExist) {
+		return s, false, nil
+	}
+	if err != nil {
+		return s, false, err
+	}
+	if err = json.Unmarshal(data, &s); err != nil {
+		return s, false, fmt.Errorf("invalid chaincode server of %s: %w", ccName, err)
+	}
+	return s, true, nil
+}
+
+func (b *localBackend) servers() ([]localServer, error) {
+	paths, err := filepath.Glob(filepath.Join(b.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	servers := make([]localServer, 0, len(paths))
+	for _, path := range paths {
+		var s localServer
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(data, &s); err != nil {
+			return nil, fmt.Errorf("invalid chaincode server %s: %w", path, err)
+		}
+		servers = append(servers, s)
+	}
+	return servers, nil
+}
+
+// save replaces the state of a chaincode server atomically.
+func (b *localBackend) save(s localServer) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := b.path(s.Chaincode) + ".tmp"
+	if err = os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.path(s.Chaincode))
+}
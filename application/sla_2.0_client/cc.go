@@ -1,419 +1,302 @@
 package main
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
-	"io"
-	"log"
-	"os"
-	"os/exec"
 	"path/filepath"
-	"regexp"
-	"strconv"
-	"strings"
+	"sync"
+	"time"
 
 	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib"
-	appsv1 "k8s.io/api/apps/v1"
-	apiv1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-
-	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
+	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib/lifecycle"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
 )
 
-func int32Ptr(i int32) *int32 { return &i }
-
-func runCommand(args, env []string, dir *string) (bytes.Buffer, error) {
-	if len(args) < 1 {
-		return bytes.Buffer{}, fmt.Errorf("too few arguments to run command")
-	}
-
-	cmd := exec.Command(args[0], args[1:]...)
-
-	if dir != nil {
-		cmd.Dir = *dir
-	}
-
-	var outb, errb bytes.Buffer
-	outWriter := io.MultiWriter(&outb, os.Stdout)
-	errWriter := io.MultiWriter(&errb, os.Stderr)
-
-	cmd.Stdout = outWriter
-	cmd.Stderr = errWriter
-
-	if len(env) > 0 {
-		cmd.Env = os.Environ()
-		cmd.Env = append(cmd.Env, env...)
-	}
-
-	err := cmd.Run()
-	if err != nil {
-		return bytes.Buffer{}, err
-	}
-
-	return outb, nil
+// Lifecycle manages the definitions of the chaincodes on the channel, as
+// *lifecycle.Client does.
+type Lifecycle interface {
+	MspID() string
+	Install(ctx context.Context, pkg []byte) (lifecycle.InstalledChaincode, error)
+	QueryInstalled(ctx context.Context) ([]lifecycle.InstalledChaincode, error)
+	Approve(ctx context.Context, def lifecycle.Definition) error
+	CheckCommitReadiness(ctx context.Context, def lifecycle.Definition) (map[string]bool, error)
+	WaitForApprovals(ctx context.Context, def lifecycle.Definition, orgs []string) error
+	Commit(ctx context.Context, def lifecycle.Definition, orgs []string) error
+	QueryCommitted(ctx context.Context, name string) (lifecycle.Definition, error)
 }
 
-func DeployCC(ccName string, orgNr int, conf lib.Config) error {
-	ccLabel := ccName
-
-	// TODO: Change this when changing the registry
-	ccImage := "147.102.19.6/pledger/slasc-bridge"
-
-	orgNamespace := "pledger-dlt"
-
-	dir, err := os.MkdirTemp("", "*")
-	if err != nil {
-		return err
-	}
-	defer os.RemoveAll(dir) // clean up
-
-	ccPackage := filepath.Join(dir, fmt.Sprintf("%s.tgz", ccName))
-
-	err = packageCC(ccName, ccLabel, ccPackage)
-	if err != nil {
-		return err
-	}
-
-	ccID, err := setId(ccPackage)
-	if err != nil {
-		return err
-	}
-	ccID = strings.TrimSpace(ccID)
-	log.Printf("Chaincode ID: %s", ccID)
-
-	log.Printf("Deploying Chaincodes")
-	err = launchCC(orgNr, orgNamespace, "peer1", ccName, ccID, ccImage)
-	if err != nil {
-		return err
-	}
-
-	err = launchCC(orgNr, orgNamespace, "peer2", ccName, ccID, ccImage)
-	if err != nil {
-		return err
-	}
-	log.Printf("Deployed Chaincodes")
-
-	log.Printf("Activating Chaincodes")
-	err = ActivateCC(orgNr, ccName, ccPackage, ccID, conf)
-	if err != nil {
-		return err
-	}
-	log.Printf("Activated Chaincodes")
-
-	err = queryMetadata(orgNr, ccName, conf)
-	if err != nil {
-		return err
-	}
-	return nil
+// Producer publishes the approval requests, as *kafka.Producer does.
+type Producer interface {
+	Produce(msg *kafka.Message, deliveryChan chan kafka.Event) error
 }
 
-func packageCC(ccName, ccLabel, ccPackage string) error {
+// Contract is the chaincode of an SLA, as *client.Contract is.
+type Contract interface {
+	ChaincodeName() string
+	EvaluateTransaction(name string, args ...string) ([]byte, error)
+	SubmitTransaction(name string, args ...string) ([]byte, error)
+}
 
-	args := []string{"./scripts/cc.sh", "package", ccName, ccLabel, ccPackage}
+// Deployer deploys the chaincode of every SLA: its chaincode servers, which
+// the backend runs, and the definition of the chaincode on the channel.
+// Every step checks what is already there and only does what is missing, so
+// an interrupted deployment is completed by running it again.
+type Deployer struct {
+	lc             Lifecycle
+	backend        Backend
+	store          *deploymentStore
+	producer       Producer
+	approvalsTopic string
+	prefix         string
+	exportDir      string
+	teardownMode   string
+	version        string
+	// approvers returns the organisations that approve the chaincode of an
+	// SLA between provider and client.
+	approvers       func(provider, client string) []string
+	timeout         time.Duration
+	approvalTimeout time.Duration
+	// locks holds a mutex per chaincode, as the deployment of an SLA and the
+	// approval requests of the other organisations may run at once.
+	locks   sync.Map
+	running sync.WaitGroup
+}
 
-	_, err := runCommand(args, nil, nil)
+// NewDeployer creates a Deployer that runs the chaincode servers with backend.
+// It keeps the progress of the deployments in the deployments folder of the
+// data folder, and the world state of the chaincodes of the SLAs that ended
+// in the exports folder.
+// The approval requests are published with producer.
+func NewDeployer(lc Lifecycle, backend Backend, producer Producer, conf lib.Config) (*Deployer, error) {
+	store, err := newDeploymentStore(filepath.Join(conf.DataFolder, "deployments"))
 	if err != nil {
-		return err
-	}
-	return nil
+		return nil, err
+	}
+	return &Deployer{
+		lc:              lc,
+		backend:         backend,
+		store:           store,
+		producer:        producer,
+		approvalsTopic:  conf.Topics.Approvals,
+		prefix:          fmt.Sprintf("%v-", conf.ContractNamePrefix),
+		exportDir:       filepath.Join(conf.DataFolder, "exports"),
+		teardownMode:    conf.Lifecycle.Teardown,
+		version:         conf.Lifecycle.Version,
+		approvers:       conf.Lifecycle.ApprovingOrgs,
+		timeout:         conf.Lifecycle.Timeout,
+		approvalTimeout: conf.Lifecycle.ApprovalTimeout,
+	}, nil
 }
 
-func setId(ccPackage string) (string, error) {
-	args := []string{"./scripts/cc.sh", "id", ccPackage}
-
-	out, err := runCommand(args, nil, nil)
-	if err != nil {
-		return "", err
-	}
-	return out.String(), nil
+// step is a step of a deployment, named after the state it leads to.
+type step struct {
+	name    string
+	timeout time.Duration
+	run     func(ctx context.Context) error
 }
 
-func launchCC(orgNr int, orgNamespace, peer, ccName, ccID, ccImage string) error {
-	deploymentName := fmt.Sprintf("org%d%s-ccaas-%s", orgNr, peer, ccName)
+// Deploy deploys the chaincode of an SLA, or completes its deployment, and
+// initialises its ledger. The first definition of the chaincode has the
+// configured version. The chaincode is committed once the organisation and
+// the other organisations in orgs approved it. It returns at once if the
+// chaincode was deployed, and fails if it was decommissioned.
+func (d *Deployer) Deploy(ccName string, orgs []string, contract Contract) error {
+	unlock := d.lock(ccName)
+	defer unlock()
 
-	config, err := rest.InClusterConfig()
+	ccPackage, ccID, err := d.chaincodePackage(ccName)
 	if err != nil {
 		return err
 	}
-
-	// creates the clientset
-	clientset, err := kubernetes.NewForConfig(config)
-	if err != nil {
+	progress, err := d.load(ccName, ccID)
+	if err != nil || progress.done(ccID) {
 		return err
 	}
-
-	deploymentsClient := clientset.AppsV1().Deployments(orgNamespace)
-	servicesClient := clientset.CoreV1().Services(orgNamespace)
-
-	deployment := &appsv1.Deployment{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: deploymentName,
-		},
-		Spec: appsv1.DeploymentSpec{
-			Replicas: int32Ptr(1),
-			Selector: &metav1.LabelSelector{
-				MatchLabels: map[string]string{
-					"app": deploymentName,
-				},
-			},
-			Template: apiv1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{
-					Labels: map[string]string{
-						"app": deploymentName,
-					},
-				},
-				Spec: apiv1.PodSpec{
-					Containers: []apiv1.Container{
-						{
-							Name:            "main",
-							Image:           ccImage,
-							ImagePullPolicy: apiv1.PullIfNotPresent,
-							Env: []apiv1.EnvVar{
-								{
-									Name:  "CHAINCODE_SERVER_ADDRESS",
-									Value: "0.0.0.0:8999",
-								},
-								{
-									Name:  "CHAINCODE_ID",
-									Value: ccID,
-								},
-								{
-									Name:  "CORE_CHAINCODE_ID_NAME",
-									Value: ccID,
-								},
-							},
-							Ports: []apiv1.ContainerPort{
-								{
-									ContainerPort: 8999,
-								},
-							},
-						},
-					},
-				},
-			},
-		},
+	if progress.ended() {
+		return fmt.Errorf("%s was decommissioned", ccName)
 	}
 
-	service := &apiv1.Service{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: deploymentName,
-		},
-		Spec: apiv1.ServiceSpec{
-			Ports: []apiv1.ServicePort{
-				{
-					Name:     "chaincode",
-					Port:     8999,
-					Protocol: apiv1.ProtocolTCP,
-				},
-			},
-			Selector: map[string]string{
-				"app": deploymentName,
-			},
-		},
+	def := lifecycle.Definition{Name: ccName, Version: d.version, Sequence: 1, PackageID: ccID}
+	if progress.Sequence > 0 {
+		// The definition that was being deployed, or upgraded to, is resumed.
+		def.Version, def.Sequence = progress.Version, progress.Sequence
 	}
+	orgs = approvingOrgs(d.lc.MspID(), orgs)
+	progress.Version, progress.Sequence, progress.Orgs = def.Version, def.Sequence, orgs
+	steps := append(d.joinSteps(ccPackage, def),
+		step{stepCommitted, d.timeout + d.approvalTimeout, func(ctx context.Context) error { return d.commit(ctx, def, orgs) }},
+		step{stepInitialized, d.timeout, func(context.Context) error { return InitLedger(contract) }},
+	)
+	lib.Info("deploying chaincodes", "chaincode", ccName, "package_id", ccID, "step", progress.Step, "orgs", orgs)
+	return d.run(progress, steps)
+}
 
-	log.Println("Creating deployment...")
-	deploymentRes, err := deploymentsClient.Create(context.TODO(), deployment, metav1.CreateOptions{})
-	if err != nil {
-		return err
+// joinSteps are the steps that run the chaincode on the peers of the
+// organisation and approve it, which every organisation of the SLA takes.
+func (d *Deployer) joinSteps(ccPackage []byte, def lifecycle.Definition) []step {
+	return []step{
+		{stepLaunched, d.timeout, func(ctx context.Context) error { return d.backend.Launch(ctx, def.Name, def.PackageID) }},
+		{stepInstalled, d.timeout, func(ctx context.Context) error { return d.install(ctx, ccPackage, def.PackageID) }},
+		{stepApproved, d.timeout, func(ctx context.Context) error { return d.approve(ctx, def) }},
 	}
-	log.Printf("Created deployment %q.\n", deploymentRes.GetObjectMeta().GetName())
+}
 
-	serviceRes, err := servicesClient.Create(context.TODO(), service, metav1.CreateOptions{})
-	if err != nil {
-		return err
+// run runs the steps in order and records the progress of the deployment
+// after each of them.
+func (d *Deployer) run(progress deployment, steps []step) error {
+	for _, step := range steps {
+		ctx, cancel := context.WithTimeout(context.Background(), step.timeout)
+		err := step.run(ctx)
+		cancel()
+		if err != nil {
+			progress.Error = err.Error()
+			if saveErr := d.store.save(progress); saveErr != nil {
+				lib.Warn("failed to save deployment", "chaincode", progress.Chaincode, "error", saveErr)
+			}
+			return fmt.Errorf("failed to deploy %s after step %q: %w", progress.Chaincode, progress.Step, err)
+		}
+		progress.Step, progress.Error = step.name, ""
+		if err = d.store.save(progress); err != nil {
+			return fmt.Errorf("failed to save deployment of %s: %w", progress.Chaincode, err)
+		}
+		lib.Info("completed step", "chaincode", progress.Chaincode, "step", step.name)
 	}
-	log.Printf("Created service %q.\n", serviceRes.GetObjectMeta().GetName())
-
 	return nil
 }
 
-func ActivateCC(orgNr int, ccName, ccPackage, ccID string, conf lib.Config) error {
-	log.Printf("Installing chaincodes")
-	err := installCC(orgNr, 1, ccName, ccPackage, conf)
+// load returns the progress of the deployment of a package, which starts over
+// if an earlier package of the chaincode was being deployed.
+func (d *Deployer) load(ccName, ccID string) (deployment, error) {
+	progress, err := d.store.load(ccName)
 	if err != nil {
-		return err
+		return progress, err
 	}
-
-	err = installCC(orgNr, 2, ccName, ccPackage, conf)
-	if err != nil {
-		return err
+	if progress.PackageID != ccID {
+		progress = deployment{Chaincode: ccName, PackageID: ccID}
 	}
+	return progress, nil
+}
 
-	//QueryInstalled(orgNr, ccName, conf)
-	log.Printf("Installed chaincodes")
-	log.Printf("Approving chaincodes")
-
-	err = approveCC(orgNr, ccName, ccID, conf)
-	if err != nil {
-		return err
-	}
-	log.Printf("Approved chaincodes")
+func (d *Deployer) lock(ccName string) func() {
+	mu, _ := d.locks.LoadOrStore(ccName, &sync.Mutex{})
+	mu.(*sync.Mutex).Lock()
+	return mu.(*sync.Mutex).Unlock
+}
 
-	err = checkCommitReadiness(orgNr, ccName, conf)
+// chaincodePackage returns the package of the chaincode of an SLA and its ID,
+// which are the same in every organisation that runs the same backend.
+func (d *Deployer) chaincodePackage(ccName string) ([]byte, string, error) {
+	address, err := d.backend.Address(ccName)
 	if err != nil {
-		return err
+		return nil, "", err
 	}
-
-	log.Printf("Committing chaincodes")
-
-	err = commitCC(orgNr, ccName, conf)
+	ccPackage, err := lifecycle.Package(ccName, lifecycle.Connection{
+		Address:     address,
+		DialTimeout: "10s",
+	})
 	if err != nil {
-		return err
+		return nil, "", fmt.Errorf("failed to package %s: %w", ccName, err)
 	}
-	log.Printf("Committed chaincodes")
-
-	return nil
+	return ccPackage, lifecycle.PackageID(ccName, ccPackage), nil
 }
 
-func installCC(orgNr, peerNr int, ccName, ccPackage string, conf lib.Config) error {
-	args := []string{
-		"./scripts/cc.sh",
-		"install",
-		strconv.Itoa(orgNr),
-		strconv.Itoa(peerNr),
-		conf.TlsCertPath,
-		ccPackage,
-	}
-
-	_, err := runCommand(args, nil, nil)
-	if err != nil {
-		return err
-	}
-	return nil
-
+// approvingOrgs returns own followed by the other organisations, without duplicates.
+func approvingOrgs(own string, others []string) []string {
+	orgs := []string{own}
+	seen := map[string]bool{own: true}
+	for _, org := range others {
+		if !seen[org] {
+			seen[org] = true
+			orgs = append(orgs, org)
+		}
+	}
+	return orgs
 }
 
-func approveCC(orgNr int, ccName, ccID string, conf lib.Config) error {
-	env := []string{
-		"CHANNEL_NAME=" + conf.ChannelName,
-		"ORDERER_TIMEOUT=10s",
-	}
-
-	args := []string{
-		"./scripts/cc.sh",
-		"approve",
-		strconv.Itoa(orgNr),
-		ccName,
-		ccID,
-		conf.TlsCertPath,
-	}
-
-	_, err := runCommand(args, env, nil)
+// install installs the package on the peers of the organisation. The peers
+// that have it already are left as they are.
+func (d *Deployer) install(ctx context.Context, ccPackage []byte, ccID string) error {
+	result, err := d.lc.Install(ctx, ccPackage)
 	if err != nil {
 		return err
 	}
-	return nil
-}
-
-func commitCC(orgNr int, ccName string, conf lib.Config) error {
-	env := []string{
-		"CHANNEL_NAME=" + conf.ChannelName,
-		"ORDERER_TIMEOUT=10s",
-	}
-
-	args := []string{
-		"./scripts/cc.sh",
-		"commit",
-		strconv.Itoa(orgNr),
-		ccName,
-		conf.TlsCertPath,
-	}
-
-	_, err := runCommand(args, env, nil)
-	if err != nil {
-		return err
+	if result.PackageID != ccID {
+		return fmt.Errorf("peers installed the package as %s instead of %s", result.PackageID, ccID)
 	}
-
 	return nil
 }
 
-func queryMetadata(orgNr int, ccName string, conf lib.Config) error {
-
-	env := []string{
-		"CHANNEL_NAME=" + conf.ChannelName,
-	}
-	args := []string{
-		"./scripts/cc.sh",
-		"query",
-		"metadata",
-		ccName,
-		strconv.Itoa(orgNr),
-		conf.TlsCertPath,
+// approve approves the chaincode for the organisation, unless it was approved
+// or committed already.
+func (d *Deployer) approve(ctx context.Context, def lifecycle.Definition) error {
+	committed, err := d.committed(ctx, def)
+	if err != nil || committed {
+		return err
 	}
-
-	_, err := runCommand(args, env, nil)
-	if err != nil {
+	approvals, err := d.lc.CheckCommitReadiness(ctx, def)
+	if err != nil || approvals[d.lc.MspID()] {
 		return err
 	}
-
-	return nil
+	lib.Info("approving chaincodes", "chaincode", def.Name)
+	return d.lc.Approve(ctx, def)
 }
 
-func QueryInstalled(orgNr int, ccName string, conf lib.Config) (bool, error) {
-
-	args := []string{
-		"./scripts/cc.sh",
-		"query",
-		"installed",
-		strconv.Itoa(orgNr),
-		conf.TlsCertPath,
+// commit commits the chaincode once all the organisations approved it. The
+// organisations that did not are asked to, and waited for.
+func (d *Deployer) commit(ctx context.Context, def lifecycle.Definition, orgs []string) error {
+	committed, err := d.committed(ctx, def)
+	if err != nil || committed {
+		return err
 	}
 
-	res, err := runCommand(args, nil, nil)
+	approvals, err := d.lc.CheckCommitReadiness(ctx, def)
 	if err != nil {
-		return false, err
-	}
-
-	match, _ := regexp.MatchString(ccName, res.String())
-
-	return match, nil
-}
-
-func GetAllInstalled(orgNr int, conf lib.Config) ([]string, error) {
-	args := []string{
-		"./scripts/cc.sh",
-		"query",
-		"installed_one",
-		strconv.Itoa(orgNr),
-		conf.TlsCertPath,
-		"1", // peer number
+		return err
 	}
-
-	res, err := runCommand(args, nil, nil)
+	var missing []string
+	for _, org := range orgs {
+		if !approvals[org] {
+			missing = append(missing, org)
+		}
+	}
+	if len(missing) > 0 {
+		lib.Info("requesting approvals", "chaincode", def.Name, "orgs", missing)
+		err = d.requestApprovals(ctx, approvalRequest{
+			Chaincode:   def.Name,
+			PackageID:   def.PackageID,
+			Version:     def.Version,
+			Sequence:    def.Sequence,
+			Orgs:        orgs,
+			RequestedBy: d.lc.MspID(),
+		})
+		if err != nil {
+			return err
+		}
+		waitCtx, cancel := context.WithTimeout(ctx, d.approvalTimeout)
+		err = d.lc.WaitForApprovals(waitCtx, def, orgs)
+		cancel()
+		if err != nil {
+			return err
+		}
+	}
+
+	lib.Info("committing chaincodes", "chaincode", def.Name, "orgs", orgs)
+	err = d.lc.Commit(ctx, def, orgs)
 	if err != nil {
-		return []string{}, err
-	}
-	r, _ := regexp.Compile("Label: .*\n")
-	ccs_with_label := r.FindAllString(res.String(), -1)
-
-	ccs := make([]string, 0)
-	for _, cc := range ccs_with_label {
-		ccs = append(ccs, strings.TrimSpace(strings.Split(cc, " ")[1]))
+		// Another organisation of the SLA may have committed it meanwhile.
+		if committed, _ = d.committed(ctx, def); committed {
+			return nil
+		}
 	}
-	return ccs, nil
+	return err
 }
 
-func checkCommitReadiness(orgNr int, ccName string, conf lib.Config) error {
-	env := []string{
-		"CHANNEL_NAME=" + conf.ChannelName,
-		"ORDERER_TIMEOUT=10s",
+// committed reports whether the definition, or a later one, is committed.
+func (d *Deployer) committed(ctx context.Context, def lifecycle.Definition) (bool, error) {
+	committed, err := d.lc.QueryCommitted(ctx, def.Name)
+	if errors.Is(err, lifecycle.ErrNotCommitted) {
+		return false, nil
 	}
-
-	args := []string{
-		"./scripts/cc.sh",
-		"checkcommitreadiness",
-		strconv.Itoa(orgNr),
-		ccName,
-		conf.TlsCertPath,
-	}
-
-	_, err := runCommand(args, env, nil)
-	if err != nil {
-		return err
-	}
-
-	return nil
+	return err == nil && committed.Sequence >= def.Sequence, err
 }
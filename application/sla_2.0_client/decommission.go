@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib"
+)
+
+// slaStopped is the state of an SLA that ended, as in the SLA chaincode.
+const slaStopped = "stopped"
+
+// Ended reports whether the SLA ended and its chaincode is being, or was,
+// decommissioned.
+func (d *Deployer) Ended(slaID string) bool {
+	progress, err := d.store.load(d.prefix + slaID)
+	return err == nil && progress.ended()
+}
+
+// Decommission archives the world state of the chaincode of an SLA that ended
+// and tears its chaincode servers down, in the background. An interrupted
+// decommissioning is resumed from where it stopped.
+func (d *Deployer) Decommission(ccName string, contract Contract) {
+	d.running.Add(1)
+	go func() {
+		defer d.running.Done()
+		if err := d.decommission(ccName, contract); err != nil {
+			lib.Error("failed to decommission chaincode", "chaincode", ccName, "error", err)
+		}
+	}()
+}
+
+func (d *Deployer) decommission(ccName string, contract Contract) error {
+	unlock := d.lock(ccName)
+	defer unlock()
+
+	progress, err := d.store.load(ccName)
+	if err != nil || progress.Step == stepDecommissioned {
+		return err
+	}
+	if progress.Export == "" {
+		progress.Export = filepath.Join(d.exportDir, ccName+".json")
+	}
+	if progress.Teardown == "" {
+		progress.Teardown = d.teardownMode
+	}
+
+	steps := []step{
+		{stepExported, d.timeout, func(context.Context) error { return exportState(contract, progress.Export) }},
+		{stepTornDown, d.timeout, func(ctx context.Context) error { return d.backend.TearDown(ctx, ccName, progress.Teardown) }},
+		{stepDecommissioned, d.timeout, func(context.Context) error { return nil }},
+	}
+	// The world state cannot be exported again once the servers are gone.
+	for i, step := range steps {
+		if step.name == progress.Step {
+			steps = steps[i+1:]
+			break
+		}
+	}
+
+	lib.Info("decommissioning chaincodes", "chaincode", ccName, "teardown", progress.Teardown, "step", progress.Step)
+	return d.run(progress, steps)
+}
+
+// exportState writes the world state of the chaincode to path.
+func exportState(contract Contract, path string) error {
+	lib.Info("evaluating transaction", "name", "ExportState", "contract", contract.ChaincodeName())
+	state, err := contract.EvaluateTransaction("ExportState")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err = os.WriteFile(tmp, state, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// finalRefund refunds the violations of an SLA that ended, since the chaincode
+// refuses to refund an SLA once it is stored as stopped.
+func finalRefund(contract Contract, slaID string) error {
+	result, err := contract.EvaluateTransaction("ContractExists", slaID)
+	if err != nil {
+		return err
+	}
+	if exists, _ := strconv.ParseBool(string(result)); !exists {
+		return nil
+	}
+
+	result, err = contract.EvaluateTransaction("ReadContract", slaID)
+	if err != nil {
+		return err
+	}
+	var stored lib.SLA
+	if err = json.Unmarshal(result, &stored); err != nil {
+		return fmt.Errorf("failed to unmarshal SLA %s: %w", slaID, err)
+	}
+	if stored.State == slaStopped {
+		return nil
+	}
+
+	lib.Info("submitting transaction", "name", "RefundSLA", "sla_id", slaID)
+	_, err = contract.SubmitTransaction("RefundSLA", slaID)
+	return err
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib"
+	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib/lifecycle"
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// fakeLifecycle keeps the definitions of a channel in memory.
+type fakeLifecycle struct {
+	mu        sync.Mutex
+	msp       string
+	members   []string
+	installed map[string]lifecycle.InstalledChaincode
+	approvals map[string]map[string]bool
+	committed map[string]lifecycle.Definition
+}
+
+func newFakeLifecycle(msp string, others ...string) *fakeLifecycle {
+	return &fakeLifecycle{
+		msp:       msp,
+		members:   append([]string{msp}, others...),
+		installed: map[string]lifecycle.InstalledChaincode{},
+		approvals: map[string]map[string]bool{},
+		committed: map[string]lifecycle.Definition{},
+	}
+}
+
+func definitionKey(def lifecycle.Definition) string {
+	return fmt.Sprintf("%s/%d/%s", def.Name, def.Sequence, def.Version)
+}
+
+func (l *fakeLifecycle) MspID() string { return l.msp }
+
+func (l *fakeLifecycle) Install(ctx context.Context, pkg []byte) (lifecycle.InstalledChaincode, error) {
+	label, _, err := lifecycle.ReadPackage(pkg)
+	if err != nil {
+		return lifecycle.InstalledChaincode{}, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cc := lifecycle.InstalledChaincode{PackageID: lifecycle.PackageID(label, pkg), Label: label}
+	l.installed[cc.PackageID] = cc
+	return cc, nil
+}
+
+func (l *fakeLifecycle) QueryInstalled(ctx context.Context) ([]lifecycle.InstalledChaincode, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var installed []lifecycle.InstalledChaincode
+	for _, cc := range l.installed {
+		installed = append(installed, cc)
+	}
+	return installed, nil
+}
+
+// approve records the approval of org.
+func (l *fakeLifecycle) approve(def lifecycle.Definition, org string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.approvals[definitionKey(def)] == nil {
+		l.approvals[definitionKey(def)] = map[string]bool{}
+	}
+	l.approvals[definitionKey(def)][org] = true
+}
+
+func (l *fakeLifecycle) Approve(ctx context.Context, def lifecycle.Definition) error {
+	l.approve(def, l.msp)
+	return nil
+}
+
+func (l *fakeLifecycle) CheckCommitReadiness(ctx context.Context, def lifecycle.Definition) (map[string]bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	approvals := map[string]bool{}
+	for _, org := range l.members {
+		approvals[org] = l.approvals[definitionKey(def)][org]
+	}
+	return approvals, nil
+}
+
+func (l *fakeLifecycle) WaitForApprovals(ctx context.Context, def lifecycle.Definition, orgs []string) error {
+	approvals, _ := l.CheckCommitReadiness(ctx, def)
+	for _, org := range orgs {
+		if !approvals[org] {
+			return &lifecycle.ApprovalsError{Name: def.Name, Missing: []string{org}, Err: context.DeadlineExceeded}
+		}
+	}
+	return nil
+}
+
+func (l *fakeLifecycle) Commit(ctx context.Context, def lifecycle.Definition, orgs []string) error {
+	if err := l.WaitForApprovals(ctx, def, orgs); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if current, ok := l.committed[def.Name]; ok && current.Sequence+1 != def.Sequence {
+		return fmt.Errorf("requested sequence is %d, but new definition must be sequence %d", def.Sequence, current.Sequence+1)
+	}
+	l.committed[def.Name] = def
+	return nil
+}
+
+func (l *fakeLifecycle) QueryCommitted(ctx context.Context, name string) (lifecycle.Definition, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	def, ok := l.committed[name]
+	if !ok {
+		return def, fmt.Errorf("%s: %w", name, lifecycle.ErrNotCommitted)
+	}
+	return def, nil
+}
+
+// fakeProducer approves the requested definitions as the other organisations.
+type fakeProducer struct {
+	lc       *fakeLifecycle
+	requests []approvalRequest
+}
+
+func (p *fakeProducer) Produce(msg *kafka.Message, delivery chan kafka.Event) error {
+	var req approvalRequest
+	if err := json.Unmarshal(msg.Value, &req); err != nil {
+		return err
+	}
+	p.requests = append(p.requests, req)
+	def := lifecycle.Definition{Name: req.Chaincode, Version: req.Version, Sequence: req.Sequence}
+	for _, org := range req.Orgs {
+		if org != req.RequestedBy {
+			p.lc.approve(def, org)
+		}
+	}
+	delivery <- msg
+	return nil
+}
+
+// fakeContract records the transactions of the chaincode of an SLA.
+type fakeContract struct {
+	name         string
+	transactions []string
+}
+
+func (c *fakeContract) ChaincodeName() string { return c.name }
+
+func (c *fakeContract) EvaluateTransaction(name string, args ...string) ([]byte, error) {
+	c.transactions = append(c.transactions, name)
+	switch name {
+	case "ExportState":
+		return []byte(`[{"key":"contract_1","value":"{}"}]`), nil
+	case "ContractExists":
+		return []byte("false"), nil
+	case "ReadContract":
+		return []byte(`{"id":"1","details":{"provider":{"id":"provider-1"},"client":{"id":"client-1"}}}`), nil
+	}
+	return nil, nil
+}
+
+func (c *fakeContract) SubmitTransaction(name string, args ...string) ([]byte, error) {
+	c.transactions = append(c.transactions, name)
+	return nil, nil
+}
+
+func TestDeployUpgradeDecommission(t *testing.T) {
+	conf := lib.Config{
+		OrgNr:              4,
+		DataFolder:         t.TempDir(),
+		ContractNamePrefix: "sla",
+		Topics:             lib.TopicConfig{Approvals: "chaincode_approvals"},
+		Lifecycle: lib.LifecycleConfig{
+			Image:           "slasc-bridge:1",
+			Version:         "1",
+			Timeout:         time.Second,
+			ApprovalTimeout: time.Second,
+			Teardown:        "delete",
+			Kubernetes:      lib.KubernetesBackend{Namespace: "pledger-dlt"},
+			Parties:         []lib.PartyOrg{{Party: "provider-1", MspID: "Org1MSP"}},
+		},
+	}
+	clientset := fake.NewSimpleClientset()
+	backend, err := newKubernetesBackend(clientset, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := newFakeLifecycle("Org4MSP", "Org1MSP")
+	producer := &fakeProducer{lc: lc}
+	deployer, err := NewDeployer(lc, backend, producer, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	contract := &fakeContract{name: "sla-1"}
+	ctx := context.Background()
+
+	// chaincodeIDs returns the packages the chaincode servers run, per peer.
+	chaincodeIDs := func() map[string]string {
+		ids := map[string]string{}
+		for _, peer := range []string{"peer1", "peer2"} {
+			deployment, err := clientset.AppsV1().Deployments("pledger-dlt").Get(ctx, "org4"+peer+"-ccaas-sla-1", metav1.GetOptions{})
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids[peer] = chaincodeID(deployment) + " " + chaincodeImage(deployment)
+		}
+		return ids
+	}
+
+	if err = deployer.Deploy("sla-1", []string{"Org1MSP"}, contract); err != nil {
+		t.Fatal(err)
+	}
+	committed, err := lc.QueryCommitted(ctx, "sla-1")
+	if err != nil || committed.Version != "1" || committed.Sequence != 1 {
+		t.Fatalf("committed %+v, %v", committed, err)
+	}
+	if len(producer.requests) != 1 || strings.Join(producer.requests[0].Orgs, ",") != "Org4MSP,Org1MSP" {
+		t.Errorf("approval requests %+v", producer.requests)
+	}
+	ids := chaincodeIDs()
+	if len(ids) != 2 || !strings.HasPrefix(ids["peer1"], committed.PackageID+" ") || ids["peer1"] != ids["peer2"] {
+		t.Errorf("chaincode servers %v, want package %s", ids, committed.PackageID)
+	}
+	if strings.Join(contract.transactions, ",") != "InitLedger" {
+		t.Errorf("transactions %v, want InitLedger", contract.transactions)
+	}
+	entry, found, err := deployer.Lookup("1")
+	if err != nil || !found || entry.Status != statusRunning {
+		t.Errorf("registry entry %+v, %v, %v", entry, found, err)
+	}
+
+	// A deployed chaincode is left as it is.
+	if err = deployer.Deploy("sla-1", []string{"Org1MSP"}, contract); err != nil {
+		t.Fatal(err)
+	}
+	if len(producer.requests) != 1 || len(contract.transactions) != 1 {
+		t.Errorf("deployed again: %d requests, transactions %v", len(producer.requests), contract.transactions)
+	}
+
+	deployer.version = "2"
+	if err = deployer.Upgrade("sla-1", contract); err != nil {
+		t.Fatal(err)
+	}
+	committed, err = lc.QueryCommitted(ctx, "sla-1")
+	if err != nil || committed.Version != "2" || committed.Sequence != 2 {
+		t.Fatalf("committed %+v after upgrade, %v", committed, err)
+	}
+	entry, _, _ = deployer.Lookup("1")
+	if entry.Status != statusRunning || entry.Sequence != 2 {
+		t.Errorf("registry entry %+v after upgrade", entry)
+	}
+
+	// A new image on the same version is only rolled out.
+	backend.image = "slasc-bridge:2"
+	if err = deployer.Upgrade("sla-1", contract); err != nil {
+		t.Fatal(err)
+	}
+	committed, _ = lc.QueryCommitted(ctx, "sla-1")
+	if committed.Sequence != 2 {
+		t.Errorf("committed sequence %d after the rollout, want 2", committed.Sequence)
+	}
+	ids = chaincodeIDs()
+	if ids["peer1"] != committed.PackageID+" slasc-bridge:2" || ids["peer1"] != ids["peer2"] {
+		t.Errorf("chaincode servers %v after the rollout", ids)
+	}
+
+	// The registry of another data folder imports the chaincode from the
+	// peer, and the organisations are read from the ledger to upgrade it.
+	imported := conf
+	imported.DataFolder = t.TempDir()
+	importer, err := NewDeployer(lc, backend, producer, imported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = importer.Import(ctx); err != nil {
+		t.Fatal(err)
+	}
+	importer.version = "3"
+	if err = importer.Upgrade("sla-1", contract); err != nil {
+		t.Fatal(err)
+	}
+	last := producer.requests[len(producer.requests)-1]
+	if last.Sequence != 3 || strings.Join(last.Orgs, ",") != "Org4MSP,Org1MSP" {
+		t.Errorf("approval request %+v of the imported chaincode", last)
+	}
+
+	if err = deployer.decommission("sla-1", contract); err != nil {
+		t.Fatal(err)
+	}
+	if ids = chaincodeIDs(); len(ids) != 0 {
+		t.Errorf("chaincode servers %v left after decommissioning", ids)
+	}
+	export, err := os.ReadFile(filepath.Join(conf.DataFolder, "exports", "sla-1.json"))
+	if err != nil || !strings.Contains(string(export), "contract_1") {
+		t.Errorf("export %s, %v", export, err)
+	}
+	entry, _, _ = deployer.Lookup("1")
+	if entry.Status != statusDecommissioned || len(entry.Objects) != 0 {
+		t.Errorf("registry entry %+v after decommissioning", entry)
+	}
+	if err = deployer.Deploy("sla-1", []string{"Org1MSP"}, contract); err == nil || !strings.Contains(err.Error(), "decommissioned") {
+		t.Errorf("Deploy after decommissioning = %v", err)
+	}
+	if err = deployer.Upgrade("sla-1", contract); err == nil {
+		t.Error("upgraded a decommissioned chaincode")
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The steps of a deployment, in order, followed by those of the
+// decommissioning of the chaincode. A deployment records the last step that
+// succeeded.
+const (
+	stepNone           = ""
+	stepLaunched       = "launched"
+	stepInstalled      = "installed"
+	stepApproved       = "approved"
+	stepCommitted      = "committed"
+	stepInitialized    = "initialized"
+	stepExported       = "exported"
+	stepTornDown       = "torn down"
+	stepDecommissioned = "decommissioned"
+)
+
+// deployment is the progress of the deployment of the chaincode of one SLA.
+type deployment struct {
+	Chaincode string    `json:"chaincode"`
+	PackageID string    `json:"packageId"`
+	Version   string    `json:"version,omitempty"`
+	Sequence  int64     `json:"sequence,omitempty"`
+	Orgs      []string  `json:"orgs,omitempty"` // the organisations that approve the chaincode
+	Step      string    `json:"step"`
+	Error     string    `json:"error,omitempty"`
+	Export    string    `json:"export,omitempty"`   // the world state of the chaincode, once its SLA ended
+	Teardown  string    `json:"teardown,omitempty"` // how its chaincode servers were torn down
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// done reports whether the chaincode of the package is ready to be used.
+func (d deployment) done(packageID string) bool {
+	return d.Step == stepInitialized && d.PackageID == packageID
+}
+
+// ended reports whether the SLA ended and its chaincode is being, or was,
+// decommissioned.
+func (d deployment) ended() bool {
+	return d.Step == stepExported || d.Step == stepTornDown || d.Step == stepDecommissioned
+}
+
+// deployed reports whether the chaincode is committed and its ledger
+// initialised, including while it is upgraded.
+func (d deployment) deployed() bool {
+	return d.Step == stepInitialized || (d.Sequence > 1 && !d.ended())
+}
+
+// deploymentStore keeps one file per chaincode, so that an interrupted
+// deployment is resumed after a restart. It is the registry of the chaincodes
+// of the SLAs.
+type deploymentStore struct {
+	dir string
+}
+
+func newDeploymentStore(dir string) (*deploymentStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create deployments folder: %w", err)
+	}
+	return &deploymentStore{dir: dir}, nil
+}
+
+func (s *deploymentStore) path(ccName string) string {
+	return filepath.Join(s.dir, ccName+".json")
+}
+
+// load returns the progress of a chaincode, which is empty if it was never deployed.
+func (s *deploymentStore) load(ccName string) (deployment, error) {
+	d := deployment{Chaincode: ccName}
+	b, err := os.ReadFile(s.path(ccName))
+	if errors.Is(err, os.ErrNotExist) {
+		return d, nil
+	}
+	if err != nil {
+		return d, err
+	}
+	if err = json.Unmarshal(b, &d); err != nil {
+		return d, fmt.Errorf("invalid deployment of %s: %w", ccName, err)
+	}
+	return d, nil
+}
+
+// list returns the progress of every chaincode, by name.
+func (s *deploymentStore) list() ([]deployment, error) {
+	paths, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	deployments := make([]deployment, 0, len(paths))
+	for _, path := range paths {
+		d, err := s.load(strings.TrimSuffix(filepath.Base(path), ".json"))
+		if err != nil {
+			return nil, err
+		}
+		deployments = append(deployments, d)
+	}
+	return deployments, nil
+}
+
+// save replaces the progress of a chaincode atomically.
+func (s *deploymentStore) save(d deployment) error {
+	d.UpdatedAt = time.Now().UTC()
+	b, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path(d.Chaincode) + ".tmp"
+	if err = os.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path(d.Chaincode))
+}
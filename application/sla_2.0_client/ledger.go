@@ -1,15 +1,16 @@
 package main
 
 import (
-	"log"
 	"strconv"
 
+	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib"
+
 	"github.com/hyperledger/fabric-gateway/pkg/client"
 )
 
-func InitLedger(contract *client.Contract) error {
+func InitLedger(contract Contract) error {
 
-	log.Println(green("--> Submit Transaction: InitLedger, function the connection with the ledger"))
+	lib.Info("submitting transaction", "name", "InitLedger")
 
 	_, err := contract.SubmitTransaction("InitLedger")
 	if err != nil {
@@ -18,27 +19,8 @@ func InitLedger(contract *client.Contract) error {
 	return nil
 }
 
-func CreateOrUpdateContract(contract *client.Contract, data string) error {
-	log.Println(green(`--> Submit Transaction: CreateOrUpdateContract, creates new contract or updates existing one with SLA`))
-
-	_, err := contract.SubmitTransaction("CreateOrUpdateContract", data)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
-func SLAViolated(contract *client.Contract, slaJSON string) (string, error) {
-	log.Println(green("--> Submit Transaction: SLAViolated, updates contracts details with ID, newStatus"))
-	result, err := contract.SubmitTransaction("SLAViolated", slaJSON)
-	if err != nil {
-		return "", err
-	}
-	return string(result), nil
-}
-
 func CreateUser(contract *client.Contract, name, publicKey string, balance int) error {
-	log.Println(green("--> Submit Transaction: CreateUser, creates new user with name, ID, publickey and an initial balance"))
+	lib.Info("submitting transaction", "name", "CreateUser", "user", name)
 	_, err := contract.SubmitTransaction("CreateUser", name, publicKey, strconv.Itoa(balance))
 	if err != nil {
 		return err
@@ -47,7 +29,7 @@ func CreateUser(contract *client.Contract, name, publicKey string, balance int)
 }
 
 func UserExists(contract *client.Contract, name string) (bool, error) {
-	log.Println(green("--> Evaluate Transaction: UserExists, checks if a user exists on chaincode"))
+	lib.Debug("evaluating transaction", "name", "UserExists", "user", name)
 	result, err := contract.EvaluateTransaction("UserExists", name)
 	if err != nil {
 		return false, err
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib"
+	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib/lifecycle"
+)
+
+var registry = flag.Bool("registry", false, "Print the registry of the chaincodes of the SLAs and exit")
+
+// The status of the chaincode of an SLA in the registry.
+const (
+	statusDeploying       = "deploying"
+	statusUpgrading       = "upgrading"
+	statusFailed          = "failed"
+	statusRunning         = "running"
+	statusDecommissioning = "decommissioning"
+	statusDecommissioned  = "decommissioned"
+)
+
+// registryEntry is the chaincode of an SLA, as the registry reports it.
+type registryEntry struct {
+	SLAID     string `json:"slaId"`
+	Chaincode string `json:"chaincode"`
+	PackageID string `json:"packageId"`
+	Version   string `json:"version,omitempty"`
+	Sequence  int64  `json:"sequence,omitempty"`
+	// Objects are the objects of the chaincode servers in the backend, as
+	// kind/name.
+	Objects   []string  `json:"objects"`
+	Status    string    `json:"status"`
+	Step      string    `json:"step"`
+	Error     string    `json:"error,omitempty"`
+	Export    string    `json:"export,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func (d *Deployer) entry(progress deployment) registryEntry {
+	e := registryEntry{
+		SLAID:     strings.TrimPrefix(progress.Chaincode, d.prefix),
+		Chaincode: progress.Chaincode,
+		PackageID: progress.PackageID,
+		Version:   progress.Version,
+		Sequence:  progress.Sequence,
+		Objects:   []string{},
+		Step:      progress.Step,
+		Error:     progress.Error,
+		Export:    progress.Export,
+		UpdatedAt: progress.UpdatedAt,
+	}
+
+	switch {
+	case progress.Step == stepDecommissioned:
+		e.Status = statusDecommissioned
+	case progress.ended():
+		e.Status = statusDecommissioning
+	case progress.Error != "":
+		e.Status = statusFailed
+	case progress.Step == stepInitialized:
+		e.Status = statusRunning
+	case progress.Sequence > 1:
+		e.Status = statusUpgrading
+	default:
+		e.Status = statusDeploying
+	}
+
+	torn := (progress.Step == stepTornDown || progress.Step == stepDecommissioned) && progress.Teardown != "scale"
+	if !torn && (progress.Step != stepNone || progress.Sequence > 1) {
+		e.Objects = append(e.Objects, d.backend.Objects(progress.Chaincode)...)
+	}
+	return e
+}
+
+// Registry returns the chaincodes of the SLAs, by SLA ID, including those
+// being deployed and those of the SLAs that ended.
+func (d *Deployer) Registry() ([]registryEntry, error) {
+	deployments, err := d.store.list()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]registryEntry, 0, len(deployments))
+	for _, progress := range deployments {
+		if strings.HasPrefix(progress.Chaincode, d.prefix) {
+			entries = append(entries, d.entry(progress))
+		}
+	}
+	return entries, nil
+}
+
+// Lookup returns the chaincode of an SLA, and false if it was never deployed.
+func (d *Deployer) Lookup(slaID string) (registryEntry, bool, error) {
+	progress, err := d.store.load(d.prefix + slaID)
+	if err != nil || progress.PackageID == "" {
+		return registryEntry{}, false, err
+	}
+	return d.entry(progress), true, nil
+}
+
+// SLAs returns the IDs of the SLAs whose chaincodes are deployed, except the
+// SLAs that ended.
+func (d *Deployer) SLAs() ([]string, error) {
+	entries, err := d.store.list()
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, progress := range entries {
+		if strings.HasPrefix(progress.Chaincode, d.prefix) && progress.deployed() {
+			ids = append(ids, strings.TrimPrefix(progress.Chaincode, d.prefix))
+		}
+	}
+	return ids, nil
+}
+
+// Import records the chaincodes of the SLAs that are installed and committed
+// but missing from the registry, such as those deployed before it existed.
+func (d *Deployer) Import(ctx context.Context) error {
+	installed, err := d.lc.QueryInstalled(ctx)
+	if err != nil {
+		return err
+	}
+
+	var imported int
+	for _, cc := range installed {
+		if !strings.HasPrefix(cc.Label, d.prefix) {
+			continue
+		}
+		if err = d.importChaincode(ctx, cc); err != nil {
+			return err
+		}
+		imported++
+	}
+	lib.Info("imported installed chaincodes", "chaincodes", imported)
+	return nil
+}
+
+func (d *Deployer) importChaincode(ctx context.Context, cc lifecycle.InstalledChaincode) error {
+	unlock := d.lock(cc.Label)
+	defer unlock()
+
+	progress, err := d.store.load(cc.Label)
+	if err != nil || progress.PackageID != "" {
+		return err
+	}
+	committed, err := d.lc.QueryCommitted(ctx, cc.Label)
+	if errors.Is(err, lifecycle.ErrNotCommitted) {
+		// The deployment is completed when the SLA is received again.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	progress.PackageID, progress.Version, progress.Sequence = cc.PackageID, committed.Version, committed.Sequence
+	progress.Step = stepInitialized
+	return d.store.save(progress)
+}
+
+// RegistryHandler serves the registry on /slas and the chaincode of one SLA
+// on /slas/<SLA ID>.
+func (d *Deployer) RegistryHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slas", func(w http.ResponseWriter, r *http.Request) {
+		entries, err := d.Registry()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, entries)
+	})
+	mux.HandleFunc("/slas/", func(w http.ResponseWriter, r *http.Request) {
+		e, found, err := d.Lookup(strings.TrimPrefix(r.URL.Path, "/slas/"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.NotFound(w, r)
+			return
+		}
+		writeJSON(w, e)
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// serveRegistry serves the registry at addr in the background.
+func serveRegistry(addr string, d *Deployer) *http.Server {
+	server := &http.Server{Addr: addr, Handler: d.RegistryHandler(), ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		lib.Info("serving chaincode registry", "address", addr)
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			lib.Error("registry endpoint failed", "error", err)
+		}
+	}()
+	return server
+}
+
+func printRegistry(w io.Writer, entries []registryEntry) {
+	fmt.Fprintf(w, "%d chaincodes\n", len(entries))
+	for _, e := range entries {
+		fmt.Fprintf(w, "  %s: %s, chaincode %s", e.SLAID, e.Status, e.Chaincode)
+		if e.Sequence > 0 {
+			fmt.Fprintf(w, ", version %s, sequence %d", e.Version, e.Sequence)
+		}
+		fmt.Fprintf(w, ", package %s", e.PackageID)
+		if e.Error != "" {
+			fmt.Fprintf(w, ", error: %s", e.Error)
+		}
+		fmt.Fprintln(w)
+	}
+}
@@ -1,261 +1,425 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
 	"os"
-	"os/signal"
-	"path/filepath"
-	"syscall"
 	"time"
 
 	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib"
+	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib/leader"
+	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib/lifecycle"
 	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"github.com/hyperledger/fabric-gateway/pkg/client"
-	"github.com/robfig/cron"
 )
 
-func loadConfig() *lib.Config {
-	conf := lib.Config{}
-	conf.TlsCertPath = "/fabric/tlscacerts/tlsca-signcert.pem"
-	conf.ContractNamePrefix = os.Getenv("fabric_contract")
-	conf.PeerEndpoint = os.Getenv("fabric_gateway_hostport")
-	conf.GatewayPeer = os.Getenv("fabric_gateway_sslHostOverride")
-	conf.ChannelName = os.Getenv("fabric_channel")
-	conf.IdentityEndpoint = os.Getenv("identity_endpoint")
-	conf.DataFolder = os.Getenv("data_folder")
-	conf.ConsumerGroup = os.Getenv("consumer_group")
-	conf.JSONFiles = make([]string, 2)
-	conf.JSONFiles[0] = filepath.Join(conf.DataFolder, "sla.json")
-	conf.JSONFiles[1] = filepath.Join(conf.DataFolder, "violations.json")
-
-	b, err := os.ReadFile("/fabric/application/wallet/appuser_org4.id")
+func loadConfig(path string) *lib.Config {
+	conf, err := lib.LoadConfig(path, lib.Config{
+		OrgNr:     4,
+		JSONFiles: []string{"sla.jsonl", "violations.jsonl"},
+	})
 	if err != nil {
-		log.Fatalf("failed to load config: %v", err)
-	}
-	var userConf lib.UserConfig
-	err = json.Unmarshal(b, &userConf)
-	if err != nil {
-		log.Fatalf("failed to unmarsal userConf: %v", err)
+		lib.Fatal("failed to load config", "error", err)
 	}
 
-	conf.UserConf = &userConf
+	// The chaincode name is used as the prefix of the per-SLA chaincodes.
+	if conf.ContractNamePrefix == "" {
+		conf.ContractNamePrefix = conf.ChaincodeName
+	}
 
-	log.Print(conf)
-	log.Print(userConf)
+	lib.SetupLogging(conf.Log)
+	lib.Info("loaded configuration", "config", conf, "user", conf.UserConf)
 
-	return &conf
+	return conf
 }
 
 func main() {
-	conf := loadConfig()
+	// The shutdown steps run before run returns, and so before the exit.
+	if err := run(); err != nil {
+		lib.Fatal("client failed", "error", err)
+	}
+}
+
+// run runs the client until it is shut down, or returns the error that
+// stopped it once everything it started was stopped.
+func run() error {
+	configFile := lib.ParseArgs()
+	conf := loadConfig(*configFile[2])
 	createKeysFolder(*conf)
 
 	// The topics that will be used
-	topics := make([]string, 2)
-	topics[0] = "sla_contracts"
-	topics[1] = "sla_violation"
+	topics := []string{conf.Topics.SLA, conf.Topics.Violations}
 
-	log.Println("============ application-golang starts ============")
+	lib.Info("client starts")
 
-	configFile := lib.ParseArgs()
+	// Everything started below registers its cleanup on shutdown, which runs
+	// on SIGINT or SIGTERM, or when run returns.
+	shutdown := lib.NewShutdown(conf.ShutdownTimeout)
+	defer shutdown.Stop()
+
+	// The offsets are committed once the transactions of their records are
+	// done, so that a crash does not lose the SLAs and violations queued on
+	// the pipeline.
+	c_sla, offsets, err := lib.CreateTrackedConsumer(*configFile[0], conf.ConsumerGroup, conf.Offsets.Reset)
+	if err != nil {
+		return fmt.Errorf("failed to create consumer: %w", err)
+	}
+	stopConsumer := lib.StopConsumer(c_sla)
+	shutdown.OnStop("kafka consumer", stopConsumer)
 
-	c_sla, err := lib.CreateConsumer(*configFile[0], conf.ConsumerGroup, "beginning")
+	// The producer publishes the approval requests of the chaincodes to the
+	// other organisations.
+	p_approvals, err := lib.CreateProducer(*configFile[0])
 	if err != nil {
-		log.Fatalf("failed to create consumer: %v", err)
+		return fmt.Errorf("failed to create producer: %w", err)
 	}
+	shutdown.OnStop("kafka producer", func(ctx context.Context) error {
+		defer p_approvals.Close()
+		timeout := 1000
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = int(time.Until(deadline).Milliseconds())
+		}
+		if timeout < 0 {
+			timeout = 0
+		}
+		if remaining := p_approvals.Flush(timeout); remaining > 0 {
+			return fmt.Errorf("%d messages were not delivered", remaining)
+		}
+		return nil
+	})
 
 	// Subscribe to topic
-	err = c_sla.SubscribeTopics(topics, nil)
+	err = lib.SubscribeTopics(c_sla, topics, conf.Offsets.StartTime())
 	if err != nil {
-		log.Fatalf("failed to connect to topics: %v", err)
+		return fmt.Errorf("failed to connect to topics: %w", err)
+	}
+
+	if conf.Metrics.Listen != "" {
+		metrics := lib.ServeMetrics(conf.Metrics.Listen)
+		shutdown.OnStop("metrics endpoint", metrics.Shutdown)
 	}
-	// Cleanup for when the service terminates
-	sigchan := make(chan os.Signal, 1)
-	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
 
-	clientConnection, err := lib.NewGrpcConnection(*conf)
+	connection, err := lib.NewConnectionManager(*conf)
 	if err != nil {
-		log.Fatalf("failed to create GRPC connection: %v", err)
+		return fmt.Errorf("failed to connect to the gateway: %w", err)
 	}
-	defer clientConnection.Close()
+	shutdown.OnStop("gateway connection", func(context.Context) error {
+		connection.Close()
+		return nil
+	})
+
+	network := connection.Network()
 
-	id, err := lib.NewIdentity(*conf)
+	// The chaincodes of the SLAs are deployed as the admin of the organisation.
+	lc, err := lifecycle.Connect(*conf)
 	if err != nil {
-		log.Fatalf("failed to create identity: %v", err)
+		return fmt.Errorf("failed to connect for chaincode deployment: %w", err)
+	}
+	shutdown.OnClose("lifecycle connections", lc)
+	backend, err := newBackend(*conf)
+	if err != nil {
+		return fmt.Errorf("failed to set up the chaincode servers: %w", err)
+	}
+	if closer, ok := backend.(io.Closer); ok {
+		shutdown.OnClose("chaincode servers", closer)
 	}
+	deployer, err := NewDeployer(lc, backend, p_approvals, *conf)
+	if err != nil {
+		return fmt.Errorf("failed to set up chaincode deployment: %w", err)
+	}
+	shutdown.OnStop("approval requests", deployer.Wait)
 
-	sign, err := lib.NewSign(*conf)
+	ctx, cancel := context.WithTimeout(shutdown.Context(), conf.Lifecycle.Timeout)
+	err = deployer.Import(ctx)
+	cancel()
 	if err != nil {
-		log.Fatalf("failed to create signature: %v", err)
+		lib.Warn("failed to import the installed chaincodes into the registry", "error", err)
 	}
 
-	// Create a Gateway connection for a specific client identity
-	gw, err := client.Connect(
-		id,
-		client.WithSign(sign),
-		client.WithClientConnection(clientConnection),
-		// Default timeouts for different gRPC calls
-		client.WithEvaluateTimeout(5*time.Second),
-		client.WithEndorseTimeout(15*time.Second),
-		client.WithSubmitTimeout(5*time.Second),
-		client.WithCommitStatusTimeout(1*time.Minute),
-	)
+	// Transactions are submitted asynchronously, but always in order per SLA,
+	// so that violations are never applied before their SLA is created.
+	pipeline := lib.NewPipeline(conf.SubmitWorkers, conf.SubmitQueueSize)
+	shutdown.OnStop("submit pipeline", pipeline.Drain)
+
+	if *registry {
+		stopConsumer(shutdown.Context())
+		entries, err := deployer.Registry()
+		if err != nil {
+			return fmt.Errorf("failed to read the registry: %w", err)
+		}
+		printRegistry(os.Stdout, entries)
+		return nil
+	}
+
+	if *upgrade || *versions {
+		stopConsumer(shutdown.Context())
+		err = runUpgrade(network, deployer)
+		if err != nil {
+			return fmt.Errorf("failed to upgrade: %w", err)
+		}
+		return nil
+	}
+
+	if *reconcile {
+		stopConsumer(shutdown.Context())
+		err = runReconcile(pipeline, network, deployer, *conf)
+		if err != nil {
+			return fmt.Errorf("failed to reconcile: %w", err)
+		}
+		return nil
+	}
+
+	// The one-shot modes above leave the chaincode servers and the refunds
+	// to the running client.
+	if resumer, ok := backend.(interface{ Resume() error }); ok {
+		if err = resumer.Resume(); err != nil {
+			return fmt.Errorf("failed to start the chaincode servers: %w", err)
+		}
+	}
+
+	// Every organisation reads all the approval requests, so they are read in
+	// a consumer group of its own instead of the one of the SLA topics, which
+	// shares them between the organisations.
+	c_approvals, err := lib.CreateConsumer(*configFile[0], approvalsGroup(*conf), conf.Offsets.Reset)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("failed to create approvals consumer: %w", err)
 	}
-	defer gw.Close()
+	err = lib.SubscribeTopics(c_approvals, []string{conf.Topics.Approvals}, time.Time{})
+	if err != nil {
+		return fmt.Errorf("failed to connect to the approvals topic: %w", err)
+	}
+	approvalsDone := make(chan struct{})
+	go func() {
+		defer close(approvalsDone)
+		consumeApprovals(shutdown.Done(), c_approvals, deployer)
+	}()
+	stopApprovals := lib.StopConsumer(c_approvals)
+	shutdown.OnStop("approvals consumer", func(ctx context.Context) error {
+		select {
+		case <-approvalsDone:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		return stopApprovals(ctx)
+	})
 
-	network := gw.GetNetwork(conf.ChannelName)
+	if conf.Lifecycle.RegistryListen != "" {
+		server := serveRegistry(conf.Lifecycle.RegistryListen, deployer)
+		shutdown.OnStop("registry endpoint", server.Shutdown)
+	}
+
+	// Every SLA has its own chaincode, so only the connection is checked.
+	health := lib.NewHealth(conf.Health.MaxStall)
+	health.AddCheck("gateway", lib.GatewayCheck(connection, nil))
+	health.AddCheck("kafka", lib.ConsumerCheck(c_sla))
+	health.AddCheck("kafka approvals", lib.ConsumerCheck(c_approvals))
+	health.AddCheck("shutdown", shutdown.Check)
+	if conf.Health.Listen != "" {
+		server := lib.ServeHealth(conf.Health.Listen, health)
+		shutdown.OnStop("health endpoint", server.Shutdown)
+	}
 
-	f_sla, err := lib.OpenJsonFile(conf.JSONFiles[0])
+	f_sla, err := lib.OpenArchive(conf.JSONFiles[0], conf.Archive)
 	if err != nil {
-		log.Fatalf("%v", err)
+		return fmt.Errorf("failed to open archive: %w", err)
 	}
-	defer lib.CloseJsonFile(f_sla)
+	shutdown.OnClose("SLA archive", f_sla)
 
-	f_vio, err := lib.OpenJsonFile(conf.JSONFiles[1])
+	f_vio, err := lib.OpenArchive(conf.JSONFiles[1], conf.Archive)
 	if err != nil {
-		log.Fatalf("%v", err)
+		return fmt.Errorf("failed to open archive: %w", err)
 	}
-	defer lib.CloseJsonFile(f_vio)
+	shutdown.OnClose("violation archive", f_vio)
 
-	// Initialize the daily refunding process
-	c := cron.New()
-	c.AddFunc("@midnight", func() { runRefunds(4, network, *conf) })
-	c.Start()
+	// Refunds are settled by one replica, every time a period ends.
+	refunds, err := lib.NewRefundScheduler(conf.Refunds, func() ([]*client.Contract, error) {
+		return refundContracts(network, deployer)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to schedule refunds: %w", err)
+	}
+	shutdown.OnStop("refund scheduler", leader.Start(conf.Refunds.Lease, refunds.Run))
 
 	var run bool = true
 	for run {
+		health.Beat()
 		select {
-		case <-sigchan:
+		case <-shutdown.Done():
 			run = false
 
 		default:
 			msg, err := c_sla.ReadMessage(100 * time.Millisecond)
 			if err != nil {
-				if err.(kafka.Error).Code() == kafka.ErrTimedOut {
+				var kafkaErr kafka.Error
+				if errors.As(err, &kafkaErr) && kafkaErr.Code() == kafka.ErrTimedOut {
 					continue
 				}
-				log.Printf("consumer failed to read: %v", err)
+				lib.Error("consumer failed to read", "error", err)
 				continue
 			}
+			lib.ObserveMessage(c_sla, msg)
+			logger := lib.MessageLogger(msg)
+			logger.Debug("received message", "value", string(msg.Value))
 
 			if *msg.TopicPartition.Topic == topics[0] {
-				log.Println(string(msg.Value))
 				var sla lib.SLA
 				err = json.Unmarshal(msg.Value, &sla)
 				if err != nil {
-					log.Printf("failed to unmarshal: %v", err)
-					continue
-				}
-				log.Println(sla)
-
-				// Generate the name of the contract
-				contractName := fmt.Sprintf("%v-%v", conf.ContractNamePrefix, sla.ID)
-
-				// Check if the contract exists and otherwise create it
-				ok, err := QueryInstalled(4, contractName, *conf)
-				if err != nil {
-					log.Println(red("%v", err))
+					lib.ObserveUnmarshalFailure(*msg.TopicPartition.Topic)
+					logger.Error("failed to unmarshal SLA", "error", err)
+					offsets.Track(msg, 0)
 					continue
 				}
-				if !ok {
-					err = DeployCC(contractName, 4, *conf)
-					if err != nil {
-						log.Println(red("%v", err))
-						continue
-					}
-					contract := network.GetContract(contractName)
-					// Init ledger
-					err = InitLedger(contract)
-					if err != nil {
-						lib.HandleError(err)
-						continue
-					}
-				}
+				logger.Info("received SLA", "sla_id", sla.ID)
 
-				contract := network.GetContract(contractName)
-
-				jsonToFile, _ := json.MarshalIndent(sla, "", " ")
-				if err = lib.WriteJsonObjectToFile(f_sla, jsonToFile); err != nil {
-					lib.HandleError(err)
-				}
-				log.Println("Creating users and contract")
-
-				_, _, err = UserExistsOrCreate(contract, sla.Details.Provider.Name, 10000, 4, *conf)
-				if err != nil {
-					lib.HandleError(err)
-					continue
+				jsonToFile, _ := json.Marshal(sla)
+				if err = f_sla.Write(jsonToFile); err != nil {
+					logger.Error("failed to archive SLA", "sla_id", sla.ID, "error", err)
 				}
 
-				_, _, err = UserExistsOrCreate(contract, sla.Details.Client.Name, 10000, 4, *conf)
-				if err != nil {
-					lib.HandleError(err)
-					continue
-				}
-
-				err = CreateOrUpdateContract(contract, string(msg.Value))
-				if err != nil {
-					lib.HandleError(err)
-					continue
-				}
-				log.Println("submitted")
+				submitSLA(pipeline, network, deployer, *conf, sla, msg.Value, offsets.Track(msg, 1))
 				continue
 			}
 			if *msg.TopicPartition.Topic == topics[1] {
-				log.Println(string(msg.Value))
 				var v lib.Violation
 				err = json.Unmarshal(msg.Value, &v)
 				if err != nil {
-					log.Printf("Unmarshal failed: %v\n", err)
+					lib.ObserveUnmarshalFailure(*msg.TopicPartition.Topic)
+					logger.Error("failed to unmarshal violation", "error", err)
+					offsets.Track(msg, 0)
 					continue
 				}
-				log.Println(v)
+				logger.Info("received violation", "violation_id", v.ID, "sla_id", v.SLAID)
 
-				jsonToFile, _ := json.MarshalIndent(v, "", " ")
-				if err = lib.WriteJsonObjectToFile(f_vio, jsonToFile); err != nil {
-					log.Printf("%v", err)
-				}
-				contractName := fmt.Sprintf("%v-%v", conf.ContractNamePrefix, v.SLAID)
-				contract := network.GetContract(contractName)
-				if contract == nil {
-					log.Printf("failed to find contract %s", contractName)
-					continue
+				jsonToFile, _ := json.Marshal(v)
+				if err = f_vio.Write(jsonToFile); err != nil {
+					logger.Error("failed to archive violation", "violation_id", v.ID, "error", err)
 				}
+				submitViolation(pipeline, network, deployer, *conf, v, msg.Value, offsets.Track(msg, 1))
+				continue
+			}
+			return fmt.Errorf("unknown topic %s", *msg.TopicPartition.Topic)
+		}
+	}
+	return nil
+}
+
+// submitSLA queues the creation or update of an SLA. The chaincode of the SLA
+// is deployed and its users are created first, if needed. done is called once
+// the transaction is done, or at once if the SLA is skipped.
+func submitSLA(pipeline *lib.Pipeline, network *client.Network, deployer *Deployer, conf lib.Config, sla lib.SLA, value []byte, done func()) {
+	// Generate the name of the contract
+	contractName := fmt.Sprintf("%v-%v", conf.ContractNamePrefix, sla.ID)
+	contract := network.GetContract(contractName)
+
+	if deployer.Ended(sla.ID) {
+		lib.Info("skipped SLA that ended", "sla_id", sla.ID)
+		// Resume the decommissioning, in case it was interrupted.
+		deployer.Decommission(contractName, contract)
+		done()
+		return
+	}
 
-				result, err := SLAViolated(contract, string(msg.Value))
+	pipeline.Submit(lib.Transaction{
+		Key:      sla.ID,
+		Contract: contract,
+		Name:     "CreateOrUpdateContract",
+		Args:     []string{string(value)},
+		Prepare: func() error {
+			// Deploy the contract, or finish deploying it, if needed
+			orgs := conf.Lifecycle.ApprovingOrgs(sla.Details.Provider.ID, sla.Details.Client.ID)
+			err := deployer.Deploy(contractName, orgs, contract)
+			if err != nil {
+				return err
+			}
+			lib.Info("creating users and contract", "sla_id", sla.ID)
+
+			_, _, err = UserExistsOrCreate(contract, sla.Details.Provider.Name, 10000, conf.OrgNr, conf)
+			if err != nil {
+				return err
+			}
+
+			_, _, err = UserExistsOrCreate(contract, sla.Details.Client.Name, 10000, conf.OrgNr, conf)
+			if err != nil {
+				return err
+			}
+
+			// The violations of an SLA that ends are refunded before it is stopped.
+			if sla.State == slaStopped {
+				err = finalRefund(contract, sla.ID)
 				if err != nil {
-					lib.HandleError(err)
-					continue
+					return err
 				}
-				log.Println(string(result))
-				continue
 			}
-			log.Fatalf("unknown topic %s", *msg.TopicPartition.Topic)
-		}
-		log.Println("============ application-golang ends ============")
-		c_sla.Close()
+
+			lib.Info("submitting transaction", "name", "CreateOrUpdateContract", "sla_id", sla.ID)
+			return nil
+		},
+		Done: func(result []byte, err error) {
+			defer done()
+			if err != nil {
+				lib.HandleError(err)
+				return
+			}
+			lib.Info("committed SLA", "sla_id", sla.ID)
+			if sla.State == slaStopped {
+				deployer.Decommission(contractName, contract)
+			}
+		},
+	})
+}
+
+// submitViolation queues a violation on the chaincode of its SLA. It shares
+// the key of its SLA, so it is applied after the SLA is created. done is
+// called once the transaction is done, or at once if the violation is skipped.
+func submitViolation(pipeline *lib.Pipeline, network *client.Network, deployer *Deployer, conf lib.Config, v lib.Violation, value []byte, done func()) {
+	if deployer.Ended(v.SLAID) {
+		lib.Warn("skipped violation of a completed SLA", "violation_id", v.ID, "sla_id", v.SLAID)
+		done()
+		return
 	}
+	contractName := fmt.Sprintf("%v-%v", conf.ContractNamePrefix, v.SLAID)
+	contract := network.GetContract(contractName)
+	if contract == nil {
+		lib.Error("failed to find contract", "contract", contractName)
+		done()
+		return
+	}
+
+	lib.Info("submitting transaction", "name", "SLAViolated", "violation_id", v.ID, "sla_id", v.SLAID)
+	pipeline.Submit(lib.Transaction{
+		Key:      v.SLAID,
+		Contract: contract,
+		Name:     "SLAViolated",
+		Args:     []string{string(value)},
+		Done: func(result []byte, err error) {
+			defer done()
+			if errors.Is(err, lib.ErrContractCompleted) {
+				lib.Warn("skipped violation of a completed SLA", "violation_id", v.ID, "sla_id", v.SLAID)
+				return
+			}
+			if err != nil {
+				lib.HandleError(err)
+				return
+			}
+			lib.Info("committed violation", "violation_id", v.ID, "sla_id", v.SLAID, "result", string(result))
+		},
+	})
 }
 
-func runRefunds(orgNr int, network *client.Network, conf lib.Config) error {
-	ccs, err := GetAllInstalled(orgNr, conf)
+// refundContracts returns the chaincodes of the SLAs that run, skipping those
+// that ended.
+func refundContracts(network *client.Network, deployer *Deployer) ([]*client.Contract, error) {
+	ids, err := deployer.SLAs()
 	if err != nil {
-		fmt.Println(err)
-		return err
+		return nil, fmt.Errorf("failed to list the SLA chaincodes: %w", err)
 	}
-
-	for _, cc := range ccs {
-		log.Println(string(lib.ColorGreen), `--> Submit Transaction:
-	RefundAllSLAs, refund all SLAs`, string(lib.ColorReset))
-		contract := network.GetContract(cc)
-		_, err := contract.SubmitTransaction("RefundAllSLAs")
-		if err != nil {
-			lib.HandleError(err)
-			return err
-		}
+	contracts := make([]*client.Contract, 0, len(ids))
+	for _, id := range ids {
+		contracts = append(contracts, network.GetContract(deployer.prefix+id))
 	}
-	return nil
+	return contracts, nil
 }
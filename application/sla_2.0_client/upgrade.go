@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib"
+	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib/lifecycle"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+var upgrade = flag.Bool("upgrade", false, "Upgrade the chaincodes of the SLAs to lifecycle.image and lifecycle.version, report their versions and exit")
+var versions = flag.Bool("versions", false, "Report the versions of the chaincodes of the SLAs and exit")
+var only = flag.String("only", "", "With -upgrade or -versions, the comma separated IDs of the SLAs to act on instead of all")
+
+// runUpgrade upgrades the chaincodes of the SLAs, with -upgrade, and reports
+// their versions. A chaincode that fails to upgrade does not stop the others.
+func runUpgrade(network *client.Network, deployer *Deployer) error {
+	var ids []string
+	if *only != "" {
+		for _, id := range strings.Split(*only, ",") {
+			ids = append(ids, strings.TrimSpace(id))
+		}
+	} else {
+		var err error
+		if ids, err = deployer.SLAs(); err != nil {
+			return err
+		}
+	}
+
+	var failed int
+	if *upgrade {
+		for _, id := range ids {
+			ccName := deployer.prefix + id
+			if err := deployer.Upgrade(ccName, network.GetContract(ccName)); err != nil {
+				lib.Error("failed to upgrade chaincode", "sla_id", id, "error", err)
+				failed++
+			}
+		}
+	}
+
+	report := make([]chaincodeVersion, 0, len(ids))
+	for _, id := range ids {
+		report = append(report, deployer.Version(id))
+	}
+	printVersions(os.Stdout, report)
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d chaincodes failed to upgrade", failed, len(ids))
+	}
+	return nil
+}
+
+// Upgrade upgrades the chaincode of an SLA to the configured image and
+// version: the chaincode servers are rolled out with the image, and the next
+// sequence of the definition is approved by the organisations of the SLA and
+// committed. A chaincode on the configured version only has its servers
+// rolled out if they run another image, and an interrupted upgrade is resumed.
+// The organisations of a chaincode imported from the peer are read from the
+// SLA on its ledger.
+func (d *Deployer) Upgrade(ccName string, contract Contract) error {
+	unlock := d.lock(ccName)
+	defer unlock()
+
+	ccPackage, ccID, err := d.chaincodePackage(ccName)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	committed, err := d.lc.QueryCommitted(ctx, ccName)
+	cancel()
+	if err != nil {
+		return err
+	}
+	progress, err := d.load(ccName, ccID)
+	if err != nil {
+		return err
+	}
+	if progress.ended() {
+		return fmt.Errorf("%s was decommissioned", ccName)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), d.timeout)
+	rolledOut := d.rolledOut(ctx, ccName)
+	cancel()
+	if committed.Version == d.version && progress.done(ccID) && rolledOut {
+		return nil
+	}
+
+	def := lifecycle.Definition{Name: ccName, Version: d.version, Sequence: committed.Sequence + 1, PackageID: ccID}
+	if committed.Version == d.version {
+		def.Sequence = committed.Sequence
+	}
+	if progress.Version != def.Version || progress.Sequence != def.Sequence {
+		progress.Step = stepNone
+	}
+	if len(progress.Orgs) == 0 {
+		if progress.Orgs, err = d.slaOrgs(contract); err != nil {
+			return err
+		}
+	}
+	orgs := approvingOrgs(d.lc.MspID(), progress.Orgs)
+	progress.Version, progress.Sequence, progress.Orgs = def.Version, def.Sequence, orgs
+
+	steps := append(d.joinSteps(ccPackage, def),
+		step{stepCommitted, d.timeout + d.approvalTimeout, func(ctx context.Context) error { return d.commit(ctx, def, orgs) }},
+		// The ledger was initialised with the first version.
+		step{stepInitialized, d.timeout, func(context.Context) error { return nil }},
+	)
+	lib.Info("upgrading chaincodes", "chaincode", ccName, "from", committed.Version, "to", def.Version, "sequence", def.Sequence)
+	return d.run(progress, steps)
+}
+
+// rolledOut reports whether every chaincode server of a chaincode runs the
+// configured image.
+func (d *Deployer) rolledOut(ctx context.Context, ccName string) bool {
+	for _, image := range d.backend.Images(ctx, ccName) {
+		if image != d.backend.Image() {
+			return false
+		}
+	}
+	return true
+}
+
+// slaOrgs returns the organisations that approve the chaincode of an SLA,
+// from the provider and client of the SLA on its ledger.
+func (d *Deployer) slaOrgs(contract Contract) ([]string, error) {
+	slaID := strings.TrimPrefix(contract.ChaincodeName(), d.prefix)
+	result, err := contract.EvaluateTransaction("ReadContract", slaID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read SLA %s: %w", slaID, err)
+	}
+	var sla lib.SLA
+	if err = json.Unmarshal(result, &sla); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal SLA %s: %w", slaID, err)
+	}
+	return d.approvers(sla.Details.Provider.ID, sla.Details.Client.ID), nil
+}
+
+// chaincodeVersion is the state of the chaincode of an SLA.
+type chaincodeVersion struct {
+	SLAID    string
+	Version  string
+	Sequence int64
+	// Images are the images of the chaincode servers, per server.
+	Images map[string]string
+	// Step is the last step of the deployment or upgrade that succeeded.
+	Step  string
+	Error string
+}
+
+// Version returns the committed definition of the chaincode of an SLA, the
+// images its servers run and the progress of its deployment.
+func (d *Deployer) Version(slaID string) chaincodeVersion {
+	ccName := d.prefix + slaID
+	v := chaincodeVersion{SLAID: slaID}
+
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+	committed, err := d.lc.QueryCommitted(ctx, ccName)
+	if err != nil && !errors.Is(err, lifecycle.ErrNotCommitted) {
+		v.Error = err.Error()
+		return v
+	}
+	v.Version, v.Sequence = committed.Version, committed.Sequence
+
+	v.Images = d.backend.Images(ctx, ccName)
+
+	progress, err := d.store.load(ccName)
+	if err != nil {
+		v.Error = err.Error()
+		return v
+	}
+	v.Step = progress.Step
+	if v.Error == "" {
+		v.Error = progress.Error
+	}
+	return v
+}
+
+func printVersions(w io.Writer, report []chaincodeVersion) {
+	fmt.Fprintf(w, "%d chaincodes\n", len(report))
+	for _, v := range report {
+		version := "not committed"
+		if v.Sequence > 0 {
+			version = fmt.Sprintf("version %s, sequence %d", v.Version, v.Sequence)
+		}
+		fmt.Fprintf(w, "  %s: %s", v.SLAID, version)
+		servers := make([]string, 0, len(v.Images))
+		for server := range v.Images {
+			servers = append(servers, server)
+		}
+		sort.Strings(servers)
+		for _, server := range servers {
+			fmt.Fprintf(w, ", %s %s", server, v.Images[server])
+		}
+		if v.Step != "" {
+			fmt.Fprintf(w, ", %s", v.Step)
+		}
+		if v.Error != "" {
+			fmt.Fprintf(w, ", error: %s", v.Error)
+		}
+		fmt.Fprintln(w)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+var reconcile = flag.Bool("reconcile", false, "Compare the local archive with the ledger, report the differences and exit")
+var resubmit = flag.Bool("resubmit", false, "With -reconcile, submit the SLAs and violations missing from the ledger again")
+
+// runReconcile reports the differences between the archives and the ledger.
+// With -resubmit, the missing SLAs are submitted again, followed by their violations.
+func runReconcile(pipeline *lib.Pipeline, contract *client.Contract, conf lib.Config) error {
+	ledger := lib.SLALedger{
+		Contract: func(string) *client.Contract { return contract },
+		IDs:      func() ([]string, error) { return lib.SLAIDs(contract) },
+	}
+
+	slas, err := lib.ReconcileSLAs(conf.JSONFiles[0], ledger)
+	if err != nil {
+		return err
+	}
+	slas.Print(os.Stdout)
+
+	violations, err := lib.ReconcileViolations(conf.JSONFiles[1], ledger)
+	if err != nil {
+		return err
+	}
+	violations.Print(os.Stdout)
+
+	if !*resubmit {
+		return nil
+	}
+	for _, item := range slas.Missing {
+		// The latest version of the SLA is the one that should be on the ledger.
+		value := item.Records[len(item.Records)-1]
+		var sla lib.SLA
+		if err = json.Unmarshal(value, &sla); err != nil {
+			return err
+		}
+		submitSLA(pipeline, contract, conf, sla, value, func() {})
+	}
+	for _, item := range violations.Missing {
+		for _, value := range item.Records {
+			var v lib.Violation
+			if err = json.Unmarshal(value, &v); err != nil {
+				return err
+			}
+			submitViolation(pipeline, contract, v, value, func() {})
+		}
+	}
+	lib.Info("resubmitted missing records", "slas", len(slas.Missing), "violation_slas", len(violations.Missing))
+
+	// Divergent records are only reported. The ledger only counts the violations
+	// of an SLA, so it cannot tell which of the archived violations are missing,
+	// and submitting them all again would count the others twice.
+	if n := len(slas.Divergent) + len(violations.Divergent); n > 0 {
+		fmt.Fprintf(os.Stdout, "%d divergent records were not resubmitted, they have to be reconciled by hand\n", n)
+	}
+	return nil
+}
@@ -1,236 +1,263 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"os"
-	"os/signal"
 	"path/filepath"
-	"syscall"
 	"time"
 
 	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib"
+	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib/leader"
 	"github.com/confluentinc/confluent-kafka-go/kafka"
 	"github.com/hyperledger/fabric-gateway/pkg/client"
-	"github.com/robfig/cron/v3"
 )
 
-func loadConfig() *lib.Config {
-	conf := lib.Config{}
-	conf.TlsCertPath = "/fabric/tlscacerts/tlsca-signcert.pem"
-	conf.PeerEndpoint = os.Getenv("fabric_gateway_hostport")
-	conf.GatewayPeer = os.Getenv("fabric_gateway_sslHostOverride")
-	conf.ChannelName = os.Getenv("fabric_channel")
-	conf.ChaincodeName = os.Getenv("fabric_contract")
-	conf.IdentityEndpoint = os.Getenv("identity_endpoint")
-	conf.DataFolder = os.Getenv("data_folder")
-	conf.ConsumerGroup = os.Getenv("consumer_group")
-	conf.JSONFiles = make([]string, 2)
-	conf.JSONFiles[0] = filepath.Join(conf.DataFolder, "sla.json")
-	conf.JSONFiles[1] = filepath.Join(conf.DataFolder, "violations.json")
-
-	b, err := os.ReadFile("/fabric/application/wallet/appuser_org1.id")
+func loadConfig(path string) *lib.Config {
+	conf, err := lib.LoadConfig(path, lib.Config{
+		OrgNr:     1,
+		JSONFiles: []string{"sla.jsonl", "violations.jsonl"},
+	})
 	if err != nil {
-		log.Fatalf("failed to load config: %v", err)
-	}
-	var userConf lib.UserConfig
-	err = json.Unmarshal(b, &userConf)
-	if err != nil {
-		log.Fatalf("failed to unmarsal userConf: %v", err)
+		lib.Fatal("failed to load config", "error", err)
 	}
 
-	conf.UserConf = &userConf
+	lib.SetupLogging(conf.Log)
+	lib.Info("loaded configuration", "config", conf, "user", conf.UserConf)
 
-	log.Print(conf)
-	log.Print(userConf)
-
-	return &conf
+	return conf
 }
 
 func main() {
-	conf := loadConfig()
+	// The shutdown steps run before run returns, and so before the exit.
+	if err := run(); err != nil {
+		lib.Fatal("client failed", "error", err)
+	}
+}
+
+// run runs the client until it is shut down, or returns the error that
+// stopped it once everything it started was stopped.
+func run() error {
+	configFile := lib.ParseArgs()
+	conf := loadConfig(*configFile[2])
 	createKeysFolder(*conf)
 
 	// The topics that will be used
-	topics := make([]string, 2)
-	topics[0] = "sla_contracts"
-	topics[1] = "sla_violation"
+	topics := []string{conf.Topics.SLA, conf.Topics.Violations}
 
-	log.Println("============ application-golang starts ============")
+	lib.Info("client starts")
 
-	configFile := lib.ParseArgs()
+	// Everything started below registers its cleanup on shutdown, which runs
+	// on SIGINT or SIGTERM, or when run returns.
+	shutdown := lib.NewShutdown(conf.ShutdownTimeout)
+	defer shutdown.Stop()
 
-	c_sla, err := lib.CreateConsumer(*configFile[0], conf.ConsumerGroup, "beginning")
+	// The offsets are committed once the transactions of their records are
+	// done, so that a crash does not lose the SLAs and violations queued on
+	// the pipeline.
+	c_sla, offsets, err := lib.CreateTrackedConsumer(*configFile[0], conf.ConsumerGroup, conf.Offsets.Reset)
 	if err != nil {
-		log.Fatalf("failed to create consumer: %v", err)
+		return fmt.Errorf("failed to create consumer: %w", err)
 	}
+	stopConsumer := lib.StopConsumer(c_sla)
+	shutdown.OnStop("kafka consumer", stopConsumer)
 
 	// Subscribe to topic
-	err = c_sla.SubscribeTopics(topics, nil)
-	if err != nil {
-		log.Fatalf("failed to connect to topics: %v", err)
-	}
-	// Cleanup for when the service terminates
-	sigchan := make(chan os.Signal, 1)
-	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
-
-	clientConnection, err := lib.NewGrpcConnection(*conf)
+	err = lib.SubscribeTopics(c_sla, topics, conf.Offsets.StartTime())
 	if err != nil {
-		log.Fatalf("failed to create GRPC connection: %v", err)
+		return fmt.Errorf("failed to connect to topics: %w", err)
 	}
-	defer clientConnection.Close()
 
-	id, err := lib.NewIdentity(*conf)
-	if err != nil {
-		log.Fatalf("failed to create identity: %v", err)
+	if conf.Metrics.Listen != "" {
+		metrics := lib.ServeMetrics(conf.Metrics.Listen)
+		shutdown.OnStop("metrics endpoint", metrics.Shutdown)
 	}
 
-	sign, err := lib.NewSign(*conf)
-	if err != nil {
-		log.Fatalf("failed to create signature: %v", err)
-	}
-	// Create a Gateway connection for a specific client identity
-	gw, err := client.Connect(
-		id,
-		client.WithSign(sign),
-		client.WithClientConnection(clientConnection),
-		// Default timeouts for different gRPC calls
-		client.WithEvaluateTimeout(5*time.Second),
-		client.WithEndorseTimeout(15*time.Second),
-		client.WithSubmitTimeout(5*time.Second),
-		client.WithCommitStatusTimeout(1*time.Minute),
-	)
+	connection, err := lib.NewConnectionManager(*conf)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("failed to connect to the gateway: %w", err)
 	}
-	defer gw.Close()
+	shutdown.OnStop("gateway connection", func(context.Context) error {
+		connection.Close()
+		return nil
+	})
 
-	network := gw.GetNetwork(conf.ChannelName)
-	contract := network.GetContract(conf.ChaincodeName)
+	contract := connection.Contract()
 
-	log.Println(string(lib.ColorGreen), "--> Submit Transaction: InitLedger, function the connection with the ledger", string(lib.ColorReset))
+	lib.Info("submitting transaction", "name", "InitLedger")
 	_, err = contract.SubmitTransaction("InitLedger")
 	if err != nil {
 		lib.HandleError(err)
 	}
 
-	// Initialize the daily refunding process
-	c := cron.New()
-	c.AddFunc("@midnight", func() { runRefunds(*contract) })
-	c.Start()
+	// Transactions are submitted asynchronously, but always in order per SLA,
+	// so that violations are never applied before their SLA is created.
+	pipeline := lib.NewPipeline(conf.SubmitWorkers, conf.SubmitQueueSize)
+	shutdown.OnStop("submit pipeline", pipeline.Drain)
 
-	// Inspect the cron job entries' next and previous run times.
-	log.Println(c.Entries())
+	if *reconcile {
+		stopConsumer(shutdown.Context())
+		err = runReconcile(pipeline, contract, *conf)
+		if err != nil {
+			return fmt.Errorf("failed to reconcile: %w", err)
+		}
+		return nil
+	}
 
-	f_sla, err := lib.OpenJsonFile(conf.JSONFiles[0])
+	// The health endpoint is served only by the running client, since the
+	// one-shot modes above close the consumer that it checks.
+	health := lib.NewHealth(conf.Health.MaxStall)
+	health.AddCheck("gateway", lib.GatewayCheck(connection, contract))
+	health.AddCheck("kafka", lib.ConsumerCheck(c_sla))
+	health.AddCheck("shutdown", shutdown.Check)
+	if conf.Health.Listen != "" {
+		server := lib.ServeHealth(conf.Health.Listen, health)
+		shutdown.OnStop("health endpoint", server.Shutdown)
+	}
+
+	// Refunds are settled by one replica, every time a period ends.
+	refunds, err := lib.NewRefundScheduler(conf.Refunds, func() ([]*client.Contract, error) {
+		return []*client.Contract{contract}, nil
+	})
 	if err != nil {
-		log.Fatalf("%v", err)
+		return fmt.Errorf("failed to schedule refunds: %w", err)
 	}
-	defer lib.CloseJsonFile(f_sla)
+	shutdown.OnStop("refund scheduler", leader.Start(conf.Refunds.Lease, refunds.Run))
 
-	f_vio, err := lib.OpenJsonFile(conf.JSONFiles[1])
+	f_sla, err := lib.OpenArchive(conf.JSONFiles[0], conf.Archive)
 	if err != nil {
-		log.Fatalf("%v", err)
+		return fmt.Errorf("failed to open archive: %w", err)
 	}
-	defer lib.CloseJsonFile(f_vio)
+	shutdown.OnClose("SLA archive", f_sla)
+
+	f_vio, err := lib.OpenArchive(conf.JSONFiles[1], conf.Archive)
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %w", err)
+	}
+	shutdown.OnClose("violation archive", f_vio)
 
 	var run bool = true
 	for run {
+		health.Beat()
 		select {
-		case <-sigchan:
+		case <-shutdown.Done():
 			run = false
 
 		default:
 			msg, err := c_sla.ReadMessage(100 * time.Millisecond)
 			if err != nil {
-				if err.(kafka.Error).Code() == kafka.ErrTimedOut {
+				var kafkaErr kafka.Error
+				if errors.As(err, &kafkaErr) && kafkaErr.Code() == kafka.ErrTimedOut {
 					continue
 				}
-				log.Printf("consumer failed to read: %v", err)
+				lib.Error("consumer failed to read", "error", err)
 				continue
 			}
+			lib.ObserveMessage(c_sla, msg)
 
+			logger := lib.MessageLogger(msg)
+			logger.Debug("received message", "value", string(msg.Value))
 			if *msg.TopicPartition.Topic == topics[0] {
-				log.Println(string(msg.Value))
 				var sla lib.SLA
 				err = json.Unmarshal(msg.Value, &sla)
 				if err != nil {
-					log.Printf("failed to unmarshal: %v", err)
-					continue
-				}
-				log.Println(sla)
-
-				jsonToFile, _ := json.MarshalIndent(sla, "", " ")
-				if err = lib.WriteJsonObjectToFile(f_sla, jsonToFile); err != nil {
-					log.Printf("%v", err)
-				}
-
-				_, _, err := UserExistsOrCreate(contract, sla.Details.Provider.Name, 10000, 1, *conf)
-				if err != nil {
-					lib.HandleError(err)
+					lib.ObserveUnmarshalFailure(*msg.TopicPartition.Topic)
+					logger.Error("failed to unmarshal SLA", "error", err)
+					offsets.Track(msg, 0)
 					continue
 				}
+				logger.Info("received SLA", "sla_id", sla.ID)
 
-				_, _, err = UserExistsOrCreate(contract, sla.Details.Client.Name, 10000, 1, *conf)
-				if err != nil {
-					lib.HandleError(err)
-					continue
+				jsonToFile, _ := json.Marshal(sla)
+				if err = f_sla.Write(jsonToFile); err != nil {
+					logger.Error("failed to archive SLA", "sla_id", sla.ID, "error", err)
 				}
 
-				log.Println(string(lib.ColorGreen), `--> Submit Transaction:
-				CreateOrUpdateContract, creates new contract or updates existing one with SLA`, string(lib.ColorReset))
-
-				_, err = contract.SubmitTransaction("CreateOrUpdateContract",
-					string(msg.Value),
-				)
-				if err != nil {
-					lib.HandleError(err)
-					continue
-				}
-				log.Println("submitted")
+				submitSLA(pipeline, contract, *conf, sla, msg.Value, offsets.Track(msg, 1))
 				continue
 			}
 			if *msg.TopicPartition.Topic == topics[1] {
-				log.Println(string(msg.Value))
 				var v lib.Violation
 				err = json.Unmarshal(msg.Value, &v)
 				if err != nil {
-					log.Printf("Unmarshal failed: %v\n", err)
+					lib.ObserveUnmarshalFailure(*msg.TopicPartition.Topic)
+					logger.Error("failed to unmarshal violation", "error", err)
+					offsets.Track(msg, 0)
 					continue
 				}
-				log.Println(v)
+				logger.Info("received violation", "violation_id", v.ID, "sla_id", v.SLAID)
 
-				jsonToFile, _ := json.MarshalIndent(v, "", " ")
-				if err = lib.WriteJsonObjectToFile(f_vio, jsonToFile); err != nil {
-					log.Printf("%v", err)
+				jsonToFile, _ := json.Marshal(v)
+				if err = f_vio.Write(jsonToFile); err != nil {
+					logger.Error("failed to archive violation", "violation_id", v.ID, "error", err)
 				}
 
-				log.Println(string(lib.ColorGreen), "--> Submit Transaction: SLAViolated, updates contracts details with ID, newStatus", string(lib.ColorReset))
-				result, err := contract.SubmitTransaction("SLAViolated", string(msg.Value))
-				if err != nil {
-					lib.HandleError(err)
-					continue
-				}
-				log.Println(string(result))
+				submitViolation(pipeline, contract, v, msg.Value, offsets.Track(msg, 1))
 				continue
 			}
-			log.Fatalf("unknown topic %s", *msg.TopicPartition.Topic)
+			return fmt.Errorf("unknown topic %s", *msg.TopicPartition.Topic)
 		}
-		log.Println("============ application-golang ends ============")
-		c_sla.Close()
 	}
+	return nil
 }
 
-func runRefunds(contract client.Contract) error {
-	log.Println(string(lib.ColorGreen), `--> Submit Transaction:
-	RefundAllSLAs, refund all SLAs`, string(lib.ColorReset))
+// submitSLA queues the creation or update of an SLA, creating its users first.
+// done is called once the transaction is done.
+func submitSLA(pipeline *lib.Pipeline, contract *client.Contract, conf lib.Config, sla lib.SLA, value []byte, done func()) {
+	pipeline.Submit(lib.Transaction{
+		Key:      sla.ID,
+		Contract: contract,
+		Name:     "CreateOrUpdateContract",
+		Args:     []string{string(value)},
+		Prepare: func() error {
+			_, _, err := UserExistsOrCreate(contract, sla.Details.Provider.Name, 10000, conf.OrgNr, conf)
+			if err != nil {
+				return err
+			}
+
+			_, _, err = UserExistsOrCreate(contract, sla.Details.Client.Name, 10000, conf.OrgNr, conf)
+			if err != nil {
+				return err
+			}
 
-	_, err := contract.SubmitTransaction("RefundAllSLAs")
-	if err != nil {
-		return fmt.Errorf(string(lib.ColorRed)+"failed to submit transaction: %w\n"+string(lib.ColorReset), err)
-	}
-	return nil
+			lib.Info("submitting transaction", "name", "CreateOrUpdateContract", "sla_id", sla.ID)
+			return nil
+		},
+		Done: func(result []byte, err error) {
+			defer done()
+			if err != nil {
+				lib.HandleError(err)
+				return
+			}
+			lib.Info("committed SLA", "sla_id", sla.ID)
+		},
+	})
+}
+
+// submitViolation queues a violation. It shares the key of its SLA, so it is
+// applied after the SLA is created. done is called once the transaction is done.
+func submitViolation(pipeline *lib.Pipeline, contract *client.Contract, v lib.Violation, value []byte, done func()) {
+	lib.Info("submitting transaction", "name", "SLAViolated", "violation_id", v.ID, "sla_id", v.SLAID)
+	pipeline.Submit(lib.Transaction{
+		Key:      v.SLAID,
+		Contract: contract,
+		Name:     "SLAViolated",
+		Args:     []string{string(value)},
+		Done: func(result []byte, err error) {
+			defer done()
+			if errors.Is(err, lib.ErrContractCompleted) {
+				lib.Warn("skipped violation of a completed SLA", "violation_id", v.ID, "sla_id", v.SLAID)
+				return
+			}
+			if err != nil {
+				lib.HandleError(err)
+				return
+			}
+			lib.Info("committed violation", "violation_id", v.ID, "sla_id", v.SLAID, "result", string(result))
+		},
+	})
 }
 
 func createKeysFolder(conf lib.Config) error {
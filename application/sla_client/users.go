@@ -5,7 +5,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -30,12 +29,12 @@ type UserRequest struct {
 func UserExistsOrCreate(contract *client.Contract, name string, balance, org int, conf lib.Config) (bool, string, error) {
 	result, err := contract.EvaluateTransaction("UserExists", name)
 	if err != nil {
-		err = fmt.Errorf(string(lib.ColorRed)+"failed to submit transaction: %s\n"+string(lib.ColorReset), err)
+		err = fmt.Errorf("failed to submit transaction: %w", err)
 		return false, "", err
 	}
 	result_bool, err := strconv.ParseBool(string(result))
 	if err != nil {
-		err = fmt.Errorf(string(lib.ColorRed)+"failed to parse boolean: %s\n"+string(lib.ColorReset), err)
+		err = fmt.Errorf("failed to parse boolean: %s", err)
 		return false, "", err
 	}
 	if result_bool {
@@ -47,20 +46,20 @@ func UserExistsOrCreate(contract *client.Contract, name string, balance, org int
 		Organization: org,
 	})
 	if err != nil {
-		err = fmt.Errorf(string(lib.ColorRed)+"failed to marshall post request: %s\n"+string(lib.ColorReset), err)
+		err = fmt.Errorf("failed to marshall post request: %s", err)
 		return false, "", err
 	}
 	responseBody := bytes.NewBuffer(postBody)
 	resp, err := http.Post((conf.IdentityEndpoint + "/create"), "application/json", responseBody)
 	if err != nil {
-		err = fmt.Errorf(string(lib.ColorRed)+"failed to send post request: %s\n"+string(lib.ColorReset), err)
+		err = fmt.Errorf("failed to send post request: %s", err)
 		return false, "", err
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		err = fmt.Errorf(string(lib.ColorRed)+"failed to get response body: %s\n"+string(lib.ColorReset), err)
+		err = fmt.Errorf("failed to get response body: %s", err)
 		return false, "", err
 	}
 
@@ -68,19 +67,19 @@ func UserExistsOrCreate(contract *client.Contract, name string, balance, org int
 	var responseBodyJSON map[string]interface{}
 	err = json.Unmarshal(body, &responseBodyJSON)
 	if err != nil {
-		err = fmt.Errorf(string(lib.ColorRed)+"failed to unmarshal response body: %s\n"+string(lib.ColorReset), err)
+		err = fmt.Errorf("failed to unmarshal response body: %s", err)
 		return false, "", err
 	}
 	if responseBodyJSON["success"] == false {
 		if responseBodyJSON["error"] == "User already exists" {
 			return false, "", fmt.Errorf("user does not exist on ledger, but exists on user service")
 		}
-		return false, "", fmt.Errorf(string(lib.ColorRed)+"response failure: %v"+string(lib.ColorReset), responseBodyJSON["error"])
+		return false, "", fmt.Errorf("response failure: %v", responseBodyJSON["error"])
 	}
 	// get the data of the internal JSON
 	data, ok := responseBodyJSON["data"].(map[string]interface{})
 	if !ok {
-		err = fmt.Errorf(string(lib.ColorRed) + "failed to convert interface to struct\n" + string(lib.ColorReset))
+		err = fmt.Errorf("failed to convert interface to struct")
 		return false, "", err
 	}
 	// convert interface{} to string
@@ -92,16 +91,15 @@ func UserExistsOrCreate(contract *client.Contract, name string, balance, org int
 
 	err = saveCertificates(name, privateKey, publicKey, conf)
 	if err != nil {
-		err = fmt.Errorf(string(lib.ColorRed)+"failed to save certificates: %s"+string(lib.ColorReset), err)
+		err = fmt.Errorf("failed to save certificates: %s", err)
 		return false, "", err
 	}
 
 	publicKeyOneLine := strings.ReplaceAll(publicKeyStripped, "\n", "")
-	log.Println(string(lib.ColorGreen), `--> Submit Transaction:
-					CreateUser, creates new user with name, ID, publickey and an initial balance`, string(lib.ColorReset))
+	lib.Info("submitting transaction", "name", "CreateUser", "user", name)
 	_, err = contract.SubmitTransaction("CreateUser", name, publicKeyOneLine, strconv.Itoa(balance))
 	if err != nil {
-		return false, "", fmt.Errorf(string(lib.ColorRed)+"failed to submit transaction: %s\n"+string(lib.ColorReset), err)
+		return false, "", fmt.Errorf("failed to submit transaction: %w", err)
 	}
 
 	return false, publicKeyOneLine, nil
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"flag"
+	"os"
+
+	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+var reconcile = flag.Bool("reconcile", false, "Compare the local archive with the ledger, report the differences and exit")
+var resubmit = flag.Bool("resubmit", false, "With -reconcile, submit the records missing from the ledger again")
+
+// runReconcile reports the differences between the archive and the ledger.
+// With -resubmit, the records of the missing timestamps are submitted again,
+// one batch per timestamp.
+func runReconcile(pipeline *lib.Pipeline, contract *client.Contract, conf lib.Config) error {
+	report, err := lib.ReconcileVRUs(conf.JSONFiles[0], contract)
+	if err != nil {
+		return err
+	}
+	report.Print(os.Stdout)
+
+	if !*resubmit {
+		return nil
+	}
+	for _, item := range report.Missing {
+		submitBatch(pipeline, contract, item.Key, item.Records, func() {})
+	}
+	lib.Info("resubmitted missing incidents", "timestamps", len(report.Missing))
+	return nil
+}
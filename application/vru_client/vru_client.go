@@ -1,12 +1,11 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
-	"log"
-	"os"
-	"os/signal"
-	"path/filepath"
-	"syscall"
+	"errors"
+	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib"
@@ -14,133 +13,156 @@ import (
 	"github.com/hyperledger/fabric-gateway/pkg/client"
 )
 
-func loadConfig() *lib.Config {
-	conf := lib.Config{}
-	conf.TlsCertPath = "/fabric/tlscacerts/tlsca-signcert.pem"
-	conf.PeerEndpoint = os.Getenv("fabric_gateway_hostport")
-	conf.GatewayPeer = os.Getenv("fabric_gateway_sslHostOverride")
-	conf.ChannelName = os.Getenv("fabric_channel")
-	conf.ChaincodeName = os.Getenv("fabric_contract")
-	conf.IdentityEndpoint = os.Getenv("identity_endpoint")
-	conf.DataFolder = os.Getenv("data_folder")
-	conf.ConsumerGroup = os.Getenv("consumer_group")
-	conf.JSONFiles = make([]string, 1)
-	conf.JSONFiles[0] = filepath.Join(conf.DataFolder, "vru.json")
-
-	b, err := os.ReadFile("/fabric/application/wallet/appuser_org2.id")
+func loadConfig(path string) *lib.Config {
+	conf, err := lib.LoadConfig(path, lib.Config{
+		OrgNr:     2,
+		JSONFiles: []string{"vru.jsonl"},
+	})
 	if err != nil {
-		log.Fatalf("failed to load config: %v", err)
-	}
-	var userConf lib.UserConfig
-	err = json.Unmarshal(b, &userConf)
-	if err != nil {
-		log.Fatalf("failed to unmarshal userConf: %v", err)
+		lib.Fatal("failed to load config", "error", err)
 	}
 
-	conf.UserConf = &userConf
-	return &conf
+	lib.SetupLogging(conf.Log)
+	lib.Info("loaded configuration", "config", conf, "user", conf.UserConf)
+
+	return conf
 }
 
 func main() {
+	// The shutdown steps run before run returns, and so before the exit.
+	if err := run(); err != nil {
+		lib.Fatal("client failed", "error", err)
+	}
+}
 
-	// logf, err := os.OpenFile("logs.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
-	// if err != nil {
-	// 	log.Fatalf("error opening file: %v", err)
-	// }
-	// defer logf.Close()
-	// log.SetOutput(logf)
-
-	conf := loadConfig()
+// run runs the client until it is shut down, or returns the error that
+// stopped it once everything it started was stopped.
+func run() error {
+	configFile := lib.ParseArgs()
+	conf := loadConfig(*configFile[2])
 
 	// The topics that will be used
-	topics := make([]string, 1)
-	topics[0] = "vru_positions"
+	topics := []string{conf.Topics.VRU}
 
-	log.Println("============ application-golang starts ============")
+	lib.Info("client starts")
 
-	configFile := lib.ParseArgs()
+	// Everything started below registers its cleanup on shutdown, which runs
+	// on SIGINT or SIGTERM, or when run returns.
+	shutdown := lib.NewShutdown(conf.ShutdownTimeout)
+	defer shutdown.Stop()
 
-	c_vru, err := lib.CreateConsumer(*configFile[0], conf.ConsumerGroup, "beginning")
+	// The offsets are committed once the batches of their records were
+	// submitted, so that a crash does not lose the records being batched.
+	c_vru, offsets, err := lib.CreateTrackedConsumer(*configFile[0], conf.ConsumerGroup, conf.Offsets.Reset)
 	if err != nil {
-		log.Fatalf("failed to create consumer: %v", err)
+		return fmt.Errorf("failed to create consumer: %w", err)
 	}
+	stopConsumer := lib.StopConsumer(c_vru)
+	shutdown.OnStop("kafka consumer", stopConsumer)
 
 	// Subscribe to topic
-	err = c_vru.SubscribeTopics(topics, nil)
+	err = lib.SubscribeTopics(c_vru, topics, conf.Offsets.StartTime())
 	if err != nil {
-		log.Fatalf("failed to connect to topics: %v", err)
+		return fmt.Errorf("failed to connect to topics: %w", err)
 	}
 
-	// Cleanup for when the service terminates
-	sigchan := make(chan os.Signal, 1)
-	signal.Notify(sigchan, syscall.SIGINT, syscall.SIGTERM)
-
-	clientConnection, err := lib.NewGrpcConnection(*conf)
-	if err != nil {
-		log.Fatalf("failed to create GRPC connection: %v", err)
+	if conf.Metrics.Listen != "" {
+		metrics := lib.ServeMetrics(conf.Metrics.Listen)
+		shutdown.OnStop("metrics endpoint", metrics.Shutdown)
 	}
-	defer clientConnection.Close()
 
-	id, err := lib.NewIdentity(*conf)
+	connection, err := lib.NewConnectionManager(*conf)
 	if err != nil {
-		log.Fatalf("failed to create identity: %v", err)
+		return fmt.Errorf("failed to connect to the gateway: %w", err)
 	}
+	shutdown.OnStop("gateway connection", func(context.Context) error {
+		connection.Close()
+		return nil
+	})
+
+	contract := connection.Contract()
 
-	sign, err := lib.NewSign(*conf)
+	lib.Info("submitting transaction", "name", "InitLedger")
+	_, err = contract.SubmitTransaction("InitLedger")
 	if err != nil {
-		log.Fatalf("failed to create signature: %v", err)
+		lib.HandleError(err)
 	}
 
-	// Create a Gateway connection for a specific client identity
-	gw, err := client.Connect(
-		id,
-		client.WithSign(sign),
-		client.WithClientConnection(clientConnection),
-		// Default timeouts for different gRPC calls
-		client.WithEvaluateTimeout(5*time.Second),
-		client.WithEndorseTimeout(15*time.Second),
-		client.WithSubmitTimeout(5*time.Second),
-		client.WithCommitStatusTimeout(1*time.Minute),
-	)
-
+	// Open the archive of the incoming json objects
+	f, err := lib.OpenArchive(conf.JSONFiles[0], conf.Archive)
 	if err != nil {
-		log.Fatalf("failed to connect to gateway: %v", err)
+		return fmt.Errorf("failed to open archive: %w", err)
+	}
+	shutdown.OnClose("archive", f)
+
+	// VRU records are submitted asynchronously in micro-batches. Each worker of the
+	// pipeline has its own batcher, so records that share a timestamp are always
+	// submitted in order by the same worker.
+	pipeline := lib.NewPipeline(conf.SubmitWorkers, conf.SubmitQueueSize)
+	shutdown.OnStop("submit pipeline", pipeline.Drain)
+
+	if *reconcile {
+		stopConsumer(shutdown.Context())
+		err = runReconcile(pipeline, contract, *conf)
+		if err != nil {
+			return fmt.Errorf("failed to reconcile: %w", err)
+		}
+		return nil
 	}
-	defer gw.Close()
-
-	network := gw.GetNetwork(conf.ChannelName)
-	contract := network.GetContract(conf.ChaincodeName)
 
-	log.Println(string(lib.ColorGreen), "--> Submit Transaction: InitLedger, function the connection with the ledger", string(lib.ColorReset))
-	_, err = contract.SubmitTransaction("InitLedger")
-	if err != nil {
-		lib.HandleError(err)
+	// The health endpoint is served only by the running client, since the
+	// one-shot modes above close the consumer that it checks.
+	health := lib.NewHealth(conf.Health.MaxStall)
+	health.AddCheck("gateway", lib.GatewayCheck(connection, contract))
+	health.AddCheck("kafka", lib.ConsumerCheck(c_vru))
+	health.AddCheck("shutdown", shutdown.Check)
+	if conf.Health.Listen != "" {
+		server := lib.ServeHealth(conf.Health.Listen, health)
+		shutdown.OnStop("health endpoint", server.Shutdown)
 	}
 
-	// Open file for logging incoming json objects
-	f, err := lib.OpenJsonFile(conf.JSONFiles[0])
-	if err != nil {
-		log.Fatalf("%v", err)
+	batchers := make([]*lib.Batcher, pipeline.Workers())
+	batchKeys := make([]string, pipeline.Workers())
+	for i := range batchers {
+		batchers[i] = lib.NewBatcher(conf.BatchSize, conf.BatchTimeout)
 	}
-	defer lib.CloseJsonFile(f)
+	shutdown.OnStop("pending batches", func(context.Context) error {
+		for i, batcher := range batchers {
+			if batcher.Len() > 0 {
+				batch, done := batcher.Flush()
+				submitBatch(pipeline, contract, batchKeys[i], batch, done)
+			}
+		}
+		return nil
+	})
 
 	var run bool = true
 	for run {
+		health.Beat()
+		for i, batcher := range batchers {
+			if batcher.Ready() {
+				batch, done := batcher.Flush()
+				submitBatch(pipeline, contract, batchKeys[i], batch, done)
+			}
+		}
+
 		select {
-		case <-sigchan:
+		case <-shutdown.Done():
 			run = false
 
 		default:
 			msg, err := c_vru.ReadMessage(100 * time.Millisecond)
 			if err != nil {
-				if err.(kafka.Error).Code() == kafka.ErrTimedOut {
+				var kafkaErr kafka.Error
+				if errors.As(err, &kafkaErr) && kafkaErr.Code() == kafka.ErrTimedOut {
 					continue
 				}
-				log.Printf("consumer failed to read: %v", err)
+				lib.Error("consumer failed to read", "error", err)
 				continue
 			}
-			log.Printf("New message received on partition: %v", msg.TopicPartition)
-			log.Println(string(msg.Value))
+			lib.ObserveMessage(c_vru, msg)
+			logger := lib.MessageLogger(msg)
+			logger.Debug("received message", "value", string(msg.Value))
 			var vru_slice []lib.VRU
 
 			err = json.Unmarshal(msg.Value, &vru_slice)
@@ -148,37 +170,61 @@ func main() {
 				var vru lib.VRU
 				err = json.Unmarshal(msg.Value, &vru)
 				if err != nil {
-					log.Printf("failed to unmarshal: %v", err)
+					lib.ObserveUnmarshalFailure(*msg.TopicPartition.Topic)
+					logger.Error("failed to unmarshal incidents", "error", err)
+					offsets.Track(msg, 0)
 					continue
 				}
 				vru_slice = append(vru_slice, vru)
 			}
-			log.Println(vru_slice)
+			logger.Info("received incidents", "count", len(vru_slice))
+			done := offsets.Track(msg, len(vru_slice))
 
 			for _, vru := range vru_slice {
 				vru_json, err := json.Marshal(vru)
 				if err != nil {
-					log.Printf("Could not marshall singe vru from slice: %v", err)
+					logger.Error("failed to marshal incident", "timestamp", vru.Timestamp, "error", err)
+					done()
+					continue
 				}
 
-				jsonToFile, _ := json.MarshalIndent(vru, "", " ")
-				if err = lib.WriteJsonObjectToFile(f, jsonToFile); err != nil {
-					log.Printf("%v", err)
+				jsonToFile, _ := json.Marshal(vru)
+				if err = f.Write(jsonToFile); err != nil {
+					logger.Error("failed to archive incident", "timestamp", vru.Timestamp, "error", err)
 				}
 
-				log.Println(string(lib.ColorGreen), `--> Submit Transaction:
-				CreateContract, creates new incident with Timestamp,
-				and related tram and OBUs incidents`, string(lib.ColorReset))
+				key := strconv.FormatInt(vru.Timestamp, 10)
+				shard := pipeline.Shard(key)
+				batchKeys[shard] = key
+				batchers[shard].Add(vru_json, done)
+			}
+		}
+	}
+	return nil
+}
 
-				result, err := contract.SubmitTransaction("CreateContract",
-					string(vru_json),
-				)
-				if err != nil {
-					lib.HandleError(err)
-					continue
-				}
-				log.Println(string(result))
+// submitBatch queues a batch on the pipeline. The key can be the
+// timestamp of any record of the batch, since they share a worker. done is
+// called once the batch was submitted.
+func submitBatch(pipeline *lib.Pipeline, contract *client.Contract, key string, batch []json.RawMessage, done func()) {
+	lib.Info("submitting transaction", "name", "CreateContracts", "incidents", len(batch))
+
+	tx, err := lib.NewBatchTransaction(key, contract, "CreateContracts", batch, func(results []lib.BatchResult, err error) {
+		defer done()
+		if err != nil {
+			lib.HandleError(err)
+			return
+		}
+		for _, result := range results {
+			if result.Error != "" {
+				lib.Warn("incident was rejected", "index", result.Index, "timestamp", result.Key, "error", result.Error)
 			}
 		}
+	})
+	if err != nil {
+		lib.Error("failed to create batch", "error", err)
+		done()
+		return
 	}
+	pipeline.Submit(tx)
 }
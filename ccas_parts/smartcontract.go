@@ -20,6 +20,11 @@ func (s *SmartContract) InitLedger(ctx contractapi.TransactionContextInterface)
 	return nil
 }
 
+// Ping answers the readiness checks of the applications without touching the ledger.
+func (s *SmartContract) Ping(ctx contractapi.TransactionContextInterface) string {
+	return "pong"
+}
+
 func (s *SmartContract) CreateContract(ctx contractapi.TransactionContextInterface, contractJSON string) error {
 	var part lib.Part
 	err := json.Unmarshal([]byte(contractJSON), &part)
@@ -38,6 +43,51 @@ func (s *SmartContract) CreateContract(ctx contractapi.TransactionContextInterfa
 	return ctx.GetStub().PutState(part.Timestamp, []byte(contractJSON))
 }
 
+// CreateContracts stores a JSON array of parts in a single transaction.
+// Every element is handled on its own, so a malformed or duplicate part is
+// reported in the returned results instead of rejecting the whole batch.
+func (s *SmartContract) CreateContracts(ctx contractapi.TransactionContextInterface, contractsJSON string) ([]lib.BatchResult, error) {
+	var items []json.RawMessage
+	err := json.Unmarshal([]byte(contractsJSON), &items)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal json array: %w", err)
+	}
+
+	// Reads do not see the writes of the same transaction,
+	// so duplicates inside the batch are tracked here.
+	written := make(map[string]bool)
+
+	results := make([]lib.BatchResult, len(items))
+	for i, item := range items {
+		results[i].Index = i
+
+		var part lib.Part
+		err := json.Unmarshal(item, &part)
+		if err != nil {
+			results[i].Error = fmt.Sprintf("failed to unmarshal json: %v", err)
+			continue
+		}
+		results[i].Key = part.Timestamp
+
+		exists, err := s.ContractExists(ctx, part.Timestamp)
+		if err != nil {
+			results[i].Error = err.Error()
+			continue
+		}
+		if exists || written[part.Timestamp] {
+			results[i].Error = fmt.Sprintf("the Contract %v already exists", part.Timestamp)
+			continue
+		}
+
+		err = ctx.GetStub().PutState(part.Timestamp, item)
+		if err != nil {
+			return nil, err
+		}
+		written[part.Timestamp] = true
+	}
+	return results, nil
+}
+
 // ContractExists returns true when Contract with given ID exists in world state
 func (s *SmartContract) ContractExists(ctx contractapi.TransactionContextInterface, id string) (bool, error) {
 	ContractJSON, err := ctx.GetStub().GetState(id)
@@ -1,96 +1,9 @@
 package main
 
 import (
-	"log"
-	"os"
-	"strconv"
-
-	"github.com/hyperledger/fabric-chaincode-go/shim"
-	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib/ccserver"
 )
 
-type serverConfig struct {
-	CCID    string
-	Address string
-}
-
 func main() {
-	// See chaincode.env.example
-	config := serverConfig{
-		CCID:    os.Getenv("CHAINCODE_ID"),
-		Address: os.Getenv("CHAINCODE_SERVER_ADDRESS"),
-	}
-
-	chaincode, err := contractapi.NewChaincode(&SmartContract{})
-
-	if err != nil {
-		log.Panicf("error create slasc_bridge chaincode: %s", err)
-	}
-
-	server := &shim.ChaincodeServer{
-		CCID:     config.CCID,
-		Address:  config.Address,
-		CC:       chaincode,
-		TLSProps: getTLSProperties(),
-	}
-
-	if err := server.Start(); err != nil {
-		log.Panicf("error starting slasc_bridge chaincode: %s", err)
-	}
-}
-
-func getTLSProperties() shim.TLSProperties {
-	// Check if chaincode is TLS enabled
-	tlsDisabledStr := getEnvOrDefault("CHAINCODE_TLS_DISABLED", "true")
-	key := getEnvOrDefault("CHAINCODE_TLS_KEY", "")
-	cert := getEnvOrDefault("CHAINCODE_TLS_CERT", "")
-	clientCACert := getEnvOrDefault("CHAINCODE_CLIENT_CA_CERT", "")
-
-	// convert tlsDisabledStr to boolean
-	tlsDisabled := getBoolOrDefault(tlsDisabledStr, false)
-	var keyBytes, certBytes, clientCACertBytes []byte
-	var err error
-
-	if !tlsDisabled {
-		keyBytes, err = os.ReadFile(key)
-		if err != nil {
-			log.Panicf("error while reading the crypto file: %s", err)
-		}
-		certBytes, err = os.ReadFile(cert)
-		if err != nil {
-			log.Panicf("error while reading the crypto file: %s", err)
-		}
-	}
-	// Did not request for the peer cert verification
-	if clientCACert != "" {
-		clientCACertBytes, err = os.ReadFile(clientCACert)
-		if err != nil {
-			log.Panicf("error while reading the crypto file: %s", err)
-		}
-	}
-
-	return shim.TLSProperties{
-		Disabled:      tlsDisabled,
-		Key:           keyBytes,
-		Cert:          certBytes,
-		ClientCACerts: clientCACertBytes,
-	}
-}
-
-func getEnvOrDefault(env, defaultVal string) string {
-	value, ok := os.LookupEnv(env)
-	if !ok {
-		value = defaultVal
-	}
-	return value
-}
-
-// Note that the method returns default value if the string
-// cannot be parsed!
-func getBoolOrDefault(value string, defaultVal bool) bool {
-	parsed, err := strconv.ParseBool(value)
-	if err != nil {
-		return defaultVal
-	}
-	return parsed
+	ccserver.Run(&SmartContract{})
 }
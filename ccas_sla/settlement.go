@@ -0,0 +1,389 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+)
+
+// The billing cycles of an SLA, after which its refunds are settled.
+const (
+	billingDaily   = "daily"
+	billingWeekly  = "weekly"
+	billingMonthly = "monthly"
+)
+
+// billingSlack lets a period that is shorter than its cycle by up to an hour,
+// such as the day daylight saving time starts, be settled.
+const billingSlack = time.Hour
+
+// Settlement is the refund of an SLA for one period.
+type Settlement struct {
+	DocType     string `json:"docType"`
+	SLAID       string `json:"slaId"`
+	Billing     string `json:"billing"`
+	PeriodStart string `json:"periodStart"`
+	PeriodEnd   string `json:"periodEnd"`
+	// Violations are the violations of the period, by importance.
+	Violations []int   `json:"violations"`
+	Amount     float64 `json:"amount"`
+	// TransferID is the transaction that transferred the amount.
+	TransferID string `json:"transferId"`
+}
+
+// settlementKey holds the end of the last period whose refunds were settled
+// for all SLAs.
+const settlementKey = "settlement"
+
+type lastSettlement struct {
+	PeriodEnd string `json:"periodEnd"`
+	// Pending is the end of the period being settled in batches, and
+	// Bookmark where its next batch starts.
+	Pending  string `json:"pending,omitempty"`
+	Bookmark string `json:"bookmark,omitempty"`
+}
+
+func validBilling(billing string) error {
+	switch billing {
+	case "", billingDaily, billingWeekly, billingMonthly:
+		return nil
+	}
+	return fmt.Errorf("unknown billing %q, must be %s, %s or %s", billing, billingDaily, billingWeekly, billingMonthly)
+}
+
+// billing returns the billing cycle of the contract.
+func (c *sla_contract) billing() string {
+	if c.Billing == "" {
+		return billingDaily
+	}
+	return c.Billing
+}
+
+// addCycles adds n billing cycles to t.
+func (c *sla_contract) addCycles(t time.Time, n int) time.Time {
+	switch c.billing() {
+	case billingWeekly:
+		return t.AddDate(0, 0, 7*n)
+	case billingMonthly:
+		return t.AddDate(0, n, 0)
+	default:
+		return t.AddDate(0, 0, n)
+	}
+}
+
+// periodStart returns when the period of the contract that is not settled
+// yet started. The period of a contract stored before periods were recorded
+// is taken to last one cycle until end.
+func (c *sla_contract) periodStart(end time.Time) (time.Time, error) {
+	if c.PeriodStart == "" {
+		return c.addCycles(end, -1), nil
+	}
+	start, err := time.Parse(time.RFC3339, c.PeriodStart)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid period start %q of the contract %s: %w", c.PeriodStart, c.ID, err)
+	}
+	return start, nil
+}
+
+// due reports whether the period of the contract lasted its billing cycle by end.
+func (c *sla_contract) due(end time.Time) (bool, error) {
+	start, err := c.periodStart(end)
+	if err != nil {
+		return false, err
+	}
+	return !end.Before(c.addCycles(start, 1).Add(-billingSlack)), nil
+}
+
+func txTime(ctx contractapi.TransactionContextInterface) (time.Time, error) {
+	timestamp, err := ctx.GetStub().GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to read the transaction timestamp: %w", err)
+	}
+	return timestamp.AsTime(), nil
+}
+
+// notFuture refuses a period that ends after the transaction.
+func notFuture(ctx contractapi.TransactionContextInterface, end time.Time) error {
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	if end.After(now) {
+		return fmt.Errorf("the period ending at %s has not ended yet", end.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+func settlementRecordKey(id string, periodEnd string) string {
+	return fmt.Sprintf("settlement_%v_%v", id, periodEnd)
+}
+
+// SettleSLA refunds an SLA for its period that ends at periodEnd, an RFC 3339
+// time, and records the settlement. The period starts where the last settled
+// one ended. It is refused if it is already settled or did not last the
+// billing cycle of the SLA.
+func (s *SmartContract) SettleSLA(ctx contractapi.TransactionContextInterface, id, periodEnd string) (*Settlement, error) {
+	end, err := time.Parse(time.RFC3339, periodEnd)
+	if err != nil {
+		return nil, fmt.Errorf("invalid period end %q: %w", periodEnd, err)
+	}
+	if err = notFuture(ctx, end); err != nil {
+		return nil, err
+	}
+	contract, err := s.ReadContract(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if contract.SLA.State == "stopped" {
+		return nil, fmt.Errorf("the contract %s is completed, no violations can happen", id)
+	}
+
+	due, err := contract.due(end)
+	if err != nil {
+		return nil, err
+	}
+	if !due {
+		return nil, fmt.Errorf("the %s period of %s that started at %s has not ended at %s", contract.billing(), id, contract.PeriodStart, periodEnd)
+	}
+	return s.settle(ctx, balanceCache{}, contract, end)
+}
+
+// settle transfers the refunds of the period of the contract that ends at
+// end, records the settlement and starts the next period.
+func (s *SmartContract) settle(ctx contractapi.TransactionContextInterface, balances balanceCache,
+	contract *sla_contract, end time.Time) (*Settlement, error) {
+	start, err := contract.periodStart(end)
+	if err != nil {
+		return nil, err
+	}
+	if !end.After(start) {
+		return nil, fmt.Errorf("the period of %s ending at %s is already settled, the current period started at %s",
+			contract.ID, end.UTC().Format(time.RFC3339), contract.PeriodStart)
+	}
+
+	settlement := Settlement{
+		DocType:     "settlement",
+		SLAID:       contract.ID,
+		Billing:     contract.billing(),
+		PeriodStart: start.UTC().Format(time.RFC3339),
+		PeriodEnd:   end.UTC().Format(time.RFC3339),
+		Violations:  append([]int{}, contract.DailyViolations...),
+		Amount:      contract.DailyValue,
+		TransferID:  ctx.GetStub().GetTxID(),
+	}
+
+	err = s.transferTokens(ctx, balances, contract.SLA.Details.Provider.Name, contract.SLA.Details.Client.Name, contract.DailyValue)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 0; i < len(contract.DailyViolations); i++ {
+		contract.TotalViolations[i] += contract.DailyViolations[i]
+		contract.DailyViolations[i] = 0
+	}
+	contract.DailyValue = 0.0
+	contract.PeriodStart = settlement.PeriodEnd
+
+	ContractJSON, err := json.Marshal(contract)
+	if err != nil {
+		return nil, err
+	}
+	err = ctx.GetStub().PutState(fmt.Sprintf("contract_%v", contract.ID), ContractJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	settlementJSON, err := json.Marshal(settlement)
+	if err != nil {
+		return nil, err
+	}
+	err = ctx.GetStub().PutState(settlementRecordKey(contract.ID, settlement.PeriodEnd), settlementJSON)
+	if err != nil {
+		return nil, err
+	}
+	return &settlement, nil
+}
+
+// GetSettlements returns the settlements of an SLA, oldest first.
+func (s *SmartContract) GetSettlements(ctx contractapi.TransactionContextInterface, id string) ([]*Settlement, error) {
+	// '`' is the character after '_', so the range holds the periods of id.
+	resultsIterator, err := ctx.GetStub().GetStateByRange(settlementRecordKey(id, ""), fmt.Sprintf("settlement_%v`", id))
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	settlements := []*Settlement{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var settlement Settlement
+		err = json.Unmarshal(queryResponse.Value, &settlement)
+		if err != nil {
+			return nil, err
+		}
+		// The range also holds the IDs that start with id and an underscore.
+		if settlement.SLAID == id {
+			settlements = append(settlements, &settlement)
+		}
+	}
+	return settlements, nil
+}
+
+// The outcome of the refund of an SLA in a batch.
+const (
+	refundRefunded = "refunded"
+	refundSkipped  = "skipped"
+	refundFailed   = "failed"
+)
+
+// RefundBatch is the outcome of a batch of refunds.
+type RefundBatch struct {
+	Outcomes []RefundOutcome `json:"outcomes"`
+	// Bookmark is where the next batch starts, empty after the last one.
+	Bookmark string `json:"bookmark"`
+}
+
+// RefundOutcome is the outcome of the refund of an SLA: refunded, skipped if
+// it is completed or its period has not ended, or failed.
+type RefundOutcome struct {
+	SLAID  string  `json:"slaId"`
+	Status string  `json:"status"`
+	Amount float64 `json:"amount,omitempty"`
+	Error  string  `json:"error,omitempty"`
+}
+
+// refundBatch refunds at most pageSize contracts, starting at the key
+// bookmark, with refund. refund returns no settlement to skip a contract. A
+// contract that fails is reported and does not stop the others, so refund
+// checks everything before it writes.
+func (s *SmartContract) refundBatch(ctx contractapi.TransactionContextInterface, bookmark string, pageSize int,
+	refund func(contract *sla_contract, balances balanceCache) (*Settlement, error)) (*RefundBatch, error) {
+	if pageSize <= 0 {
+		return nil, fmt.Errorf("the page size must be positive")
+	}
+	start := "contract_"
+	if bookmark != "" {
+		if !strings.HasPrefix(bookmark, start) {
+			return nil, fmt.Errorf("invalid bookmark %q", bookmark)
+		}
+		start = bookmark
+	}
+
+	// Only the contracts are refunded, not the users or the settlements.
+	resultsIterator, err := ctx.GetStub().GetStateByRange(start, "contract`")
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	batch := &RefundBatch{Outcomes: []RefundOutcome{}}
+	balances := balanceCache{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		if len(batch.Outcomes) == pageSize {
+			batch.Bookmark = queryResponse.Key
+			break
+		}
+
+		outcome := RefundOutcome{SLAID: strings.TrimPrefix(queryResponse.Key, "contract_"), Status: refundSkipped}
+		var contract sla_contract
+		err = json.Unmarshal(queryResponse.Value, &contract)
+		switch {
+		case err != nil:
+			outcome.Status, outcome.Error = refundFailed, err.Error()
+		case contract.SLA.State == "stopped":
+		default:
+			settlement, err := refund(&contract, balances)
+			if err != nil {
+				outcome.Status, outcome.Error = refundFailed, err.Error()
+			} else if settlement != nil {
+				outcome.Status, outcome.Amount = refundRefunded, settlement.Amount
+			}
+		}
+		batch.Outcomes = append(batch.Outcomes, outcome)
+	}
+	return batch, nil
+}
+
+// SettleRefunds settles at most pageSize SLAs whose billing cycle ended by
+// periodEnd, an RFC 3339 time. It is called again while the returned bookmark
+// is not empty, and periodEnd is recorded as the last settled period after
+// the last batch. A period that does not end after the last settled one is
+// refused, so that no period is settled twice. A settlement that was
+// interrupted is resumed where it stopped, with the same or a later period.
+func (s *SmartContract) SettleRefunds(ctx contractapi.TransactionContextInterface, periodEnd string, pageSize int) (*RefundBatch, error) {
+	end, err := time.Parse(time.RFC3339, periodEnd)
+	if err != nil {
+		return nil, fmt.Errorf("invalid period end %q: %w", periodEnd, err)
+	}
+	if err = notFuture(ctx, end); err != nil {
+		return nil, err
+	}
+	last, err := s.lastSettlement(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, settled := range []string{last.PeriodEnd, last.Pending} {
+		if settled == "" {
+			continue
+		}
+		settledEnd, err := time.Parse(time.RFC3339, settled)
+		if err != nil {
+			return nil, fmt.Errorf("invalid settled period %q: %w", settled, err)
+		}
+		if end.Before(settledEnd) || (settled == last.PeriodEnd && end.Equal(settledEnd)) {
+			return nil, fmt.Errorf("the period ending at %s is already settled, the last settled period ends at %s", periodEnd, settled)
+		}
+	}
+
+	batch, err := s.refundBatch(ctx, last.Bookmark, pageSize, func(contract *sla_contract, balances balanceCache) (*Settlement, error) {
+		due, err := contract.due(end)
+		if err != nil || !due {
+			return nil, err
+		}
+		return s.settle(ctx, balances, contract, end)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if batch.Bookmark == "" {
+		last = lastSettlement{PeriodEnd: end.UTC().Format(time.RFC3339)}
+	} else {
+		last.Pending, last.Bookmark = end.UTC().Format(time.RFC3339), batch.Bookmark
+	}
+	settlementJSON, err := json.Marshal(last)
+	if err != nil {
+		return nil, err
+	}
+	return batch, ctx.GetStub().PutState(settlementKey, settlementJSON)
+}
+
+// LastSettledPeriod returns the end of the last period settled for all SLAs,
+// or an empty string if no period was settled yet.
+func (s *SmartContract) LastSettledPeriod(ctx contractapi.TransactionContextInterface) (string, error) {
+	last, err := s.lastSettlement(ctx)
+	return last.PeriodEnd, err
+}
+
+func (s *SmartContract) lastSettlement(ctx contractapi.TransactionContextInterface) (lastSettlement, error) {
+	var last lastSettlement
+	settlementJSON, err := ctx.GetStub().GetState(settlementKey)
+	if err != nil {
+		return last, fmt.Errorf("failed to read from world state: %w", err)
+	}
+	if settlementJSON == nil {
+		return last, nil
+	}
+	err = json.Unmarshal(settlementJSON, &last)
+	return last, err
+}
@@ -6,6 +6,7 @@ import (
 	"math/rand"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib"
 	"github.com/hyperledger/fabric-contract-api-go/contractapi"
@@ -22,6 +23,9 @@ type sla_contract struct {
 	TotalViolations []int   `json:"TotalViolations"`
 	DailyValue      float64 `json:"DailyValue"`
 	DailyViolations []int   `json:"DailyViolations"`
+	// PeriodStart is when the period that is not settled yet started, as an
+	// RFC 3339 time. The value and violations above are those of the period.
+	PeriodStart string `json:"PeriodStart,omitempty"`
 }
 
 type User struct {
@@ -38,6 +42,11 @@ func (s *SmartContract) InitLedger(ctx contractapi.TransactionContextInterface)
 	return nil
 }
 
+// Ping answers the readiness checks of the applications without touching the ledger.
+func (s *SmartContract) Ping(ctx contractapi.TransactionContextInterface) string {
+	return "pong"
+}
+
 // Returns the users balance.
 func (s *SmartContract) UserBalance(ctx contractapi.TransactionContextInterface, id string) (float64, error) {
 	user, err := s.ReadUser(ctx, id)
@@ -111,13 +120,24 @@ func (s *SmartContract) Mint(ctx contractapi.TransactionContextInterface, id str
 	return fmt.Sprintf("New balance is: %f\n", updatedBalance), nil
 }
 
-func (s *SmartContract) transferTokens(ctx contractapi.TransactionContextInterface,
+// balanceCache holds the balances written by a transaction, which GetState
+// does not return until the transaction is committed.
+type balanceCache map[string]float64
+
+func (s *SmartContract) cachedBalance(ctx contractapi.TransactionContextInterface, balances balanceCache, id string) (float64, error) {
+	if balance, ok := balances[id]; ok {
+		return balance, nil
+	}
+	return s.UserBalance(ctx, id)
+}
+
+func (s *SmartContract) transferTokens(ctx contractapi.TransactionContextInterface, balances balanceCache,
 	from, to string, amount float64) error {
 	if from == to {
 		return fmt.Errorf("cannot transfer from and to the same account")
 	}
 
-	fromBalance, err := s.UserBalance(ctx, from)
+	fromBalance, err := s.cachedBalance(ctx, balances, from)
 	if err != nil {
 		return fmt.Errorf("could not get balance of transferer during token transfer: %w", err)
 	}
@@ -125,7 +145,7 @@ func (s *SmartContract) transferTokens(ctx contractapi.TransactionContextInterfa
 		return fmt.Errorf("transferer does not have enough tokens to complete transfer")
 	}
 
-	toBalance, err := s.UserBalance(ctx, to)
+	toBalance, err := s.cachedBalance(ctx, balances, to)
 	if err != nil {
 		return fmt.Errorf("could not get balance of transferee during token transfer: %w", err)
 	}
@@ -142,6 +162,7 @@ func (s *SmartContract) transferTokens(ctx contractapi.TransactionContextInterfa
 	if err != nil {
 		return fmt.Errorf("could not update receiver's balance: %w", err)
 	}
+	balances[from], balances[to] = updatedFromBalance, updatedToBalance
 	return nil
 }
 
@@ -153,6 +174,10 @@ func (s *SmartContract) CreateOrUpdateContract(ctx contractapi.TransactionContex
 		return fmt.Errorf("failed to unmarshal json: %w", err)
 	}
 
+	if err = validBilling(sla.Billing); err != nil {
+		return err
+	}
+
 	exists, err := s.UserExists(ctx, sla.Details.Provider.Name)
 	if err != nil {
 		return fmt.Errorf("provider account %s could not be read: %w", sla.Details.Provider.ID, err)
@@ -178,6 +203,11 @@ func (s *SmartContract) CreateOrUpdateContract(ctx contractapi.TransactionContex
 	totalViolations := make([]int, 1)
 	dailyViolations := make([]int, 1)
 	dailyValue := 0.0
+	now, err := txTime(ctx)
+	if err != nil {
+		return err
+	}
+	periodStart := now.UTC().Format(time.RFC3339)
 
 	if exists {
 		contract, err := s.ReadContract(ctx, sla.ID)
@@ -188,6 +218,7 @@ func (s *SmartContract) CreateOrUpdateContract(ctx contractapi.TransactionContex
 		totalViolations = contract.TotalViolations
 		dailyViolations = contract.DailyViolations
 		dailyValue = contract.DailyValue
+		periodStart = contract.PeriodStart
 	}
 
 	contract := sla_contract{
@@ -196,6 +227,7 @@ func (s *SmartContract) CreateOrUpdateContract(ctx contractapi.TransactionContex
 		TotalViolations: totalViolations,
 		DailyViolations: dailyViolations,
 		DailyValue:      dailyValue,
+		PeriodStart:     periodStart,
 	}
 
 	slaContractJSON, err := json.Marshal(contract)
@@ -224,6 +256,57 @@ func (s *SmartContract) ReadContract(ctx contractapi.TransactionContextInterface
 	return &contract, nil
 }
 
+// GetAllContracts returns every Contract stored in the world state.
+func (s *SmartContract) GetAllContracts(ctx contractapi.TransactionContextInterface) ([]*sla_contract, error) {
+	// Contract keys start with "contract_", and '`' is the character after '_'.
+	resultsIterator, err := ctx.GetStub().GetStateByRange("contract_", "contract`")
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var contracts []*sla_contract
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var contract sla_contract
+		err = json.Unmarshal(queryResponse.Value, &contract)
+		if err != nil {
+			return nil, err
+		}
+		contracts = append(contracts, &contract)
+	}
+	return contracts, nil
+}
+
+// StateEntry is a key of the world state and its value.
+type StateEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// ExportState returns the whole world state of the chaincode, so that it can
+// be archived when its SLA ends.
+func (s *SmartContract) ExportState(ctx contractapi.TransactionContextInterface) ([]StateEntry, error) {
+	resultsIterator, err := ctx.GetStub().GetStateByRange("", "")
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	entries := []StateEntry{}
+	for resultsIterator.HasNext() {
+		queryResponse, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, StateEntry{Key: queryResponse.Key, Value: string(queryResponse.Value)})
+	}
+	return entries, nil
+}
+
 // ReadUser returns the User stored in the world state with given name or public key.
 func (s *SmartContract) ReadUser(ctx contractapi.TransactionContextInterface, id string) (User, error) {
 	userBytes, err := ctx.GetStub().GetState(fmt.Sprintf("user_%v", id))
@@ -370,6 +453,8 @@ func (s *SmartContract) SLAViolated(ctx contractapi.TransactionContextInterface,
 	return ctx.GetStub().PutState(fmt.Sprintf("contract_%v", vio.SLAID), ContractJSON)
 }
 
+// RefundSLA settles the period of an SLA at once, ending it now whatever its
+// billing cycle.
 func (s *SmartContract) RefundSLA(ctx contractapi.TransactionContextInterface, id string) error {
 	contract, err := s.ReadContract(ctx, id)
 	if err != nil {
@@ -380,54 +465,23 @@ func (s *SmartContract) RefundSLA(ctx contractapi.TransactionContextInterface, i
 		return fmt.Errorf("the contract %s is completed, no violations can happen", id)
 	}
 
-	err = s.transferTokens(ctx, contract.SLA.Details.Provider.Name, contract.SLA.Details.Client.Name, contract.DailyValue)
+	now, err := txTime(ctx)
 	if err != nil {
 		return err
 	}
-
-	for i := 0; i < len(contract.DailyViolations); i++ {
-		contract.TotalViolations[i] += contract.DailyViolations[i]
-		contract.DailyViolations[i] = 0
-	}
-	contract.DailyValue = 0.0
-
-	ContractJSON, err := json.Marshal(contract)
-	if err != nil {
-		return err
-	}
-
-	return ctx.GetStub().PutState(fmt.Sprintf("contract_%v", id), ContractJSON)
+	_, err = s.settle(ctx, balanceCache{}, contract, now)
+	return err
 }
 
-func (s *SmartContract) RefundAllSLAs(ctx contractapi.TransactionContextInterface) error {
-	// range query with empty string for startKey and endKey does an
-	// open-ended query of all kv pairs in the chaincode namespace.
-	resultsIterator, err := ctx.GetStub().GetStateByRange("", "")
+// RefundAllSLAs refunds at once at most pageSize SLAs that are not
+// completed, starting at bookmark, which is empty for the first batch. An SLA
+// that fails to be refunded does not stop the others.
+func (s *SmartContract) RefundAllSLAs(ctx contractapi.TransactionContextInterface, bookmark string, pageSize int) (*RefundBatch, error) {
+	now, err := txTime(ctx)
 	if err != nil {
-		return err
-	}
-	defer resultsIterator.Close()
-
-	for resultsIterator.HasNext() {
-		queryResponse, err := resultsIterator.Next()
-		if err != nil {
-			return err
-		}
-
-		if strings.HasPrefix(queryResponse.Key, "user_") {
-			continue
-		}
-
-		var contract sla_contract
-		err = json.Unmarshal(queryResponse.Value, &contract)
-		if err != nil {
-			return err
-		}
-
-		err = s.RefundSLA(ctx, contract.ID)
-		if err != nil {
-			return err
-		}
+		return nil, err
 	}
-	return nil
+	return s.refundBatch(ctx, bookmark, pageSize, func(contract *sla_contract, balances balanceCache) (*Settlement, error) {
+		return s.settle(ctx, balances, contract, now)
+	})
 }
@@ -27,35 +27,110 @@ func (s *SmartContract) InitLedger(ctx contractapi.TransactionContextInterface)
 	return nil
 }
 
+// Ping answers the readiness checks of the applications without touching the ledger.
+func (s *SmartContract) Ping(ctx contractapi.TransactionContextInterface) string {
+	return "pong"
+}
+
 func (s *SmartContract) CreateContract(ctx contractapi.TransactionContextInterface, contractJSON string) error {
 	var vru lib.VRU
-	var vruCC vru_st
 
 	err := json.Unmarshal([]byte(contractJSON), &vru)
 	if err != nil {
 		return fmt.Errorf("failed to unmarshal json: %v", err)
 	}
 
-	exists, err := s.ContractExists(ctx, strconv.FormatInt(vru.Timestamp, 10))
+	vruCC, err := s.readVRU(ctx, vru.Timestamp)
+	if err != nil {
+		return err
+	}
+	mergeVRU(vruCC, vru)
+
+	return s.putVRU(ctx, vruCC)
+}
+
+// CreateContracts stores a JSON array of VRU records in a single transaction.
+// Every element is handled on its own, so a malformed record is reported in
+// the returned results instead of rejecting the whole batch.
+func (s *SmartContract) CreateContracts(ctx contractapi.TransactionContextInterface, contractsJSON string) ([]lib.BatchResult, error) {
+	var items []json.RawMessage
+	err := json.Unmarshal([]byte(contractsJSON), &items)
 	if err != nil {
-		return fmt.Errorf("failed to check contract existence: %v", err)
+		return nil, fmt.Errorf("failed to unmarshal json array: %v", err)
 	}
-	if exists {
-		vruCC.Trams = append(vruCC.Trams, vru.Tram)
-		vruCC.OBUs = append(vruCC.OBUs, vru.OBUs...)
-	} else {
-		vruCC.Timestamp = vru.Timestamp
-		vruCC.Trams = make([]lib.Tram_s, 1)
-		vruCC.Trams[0] = vru.Tram
-		vruCC.OBUs = vru.OBUs
+
+	// Reads do not see the writes of the same transaction, so records that
+	// share a timestamp are merged here before they are put to the world state.
+	pending := make(map[int64]*vru_st)
+	var order []int64
+
+	results := make([]lib.BatchResult, len(items))
+	for i, item := range items {
+		results[i].Index = i
+
+		var vru lib.VRU
+		err := json.Unmarshal(item, &vru)
+		if err != nil {
+			results[i].Error = fmt.Sprintf("failed to unmarshal json: %v", err)
+			continue
+		}
+		results[i].Key = strconv.FormatInt(vru.Timestamp, 10)
+
+		vruCC, ok := pending[vru.Timestamp]
+		if !ok {
+			vruCC, err = s.readVRU(ctx, vru.Timestamp)
+			if err != nil {
+				results[i].Error = err.Error()
+				continue
+			}
+			pending[vru.Timestamp] = vruCC
+			order = append(order, vru.Timestamp)
+		}
+		mergeVRU(vruCC, vru)
 	}
 
+	for _, timestamp := range order {
+		err = s.putVRU(ctx, pending[timestamp])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// readVRU returns the stored record for the timestamp, or an empty one
+// if nothing has been stored for it yet.
+func (s *SmartContract) readVRU(ctx contractapi.TransactionContextInterface, timestamp int64) (*vru_st, error) {
+	vruJSON, err := ctx.GetStub().GetState(strconv.FormatInt(timestamp, 10))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+
+	vruCC := vru_st{Timestamp: timestamp}
+	if vruJSON == nil {
+		return &vruCC, nil
+	}
+
+	err = json.Unmarshal(vruJSON, &vruCC)
+	if err != nil {
+		return nil, fmt.Errorf("could not unmarshal vru chaincode struct: %v", err)
+	}
+	return &vruCC, nil
+}
+
+func (s *SmartContract) putVRU(ctx contractapi.TransactionContextInterface, vruCC *vru_st) error {
 	vruCCJson, err := json.Marshal(vruCC)
 	if err != nil {
 		return fmt.Errorf("could not marshal vru chaincode struct: %v", err)
 	}
 
-	return ctx.GetStub().PutState(fmt.Sprintf("%v", vru.Timestamp), []byte(vruCCJson))
+	return ctx.GetStub().PutState(strconv.FormatInt(vruCC.Timestamp, 10), vruCCJson)
+}
+
+// mergeVRU adds the tram and OBUs of a single record to the stored record.
+func mergeVRU(vruCC *vru_st, vru lib.VRU) {
+	vruCC.Trams = append(vruCC.Trams, vru.Tram)
+	vruCC.OBUs = append(vruCC.OBUs, vru.OBUs...)
 }
 
 // ContractExists returns true when Contract with given ID exists in world state
@@ -68,7 +143,8 @@ func (s *SmartContract) ContractExists(ctx contractapi.TransactionContextInterfa
 	return ContractJSON != nil, nil
 }
 
-func (s *SmartContract) getAssetByRange(ctx contractapi.TransactionContextInterface, startKey, endKey string) ([]*vru_st, error) {
+// GetAssetByRange returns the records whose timestamps are in [startKey, endKey).
+func (s *SmartContract) GetAssetByRange(ctx contractapi.TransactionContextInterface, startKey, endKey string) ([]*vru_st, error) {
 	resultsIterator, err := ctx.GetStub().GetStateByRange(startKey, endKey)
 	if err != nil {
 		return nil, err
@@ -93,7 +169,7 @@ func (s *SmartContract) getAssetByRange(ctx contractapi.TransactionContextInterf
 }
 
 func (s *SmartContract) GetAssetRiskInRange(ctx contractapi.TransactionContextInterface, startKey, endKey string) (lib.Risk, error) {
-	assets, err := s.getAssetByRange(ctx, startKey, endKey)
+	assets, err := s.GetAssetByRange(ctx, startKey, endKey)
 	if err != nil {
 		return lib.Risk{}, err
 	}
@@ -0,0 +1,510 @@
+package lib
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ArchiveOptions controls when the active file of an Archive is rotated.
+type ArchiveOptions struct {
+	// MaxSizeMB rotates the active file once it would grow past this size. 0 disables it.
+	MaxSizeMB int `yaml:"maxSizeMB" env:"archive_max_size_mb"`
+	// MaxAge rotates the active file once its first record is older than this. 0 disables it.
+	MaxAge time.Duration `yaml:"maxAge" env:"archive_max_age"`
+	// Compress gzips the rotated files.
+	Compress bool `yaml:"compress" env:"archive_compress"`
+}
+
+// Archive keeps a local copy of the records a client receives. Records are
+// appended to the active file as JSON Lines and synced to disk before Write
+// returns, so a crash loses at most the record that was being written.
+// Rotated files are named after the active file and the time they were rotated.
+type Archive struct {
+	path string
+	opts ArchiveOptions
+
+	mu      sync.Mutex
+	f       *os.File
+	size    int64
+	started time.Time
+}
+
+const archiveTimeFormat = "20060102T150405.000"
+
+// OpenArchive opens the archive whose active file is at path. A partial record
+// left by a crash is removed. If path ends in .jsonl and a JSON array written by
+// an older client exists next to it with the .json extension, its records are
+// recovered into the archive first.
+func OpenArchive(path string, opts ArchiveOptions) (*Archive, error) {
+	a := &Archive{path: path, opts: opts}
+
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+
+	if strings.HasSuffix(path, ".jsonl") {
+		legacy := strings.TrimSuffix(path, "l")
+		exists, err := FileExists(legacy)
+		if err != nil {
+			a.Close()
+			return nil, err
+		}
+		if exists {
+			n, err := RecoverJSONArray(legacy, a)
+			if err != nil {
+				a.Close()
+				return nil, fmt.Errorf("failed to recover %s: %w", legacy, err)
+			}
+			Info("recovered legacy archive", "records", n, "file", legacy)
+		}
+	}
+	return a, nil
+}
+
+func (a *Archive) open() error {
+	f, err := os.OpenFile(a.path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open archive: %w", err)
+	}
+
+	size, err := repairTail(f)
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to repair archive %s: %w", a.path, err)
+	}
+	if _, err = f.Seek(size, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+
+	a.f = f
+	a.size = size
+	a.started = time.Time{}
+	if size > 0 {
+		a.started = time.Now()
+	}
+	return nil
+}
+
+// repairTail truncates the file after its last complete line and returns the new size.
+func repairTail(f *os.File) (int64, error) {
+	stat, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := stat.Size()
+	if size == 0 {
+		return 0, nil
+	}
+
+	buf := make([]byte, 4096)
+	end := size
+	for end > 0 {
+		n := int64(len(buf))
+		if n > end {
+			n = end
+		}
+		if _, err := f.ReadAt(buf[:n], end-n); err != nil {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			end = end - n + int64(i) + 1
+			break
+		}
+		end -= n
+	}
+
+	if end < size {
+		Warn("dropping a partial record", "bytes", size-end, "file", f.Name())
+		if err := f.Truncate(end); err != nil {
+			return 0, err
+		}
+		if err := f.Sync(); err != nil {
+			return 0, err
+		}
+	}
+	return end, nil
+}
+
+// Write appends a JSON object to the archive as a single line and syncs it to disk.
+func (a *Archive) Write(obj []byte) error {
+	var line bytes.Buffer
+	if err := json.Compact(&line, obj); err != nil {
+		return fmt.Errorf("invalid archive record: %w", err)
+	}
+	line.WriteByte('\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.f == nil {
+		return errors.New("archive is closed")
+	}
+	if a.shouldRotate(int64(line.Len())) {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := a.f.Write(line.Bytes())
+	a.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write archive: %w", err)
+	}
+	if err = a.f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync archive: %w", err)
+	}
+	if a.started.IsZero() {
+		a.started = time.Now()
+	}
+	return nil
+}
+
+func (a *Archive) shouldRotate(next int64) bool {
+	if a.size == 0 {
+		return false
+	}
+	if a.opts.MaxSizeMB > 0 && a.size+next > int64(a.opts.MaxSizeMB)<<20 {
+		return true
+	}
+	return a.opts.MaxAge > 0 && time.Since(a.started) >= a.opts.MaxAge
+}
+
+// Rotate closes the active file, renames it after the current time and starts a new one.
+func (a *Archive) Rotate() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.f == nil {
+		return errors.New("archive is closed")
+	}
+	if a.size == 0 {
+		return nil
+	}
+	return a.rotate()
+}
+
+func (a *Archive) rotate() error {
+	if err := a.f.Close(); err != nil {
+		return fmt.Errorf("failed to close archive: %w", err)
+	}
+	a.f = nil
+
+	rotated, err := freeRotatedName(a.path, time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to rotate archive: %w", err)
+	}
+	if err := os.Rename(a.path, rotated); err != nil {
+		return fmt.Errorf("failed to rotate archive: %w", err)
+	}
+	if a.opts.Compress {
+		if err := compressFile(rotated); err != nil {
+			// The rotated file is still complete, so only the compression is lost.
+			Error("failed to compress archive", "file", rotated, "error", err)
+		}
+	}
+	return a.open()
+}
+
+// freeRotatedName returns a name for the file of path rotated at t that no
+// rotated file has yet. Rotations within the same millisecond get a counter,
+// which sorts after the name without it.
+func freeRotatedName(path string, t time.Time) (string, error) {
+	ext := filepath.Ext(path)
+	name := fmt.Sprintf("%s-%s", strings.TrimSuffix(path, ext), t.UTC().Format(archiveTimeFormat))
+	rotated := name + ext
+	for i := 1; ; i++ {
+		taken, err := anyFileExists(rotated, rotated+".gz")
+		if err != nil || !taken {
+			return rotated, err
+		}
+		rotated = fmt.Sprintf("%s_%d%s", name, i, ext)
+	}
+}
+
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := path + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	zw := gzip.NewWriter(out)
+	if _, err = io.Copy(zw, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, path+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// Close closes the active file.
+func (a *Archive) Close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.f == nil {
+		return nil
+	}
+	err := a.f.Close()
+	a.f = nil
+	return err
+}
+
+// ArchiveFiles returns the files of the archive whose active file is at path,
+// oldest first: the rotated files, compressed or not, followed by the active file.
+func ArchiveFiles(path string) ([]string, error) {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+
+	var files []string
+	for _, pattern := range []string{base + "-*" + ext, base + "-*" + ext + ".gz"} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	// The rotation time in the name sorts the files chronologically.
+	sort.Slice(files, func(i, j int) bool {
+		return strings.TrimSuffix(files[i], ".gz") < strings.TrimSuffix(files[j], ".gz")
+	})
+
+	exists, err := FileExists(path)
+	if err != nil {
+		return nil, err
+	}
+	if exists {
+		files = append(files, path)
+	}
+	return files, nil
+}
+
+// ReadArchive calls fn for every record of the archive whose active file is at
+// path, oldest first. A partial record at the end of a file is skipped.
+func ReadArchive(path string, fn func(record json.RawMessage) error) error {
+	files, err := ArchiveFiles(path)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err = readArchiveFile(file, fn); err != nil {
+			return fmt.Errorf("failed to read %s: %w", file, err)
+		}
+	}
+	return nil
+}
+
+func readArchiveFile(path string, fn func(record json.RawMessage) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			// A line without a newline was not completely written.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		if !json.Valid(line) {
+			return fmt.Errorf("invalid record %q", line)
+		}
+		if err = fn(json.RawMessage(line)); err != nil {
+			return err
+		}
+	}
+}
+
+// ExportArchive writes every record of the archive whose active file is at path
+// to w as a JSON array, in the format the clients used to write.
+func ExportArchive(path string, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("[\n")
+	first := true
+	err := ReadArchive(path, func(record json.RawMessage) error {
+		if !first {
+			bw.WriteString(",\n")
+		}
+		first = false
+		_, err := bw.Write(record)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	bw.WriteString("\n]\n")
+	return bw.Flush()
+}
+
+// RecoverJSONArray adds the objects of a JSON array file written by the older
+// clients to the archive, as a rotated file named after the modification time
+// of the array file. Files left without a closing bracket, with a trailing
+// comma or cut in the middle of an object by a crash are accepted. The rotated
+// file is written in full before it appears, and the array file is renamed
+// with the .recovered suffix after it, so a crash in between recovers neither
+// part of the records nor the records twice. RecoverJSONArray returns the
+// number of recovered records.
+func RecoverJSONArray(path string, a *Archive) (int, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	records, err := parseLegacyArray(b)
+	if err != nil {
+		return 0, err
+	}
+
+	ext := filepath.Ext(a.path)
+	rotated := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(a.path, ext), info.ModTime().UTC().Format(archiveTimeFormat), ext)
+	written, err := anyFileExists(rotated, rotated+".gz")
+	if err != nil {
+		return 0, err
+	}
+	if !written && len(records) > 0 {
+		if err = writeRecords(rotated, records); err != nil {
+			return 0, fmt.Errorf("failed to write %s: %w", rotated, err)
+		}
+		if a.opts.Compress {
+			if err = compressFile(rotated); err != nil {
+				Error("failed to compress archive", "file", rotated, "error", err)
+			}
+		}
+	}
+
+	if err = os.Rename(path, path+".recovered"); err != nil {
+		return 0, err
+	}
+	return len(records), nil
+}
+
+// writeRecords writes the records to a new file at path, one per line, which
+// only appears once it is complete.
+func writeRecords(path string, records []json.RawMessage) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	bw := bufio.NewWriter(f)
+	for _, record := range records {
+		var line bytes.Buffer
+		if err = json.Compact(&line, record); err != nil {
+			f.Close()
+			return fmt.Errorf("invalid archive record: %w", err)
+		}
+		line.WriteByte('\n')
+		bw.Write(line.Bytes())
+	}
+	if err = bw.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func anyFileExists(paths ...string) (bool, error) {
+	for _, path := range paths {
+		exists, err := FileExists(path)
+		if err != nil || exists {
+			return exists, err
+		}
+	}
+	return false, nil
+}
+
+func parseLegacyArray(b []byte) ([]json.RawMessage, error) {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 {
+		return nil, nil
+	}
+	if b[0] != '[' {
+		return nil, errors.New("not a JSON array")
+	}
+
+	var records []json.RawMessage
+	pos := 1
+	for {
+		// The older clients separated the objects with ',' and overwrote the
+		// closing bracket with ' ' while the file was open.
+		for pos < len(b) && strings.IndexByte(", \t\r\n", b[pos]) >= 0 {
+			pos++
+		}
+		if pos >= len(b) || b[pos] == ']' {
+			return records, nil
+		}
+
+		var record json.RawMessage
+		dec := json.NewDecoder(bytes.NewReader(b[pos:]))
+		if err := dec.Decode(&record); err != nil {
+			// Whatever follows the last complete object is the damage of a crash.
+			Warn("dropping the bytes after the last complete record", "bytes", len(b)-pos)
+			return records, nil
+		}
+		records = append(records, record)
+		pos += int(dec.InputOffset())
+	}
+}
@@ -0,0 +1,184 @@
+package lib
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func readRecords(t *testing.T, path string) []string {
+	t.Helper()
+	var records []string
+	err := ReadArchive(path, func(record json.RawMessage) error {
+		records = append(records, string(record))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+func TestRecoverJSONArray(t *testing.T) {
+	modTime := time.Date(2022, 8, 8, 13, 45, 20, 123e6, time.UTC)
+	tests := []struct {
+		name     string
+		legacy   string
+		compress bool
+		want     []string
+	}{
+		{
+			name:   "complete",
+			legacy: "[\n{\"id\": \"1\"},\n{\"id\": \"2\"}\n]\n",
+			want:   []string{`{"id":"1"}`, `{"id":"2"}`},
+		},
+		{
+			name:     "compressed",
+			legacy:   `[{"id":"1"},{"id":"2"}]`,
+			compress: true,
+			want:     []string{`{"id":"1"}`, `{"id":"2"}`},
+		},
+		{
+			name:   "open",
+			legacy: "[{\"id\":\"1\"},\n{\"id\":\"2\"} ",
+			want:   []string{`{"id":"1"}`, `{"id":"2"}`},
+		},
+		{
+			name:   "trailing comma",
+			legacy: `[{"id":"1"},{"id":"2"},`,
+			want:   []string{`{"id":"1"}`, `{"id":"2"}`},
+		},
+		{
+			name:   "cut record",
+			legacy: `[{"id":"1"},{"id":"2"},{"id":`,
+			want:   []string{`{"id":"1"}`, `{"id":"2"}`},
+		},
+		{
+			name:   "empty",
+			legacy: "",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "sla.jsonl")
+			legacy := filepath.Join(dir, "sla.json")
+			if err := os.WriteFile(legacy, []byte(tt.legacy), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(legacy, modTime, modTime); err != nil {
+				t.Fatal(err)
+			}
+
+			a, err := OpenArchive(path, ArchiveOptions{Compress: tt.compress})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err = a.Write([]byte(`{"id":"3"}`)); err != nil {
+				t.Fatal(err)
+			}
+			if err = a.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			want := append(tt.want, `{"id":"3"}`)
+			if got := readRecords(t, path); !reflect.DeepEqual(got, want) {
+				t.Errorf("records %v, want %v", got, want)
+			}
+			if exists, _ := FileExists(legacy); exists {
+				t.Errorf("%s was not renamed", legacy)
+			}
+			if exists, _ := FileExists(legacy + ".recovered"); !exists {
+				t.Errorf("%s.recovered does not exist", legacy)
+			}
+			if len(tt.want) > 0 {
+				rotated := filepath.Join(dir, "sla-20220808T134520.123.jsonl")
+				if tt.compress {
+					rotated += ".gz"
+				}
+				if exists, _ := FileExists(rotated); !exists {
+					t.Errorf("%s does not exist", rotated)
+				}
+			}
+
+			// A crash before the array file was renamed recovers it again,
+			// without adding its records twice.
+			if err = os.Rename(legacy+".recovered", legacy); err != nil {
+				t.Fatal(err)
+			}
+			a, err = OpenArchive(path, ArchiveOptions{Compress: tt.compress})
+			if err != nil {
+				t.Fatal(err)
+			}
+			a.Close()
+			if got := readRecords(t, path); !reflect.DeepEqual(got, want) {
+				t.Errorf("records after a second recovery %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestFreeRotatedName(t *testing.T) {
+	rotatedAt := time.Date(2022, 8, 8, 13, 45, 20, 123e6, time.UTC)
+	tests := []struct {
+		name     string
+		existing []string
+		want     string
+	}{
+		{
+			name: "free",
+			want: "sla-20220808T134520.123.jsonl",
+		},
+		{
+			name:     "rotated",
+			existing: []string{"sla-20220808T134520.123.jsonl"},
+			want:     "sla-20220808T134520.123_1.jsonl",
+		},
+		{
+			name:     "compressed",
+			existing: []string{"sla-20220808T134520.123.jsonl.gz"},
+			want:     "sla-20220808T134520.123_1.jsonl",
+		},
+		{
+			name:     "rotated twice",
+			existing: []string{"sla-20220808T134520.123.jsonl", "sla-20220808T134520.123_1.jsonl.gz"},
+			want:     "sla-20220808T134520.123_2.jsonl",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "sla.jsonl")
+			for _, name := range tt.existing {
+				if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			got, err := freeRotatedName(path, rotatedAt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := filepath.Join(dir, tt.want); got != want {
+				t.Errorf("freeRotatedName = %s, want %s", got, want)
+			}
+
+			// The new name sorts after the rotated files that took the others.
+			if err = os.WriteFile(got, nil, 0644); err != nil {
+				t.Fatal(err)
+			}
+			files, err := ArchiveFiles(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if last := files[len(files)-1]; last != got {
+				t.Errorf("ArchiveFiles ends with %s, want %s", last, got)
+			}
+		})
+	}
+}
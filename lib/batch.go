@@ -0,0 +1,105 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+// BatchResult is the outcome of a single element of a batch transaction.
+// An empty Error means that the element was written to the world state.
+type BatchResult struct {
+	Index int    `json:"index"`
+	Key   string `json:"key"`
+	Error string `json:"error,omitempty"`
+}
+
+// Batcher collects records into micro-batches. A batch is ready once it holds
+// maxSize records, or once maxWait has passed since its first record arrived.
+type Batcher struct {
+	maxSize int
+	maxWait time.Duration
+	items   []json.RawMessage
+	done    []func()
+	started time.Time
+}
+
+func NewBatcher(maxSize int, maxWait time.Duration) *Batcher {
+	if maxSize < 1 {
+		maxSize = 1
+	}
+	return &Batcher{
+		maxSize: maxSize,
+		maxWait: maxWait,
+	}
+}
+
+// Add appends a JSON record to the current batch. done, if set, is called
+// once the batch was submitted, as OffsetTracker.Track returns it.
+func (b *Batcher) Add(item []byte, done func()) {
+	if len(b.items) == 0 {
+		b.started = time.Now()
+	}
+	b.items = append(b.items, json.RawMessage(item))
+	if done != nil {
+		b.done = append(b.done, done)
+	}
+}
+
+func (b *Batcher) Len() int {
+	return len(b.items)
+}
+
+// Ready returns true when the current batch should be submitted.
+func (b *Batcher) Ready() bool {
+	if len(b.items) == 0 {
+		return false
+	}
+	return len(b.items) >= b.maxSize || time.Since(b.started) >= b.maxWait
+}
+
+// Flush returns the current batch, with the function that calls the done
+// functions of its records, and starts a new one.
+func (b *Batcher) Flush() ([]json.RawMessage, func()) {
+	items, done := b.items, b.done
+	b.items, b.done = nil, nil
+	return items, func() {
+		for _, fn := range done {
+			fn()
+		}
+	}
+}
+
+// NewBatchTransaction creates a pipeline transaction that submits the records as a
+// single JSON array to a batch transaction of the chaincode. The results of
+// the individual records are passed to done.
+func NewBatchTransaction(key string, contract *client.Contract, name string,
+	items []json.RawMessage, done func([]BatchResult, error)) (Transaction, error) {
+	batchJSON, err := json.Marshal(items)
+	if err != nil {
+		return Transaction{}, fmt.Errorf("failed to marshal batch: %w", err)
+	}
+
+	return Transaction{
+		Key:      key,
+		Contract: contract,
+		Name:     name,
+		Args:     []string{string(batchJSON)},
+		Done: func(result []byte, err error) {
+			if err != nil {
+				done(nil, err)
+				return
+			}
+
+			var results []BatchResult
+			err = json.Unmarshal(result, &results)
+			if err != nil {
+				done(nil, fmt.Errorf("failed to unmarshal batch results: %w", err))
+				return
+			}
+			done(results, nil)
+		},
+	}, nil
+}
@@ -0,0 +1,192 @@
+// Package ccserver runs contracts as a chaincode server, the process the
+// peers connect to when chaincode is deployed as a service.
+package ccserver
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-contract-api-go/contractapi"
+	"github.com/hyperledger/fabric-protos-go/peer"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+
+	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib"
+)
+
+// The limits of the messages match the peer, as in the shim.
+const maxMessageSize = 100 * 1024 * 1024
+
+// Config configures a chaincode server. It is read from the CHAINCODE_*
+// environment variables, see ConfigFromEnv.
+type Config struct {
+	// CCID is the package ID of the chaincode on the peers.
+	CCID string
+	// Address is the address the peers connect to.
+	Address string
+	// HealthAddress, if set, serves the liveness and readiness probes.
+	HealthAddress string
+	TLS           TLSConfig
+}
+
+// TLSConfig points to the TLS material of the server. The files are reloaded
+// when they change.
+type TLSConfig struct {
+	Disabled bool
+	KeyPath  string
+	CertPath string
+	// ClientCAPath, if set, makes the server verify the certificates of the peers.
+	ClientCAPath string
+}
+
+// ConfigFromEnv reads the configuration from the environment and validates it.
+func ConfigFromEnv() (Config, error) {
+	conf := Config{
+		CCID:          os.Getenv("CHAINCODE_ID"),
+		Address:       os.Getenv("CHAINCODE_SERVER_ADDRESS"),
+		HealthAddress: os.Getenv("CHAINCODE_HEALTH_ADDRESS"),
+		TLS: TLSConfig{
+			Disabled:     true,
+			KeyPath:      os.Getenv("CHAINCODE_TLS_KEY"),
+			CertPath:     os.Getenv("CHAINCODE_TLS_CERT"),
+			ClientCAPath: os.Getenv("CHAINCODE_CLIENT_CA_CERT"),
+		},
+	}
+
+	var problems []string
+	if value, ok := os.LookupEnv("CHAINCODE_TLS_DISABLED"); ok {
+		disabled, err := strconv.ParseBool(value)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("CHAINCODE_TLS_DISABLED is not a valid boolean: %q", value))
+		}
+		conf.TLS.Disabled = disabled
+	}
+
+	problems = append(problems, conf.validate()...)
+	if len(problems) > 0 {
+		return conf, &lib.ConfigError{Problems: problems}
+	}
+	return conf, nil
+}
+
+func (conf Config) validate() []string {
+	var problems []string
+	if conf.CCID == "" {
+		problems = append(problems, "CHAINCODE_ID is missing")
+	}
+	if conf.Address == "" {
+		problems = append(problems, "CHAINCODE_SERVER_ADDRESS is missing")
+	} else if _, _, err := net.SplitHostPort(conf.Address); err != nil {
+		problems = append(problems, fmt.Sprintf("CHAINCODE_SERVER_ADDRESS: %v", err))
+	}
+	if conf.HealthAddress != "" {
+		if _, _, err := net.SplitHostPort(conf.HealthAddress); err != nil {
+			problems = append(problems, fmt.Sprintf("CHAINCODE_HEALTH_ADDRESS: %v", err))
+		}
+	}
+	if conf.TLS.Disabled {
+		return problems
+	}
+
+	files := []struct{ env, path string }{
+		{"CHAINCODE_TLS_KEY", conf.TLS.KeyPath},
+		{"CHAINCODE_TLS_CERT", conf.TLS.CertPath},
+	}
+	if conf.TLS.ClientCAPath != "" {
+		files = append(files, struct{ env, path string }{"CHAINCODE_CLIENT_CA_CERT", conf.TLS.ClientCAPath})
+	}
+	for _, file := range files {
+		if file.path == "" {
+			problems = append(problems, fmt.Sprintf("%s is missing, or set CHAINCODE_TLS_DISABLED=true", file.env))
+		} else if _, err := os.Stat(file.path); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", file.env, err))
+		}
+	}
+	return problems
+}
+
+// Run serves the contracts with the configuration of the environment until
+// SIGINT or SIGTERM, and exits if it fails. The first contract is the default
+// one; the functions of the others are called as "<contract name>:<function>".
+func Run(contracts ...contractapi.ContractInterface) {
+	conf, err := ConfigFromEnv()
+	if err != nil {
+		lib.Fatal("invalid chaincode server configuration", "error", err)
+	}
+	if err := Serve(conf, contracts...); err != nil {
+		lib.Fatal("chaincode server failed", "ccid", conf.CCID, "error", err)
+	}
+}
+
+// Serve serves the contracts until SIGINT or SIGTERM.
+func Serve(conf Config, contracts ...contractapi.ContractInterface) error {
+	chaincode, err := contractapi.NewChaincode(contracts...)
+	if err != nil {
+		return fmt.Errorf("failed to create chaincode: %w", err)
+	}
+
+	options := []grpc.ServerOption{
+		grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    1 * time.Minute,
+			Timeout: 20 * time.Second,
+		}),
+		grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             1 * time.Minute,
+			PermitWithoutStream: true,
+		}),
+		grpc.MaxSendMsgSize(maxMessageSize),
+		grpc.MaxRecvMsgSize(maxMessageSize),
+		grpc.ConnectionTimeout(5 * time.Second),
+	}
+	if !conf.TLS.Disabled {
+		certs, err := newCertReloader(conf.TLS)
+		if err != nil {
+			return err
+		}
+		options = append(options, grpc.Creds(credentials.NewTLS(certs.tlsConfig())))
+	}
+
+	// The shim serves the connections of the peers; only the gRPC server is our own.
+	server := grpc.NewServer(options...)
+	peer.RegisterChaincodeServer(server, &shim.ChaincodeServer{CCID: conf.CCID, CC: chaincode})
+
+	listener, err := net.Listen("tcp", conf.Address)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", conf.Address, err)
+	}
+
+	shutdown := lib.NewShutdown(10 * time.Second)
+	defer shutdown.Stop()
+	shutdown.OnStop("chaincode server", func(context.Context) error {
+		// The peers keep their streams open, so there is nothing to drain.
+		server.Stop()
+		return nil
+	})
+
+	if conf.HealthAddress != "" {
+		health := lib.NewHealth(0)
+		health.AddCheck("chaincode server", lib.ListenerCheck(listener.Addr().String()))
+		health.AddCheck("shutdown", shutdown.Check)
+		healthServer := lib.ServeHealth(conf.HealthAddress, health)
+		shutdown.OnStop("health endpoint", healthServer.Shutdown)
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Serve(listener)
+	}()
+	lib.Info("serving chaincode", "ccid", conf.CCID, "address", conf.Address, "tls", !conf.TLS.Disabled)
+
+	select {
+	case err := <-errs:
+		return err
+	case <-shutdown.Done():
+		return nil
+	}
+}
@@ -0,0 +1,153 @@
+package ccserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib"
+)
+
+// cipherSuites follows the defaults of the peer, as the shim does.
+var cipherSuites = []uint16{
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+// certReloader serves the TLS material of the server and reloads it once its
+// files change, so that rotated certificates are used without a restart. The
+// files are checked on every handshake; if the new material is invalid, for
+// instance because only the key has been replaced yet, the old one is kept.
+type certReloader struct {
+	conf TLSConfig
+
+	mu        sync.Mutex
+	modTimes  []time.Time
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+func newCertReloader(conf TLSConfig) (*certReloader, error) {
+	r := &certReloader{conf: conf}
+	modTimes, err := r.stat()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTimes); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *certReloader) files() []string {
+	files := []string{r.conf.CertPath, r.conf.KeyPath}
+	if r.conf.ClientCAPath != "" {
+		files = append(files, r.conf.ClientCAPath)
+	}
+	return files
+}
+
+// stat follows symbolic links, so the atomic updates of Kubernetes secrets,
+// which swap a link to a new directory, are noticed as well.
+func (r *certReloader) stat() ([]time.Time, error) {
+	files := r.files()
+	modTimes := make([]time.Time, len(files))
+	for i, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+func (r *certReloader) load(modTimes []time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.conf.CertPath, r.conf.KeyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load key pair: %w", err)
+	}
+	cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("failed to parse certificate: %w", err)
+	}
+
+	var clientCAs *x509.CertPool
+	if r.conf.ClientCAPath != "" {
+		pem, err := os.ReadFile(r.conf.ClientCAPath)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA: %w", err)
+		}
+		clientCAs = x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return errors.New("no certificates found in client CA " + r.conf.ClientCAPath)
+		}
+	}
+
+	r.cert = &cert
+	r.clientCAs = clientCAs
+	r.modTimes = modTimes
+	return nil
+}
+
+func (r *certReloader) changed(modTimes []time.Time) bool {
+	for i := range modTimes {
+		if !modTimes[i].Equal(r.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// current reloads the material if its files changed and returns it.
+func (r *certReloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTimes, err := r.stat()
+	if err != nil {
+		lib.Warn("failed to check the TLS files, keeping the loaded ones", "error", err)
+		return r.cert, r.clientCAs
+	}
+	if r.changed(modTimes) {
+		if err := r.load(modTimes); err != nil {
+			lib.Warn("failed to reload the TLS files, keeping the loaded ones", "error", err)
+		} else {
+			lib.Info("reloaded TLS certificate", "cert", r.conf.CertPath, "notAfter", r.cert.Leaf.NotAfter)
+		}
+	}
+	return r.cert, r.clientCAs
+}
+
+// tlsConfig returns a server configuration that picks up the current material
+// on every handshake.
+func (r *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, clientCAs := r.current()
+			conf := &tls.Config{
+				MinVersion:             tls.VersionTLS12,
+				Certificates:           []tls.Certificate{*cert},
+				CipherSuites:           cipherSuites,
+				SessionTicketsDisabled: true,
+				// The configuration replaces the one of the gRPC credentials,
+				// which would have added HTTP/2.
+				NextProtos: []string{"h2"},
+			}
+			if clientCAs != nil {
+				conf.ClientCAs = clientCAs
+				conf.ClientAuth = tls.RequireAndVerifyClientCert
+			}
+			return conf, nil
+		},
+	}
+}
@@ -1,24 +1,286 @@
 package lib
 
 import (
+	"encoding"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"net"
 	"os"
+	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"gopkg.in/yaml.v3"
 )
 
+// Config holds the configuration of a client. It is loaded by LoadConfig from
+// the client defaults, an optional YAML or JSON file and the environment, in
+// that order. The env tag names the environmental variable that overrides a field.
 type Config struct {
-	DataFolder         string
-	JSONFiles          []string
-	ContractNamePrefix string
-	TlsCertPath        string
-	PeerEndpoint       string
-	GatewayPeer        string
-	ChannelName        string
-	ChaincodeName      string
-	IdentityEndpoint   string
-	ConsumerGroup      string
-	UserConf           *UserConfig
+	OrgNr              int               `yaml:"orgNr" env:"org_nr"`
+	DataFolder         string            `yaml:"dataFolder" env:"data_folder"`
+	JSONFiles          []string          `yaml:"jsonFiles" env:"json_files"`
+	Archive            ArchiveOptions    `yaml:"archive"`
+	ContractNamePrefix string            `yaml:"contractNamePrefix" env:"fabric_contract_prefix"`
+	TlsCertPath        string            `yaml:"tlsCertPath" env:"tls_cert_path"`
+	ClientTLS          ClientTLS         `yaml:"clientTls"`
+	WalletPath         string            `yaml:"walletPath" env:"wallet_path"`
+	Signer             SignerConfig      `yaml:"signer"`
+	PeerEndpoint       string            `yaml:"peerEndpoint" env:"fabric_gateway_hostport"`
+	GatewayPeer        string            `yaml:"gatewayPeer" env:"fabric_gateway_sslHostOverride"`
+	Gateways           []GatewayEndpoint `yaml:"gateways" env:"fabric_gateways"`
+	Keepalive          Keepalive         `yaml:"keepalive"`
+	ChannelName        string            `yaml:"channelName" env:"fabric_channel"`
+	ChaincodeName      string            `yaml:"chaincodeName" env:"fabric_contract"`
+	IdentityEndpoint   string            `yaml:"identityEndpoint" env:"identity_endpoint"`
+	ConsumerGroup      string            `yaml:"consumerGroup" env:"consumer_group"`
+	Topics             TopicConfig       `yaml:"topics"`
+	Offsets            OffsetConfig      `yaml:"offsets"`
+	BatchSize          int               `yaml:"batchSize" env:"batch_size"`
+	BatchTimeout       time.Duration     `yaml:"batchTimeout" env:"batch_timeout"`
+	SubmitWorkers      int               `yaml:"submitWorkers" env:"submit_workers"`
+	SubmitQueueSize    int               `yaml:"submitQueueSize" env:"submit_queue_size"`
+	Timeouts           Timeouts          `yaml:"timeouts"`
+	ShutdownTimeout    time.Duration     `yaml:"shutdownTimeout" env:"shutdown_timeout"`
+	Lifecycle          LifecycleConfig   `yaml:"lifecycle"`
+	Refunds            RefundConfig      `yaml:"refunds"`
+	Metrics            MetricsConfig     `yaml:"metrics"`
+	Health             HealthConfig      `yaml:"health"`
+	Log                LogConfig         `yaml:"log"`
+	UserConf           *UserConfig       `yaml:"-"`
+}
+
+// TopicConfig holds the Kafka topics the clients consume from.
+type TopicConfig struct {
+	SLA        string `yaml:"sla" env:"topic_sla"`
+	Violations string `yaml:"violations" env:"topic_violations"`
+	VRU        string `yaml:"vru" env:"topic_vru"`
+	Parts      string `yaml:"parts" env:"topic_parts"`
+	// Approvals carries the approval requests of the per-SLA chaincodes
+	// between the organisations.
+	Approvals string `yaml:"approvals" env:"topic_approvals"`
+}
+
+// OffsetConfig sets where a client starts consuming. Reset applies to the
+// partitions without a committed offset. StartFrom, if set, moves every
+// partition to the first message at or after that time when the client starts.
+type OffsetConfig struct {
+	Reset     string `yaml:"reset" env:"auto_offset_reset"`
+	StartFrom string `yaml:"startFrom" env:"start_from"`
+}
+
+// GatewayEndpoint is a peer that can serve as the gateway of a client. Its
+// certificate is verified against HostOverride, if it is set. In the environment
+// and as a string in the file it is written as endpoint or endpoint=hostOverride.
+type GatewayEndpoint struct {
+	Endpoint     string `yaml:"endpoint"`
+	HostOverride string `yaml:"hostOverride"`
+}
+
+func (g *GatewayEndpoint) UnmarshalText(text []byte) error {
+	endpoint, override, _ := strings.Cut(strings.TrimSpace(string(text)), "=")
+	if endpoint == "" {
+		return fmt.Errorf("invalid gateway %q", text)
+	}
+	g.Endpoint = endpoint
+	g.HostOverride = override
+	return nil
+}
+
+// ClientTLS is the certificate and key a client presents to the gateways
+// that require mutual TLS. Both are read again on every handshake, so they can
+// be renewed without restarting the client.
+type ClientTLS struct {
+	CertPath string `yaml:"certPath" env:"client_tls_cert_path"`
+	KeyPath  string `yaml:"keyPath" env:"client_tls_key_path"`
+}
+
+// LifecycleConfig locates the admin identity, the peers and the orderer that
+// deploy chaincode. Only the SLA 2.0 client deploys chaincode.
+type LifecycleConfig struct {
+	// MSPPath is the MSP folder of an admin of the organisation, with the
+	// certificate in signcerts and the private key in keystore.
+	MSPPath string `yaml:"mspPath" env:"lifecycle_msp_path"`
+	// Peers are the peers of the organisation. They default to its peer1 and peer2.
+	Peers         []GatewayEndpoint `yaml:"peers" env:"lifecycle_peers"`
+	Orderer       string            `yaml:"orderer" env:"lifecycle_orderer"`
+	OrdererCAPath string            `yaml:"ordererCaPath" env:"lifecycle_orderer_ca_path"`
+	// Endorsers are a peer of each other organisation that approves the
+	// chaincodes, which endorse their commits.
+	Endorsers []OrgPeer `yaml:"endorsers" env:"lifecycle_endorsers"`
+	// Image is the image of the chaincode servers, and Version the version of
+	// the chaincode it holds. Changing them and running the client with
+	// -upgrade upgrades the chaincodes already deployed.
+	Image   string `yaml:"image" env:"lifecycle_image"`
+	Version string `yaml:"version" env:"lifecycle_version"`
+	// Timeout bounds the deployment of a chaincode.
+	Timeout time.Duration `yaml:"timeout" env:"lifecycle_timeout"`
+	// Parties maps the providers and clients of the SLAs to their
+	// organisations, which have to approve the chaincode of the SLA.
+	Parties []PartyOrg `yaml:"parties" env:"lifecycle_parties"`
+	// Approvers are the organisations that approve the chaincode of every SLA.
+	Approvers []string `yaml:"approvers" env:"lifecycle_approvers"`
+	// ApprovalTimeout bounds the wait for the approvals of the other organisations.
+	ApprovalTimeout time.Duration `yaml:"approvalTimeout" env:"lifecycle_approval_timeout"`
+	// Teardown is what happens to the chaincode servers of an SLA that ended:
+	// "delete" deletes them, "scale" stops them but keeps what is needed to
+	// start them again, such as their Services.
+	Teardown string `yaml:"teardown" env:"lifecycle_teardown"`
+	// RegistryListen is the address the registry of the chaincodes is served
+	// on, e.g. :8081. It is not served if it is empty.
+	RegistryListen string `yaml:"registryListen" env:"lifecycle_registry_listen"`
+	// Backend runs the chaincode servers: "kubernetes" next to the peers, or
+	// "local" as processes next to the client.
+	Backend    string            `yaml:"backend" env:"lifecycle_backend"`
+	Kubernetes KubernetesBackend `yaml:"kubernetes"`
+	Local      LocalBackend      `yaml:"local"`
+}
+
+// KubernetesBackend configures the chaincode servers run next to the peers.
+type KubernetesBackend struct {
+	// Kubeconfig is the kubeconfig file to connect with. The client connects
+	// from inside the cluster if it is empty.
+	Kubeconfig string `yaml:"kubeconfig" env:"lifecycle_kubeconfig"`
+	Namespace  string `yaml:"namespace" env:"lifecycle_namespace"`
+	// Labels are added to the Deployments, their pods and the Services.
+	Labels    []Label   `yaml:"labels" env:"lifecycle_labels"`
+	Resources Resources `yaml:"resources"`
+}
+
+// Resources are the compute resources of a chaincode server, as Kubernetes
+// quantities. Empty ones are not set.
+type Resources struct {
+	CPURequest    string `yaml:"cpuRequest" env:"lifecycle_cpu_request"`
+	MemoryRequest string `yaml:"memoryRequest" env:"lifecycle_memory_request"`
+	CPULimit      string `yaml:"cpuLimit" env:"lifecycle_cpu_limit"`
+	MemoryLimit   string `yaml:"memoryLimit" env:"lifecycle_memory_limit"`
+}
+
+// LocalBackend configures the chaincode servers run as processes next to the
+// client, each on its own port.
+type LocalBackend struct {
+	// Command is the chaincode server, e.g. a build of ccas_sla.
+	Command string `yaml:"command" env:"lifecycle_local_command"`
+	// Host is where the peers reach the chaincode servers.
+	Host      string `yaml:"host" env:"lifecycle_local_host"`
+	FirstPort int    `yaml:"firstPort" env:"lifecycle_local_first_port"`
+	LastPort  int    `yaml:"lastPort" env:"lifecycle_local_last_port"`
+}
+
+// Label is a Kubernetes label. In the environment and as a string in the file
+// it is written as key=value.
+type Label struct {
+	Key   string `yaml:"key"`
+	Value string `yaml:"value"`
+}
+
+func (l *Label) UnmarshalText(text []byte) error {
+	key, value, ok := strings.Cut(strings.TrimSpace(string(text)), "=")
+	if !ok || key == "" {
+		return fmt.Errorf("invalid label %q, expected key=value", text)
+	}
+	l.Key = key
+	l.Value = value
+	return nil
+}
+
+func (l LifecycleConfig) validate() []string {
+	var problems []string
+	if l.Teardown != "delete" && l.Teardown != "scale" {
+		problems = append(problems, fmt.Sprintf("lifecycle.teardown: invalid value %q, expected delete or scale", l.Teardown))
+	}
+	if l.RegistryListen != "" {
+		if _, _, err := net.SplitHostPort(l.RegistryListen); err != nil {
+			problems = append(problems, fmt.Sprintf("lifecycle.registryListen: %v", err))
+		}
+	}
+	for _, endorser := range l.Endorsers {
+		if endorser.MspID == "" || endorser.Endpoint == "" {
+			problems = append(problems, fmt.Sprintf("lifecycle.endorsers: %+v needs an mspId and an endpoint", endorser))
+		}
+	}
+	switch l.Backend {
+	case "kubernetes":
+	case "local":
+		if l.Local.Command == "" {
+			problems = append(problems, "lifecycle.local.command is required by the local backend")
+		}
+		if l.Local.FirstPort < 1 || l.Local.LastPort > 65535 || l.Local.FirstPort > l.Local.LastPort {
+			problems = append(problems, fmt.Sprintf("lifecycle.local: invalid ports %d-%d", l.Local.FirstPort, l.Local.LastPort))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("lifecycle.backend: invalid value %q, expected kubernetes or local", l.Backend))
+	}
+	return problems
+}
+
+// OrgPeer is a peer of another organisation. Its TLS certificate is verified
+// with the TLS CA of the client if TLSCAPath is empty. In the environment and
+// as a string in the file it is written as mspID=endpoint.
+type OrgPeer struct {
+	MspID        string `yaml:"mspId"`
+	Endpoint     string `yaml:"endpoint"`
+	HostOverride string `yaml:"hostOverride"`
+	TLSCAPath    string `yaml:"tlsCaPath"`
+}
+
+func (p *OrgPeer) UnmarshalText(text []byte) error {
+	mspID, endpoint, ok := strings.Cut(strings.TrimSpace(string(text)), "=")
+	if !ok || mspID == "" || endpoint == "" {
+		return fmt.Errorf("invalid peer %q, expected mspID=endpoint", text)
+	}
+	p.MspID = mspID
+	p.Endpoint = endpoint
+	return nil
+}
+
+// PartyOrg is the organisation of a provider or client of the SLAs, by ID. In
+// the environment and as a string in the file it is written as party=mspID.
+type PartyOrg struct {
+	Party string `yaml:"party"`
+	MspID string `yaml:"mspId"`
+}
+
+func (p *PartyOrg) UnmarshalText(text []byte) error {
+	party, mspID, ok := strings.Cut(strings.TrimSpace(string(text)), "=")
+	if !ok || party == "" || mspID == "" {
+		return fmt.Errorf("invalid party %q, expected party=mspID", text)
+	}
+	p.Party = party
+	p.MspID = mspID
+	return nil
+}
+
+// ApprovingOrgs returns the organisations, other than the SLA's own ones, that
+// approve the chaincode of an SLA between provider and client.
+func (l LifecycleConfig) ApprovingOrgs(provider, client string) []string {
+	orgs := append([]string{}, l.Approvers...)
+	for _, p := range l.Parties {
+		if p.Party == provider || p.Party == client {
+			orgs = append(orgs, p.MspID)
+		}
+	}
+	return orgs
+}
+
+// Keepalive holds the keepalive settings of the gateway connections. Peers
+// close connections that ping more often than their keepalive.minInterval,
+// which is 60 seconds by default.
+type Keepalive struct {
+	Time    time.Duration `yaml:"time" env:"keepalive_time"`
+	Timeout time.Duration `yaml:"timeout" env:"keepalive_timeout"`
+}
+
+// Timeouts holds the default timeouts of the gRPC calls to the gateway.
+type Timeouts struct {
+	Evaluate     time.Duration `yaml:"evaluate" env:"evaluate_timeout"`
+	Endorse      time.Duration `yaml:"endorse" env:"endorse_timeout"`
+	Submit       time.Duration `yaml:"submit" env:"submit_timeout"`
+	CommitStatus time.Duration `yaml:"commitStatus" env:"commit_status_timeout"`
 }
 
 type userCredentials struct {
@@ -33,18 +295,380 @@ type UserConfig struct {
 	Version     int             `json:"version"`
 }
 
+// ConfigError lists every problem found while loading a configuration.
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid configuration: %s", strings.Join(e.Problems, "; "))
+}
+
 // ParseArgs parses the command line arguments and
 // returns the config file on success, or exits on error
 func ParseArgs() []*string {
 	var configFile = flag.String("f", "", "Path to Kafka configuration file")
 	var environment = flag.String("e", "prod", "Environment the client is running in. Can be prod or dev")
+	var clientConfigFile = flag.String("c", "", "Path to the YAML or JSON client configuration file")
 	flag.Parse()
 	if *configFile == "" {
 		flag.Usage()
 		os.Exit(2) // the same exit code flag.Parse uses
 	}
 
-	return []*string{configFile, environment}
+	return []*string{configFile, environment, clientConfigFile}
+}
+
+// LoadConfig builds the configuration of a client. The defaults are overridden
+// by the file at path, if one is given, and then by the environment. Relative
+// JSON files are placed in the data folder, the wallet of the organisation is
+// loaded, and every missing or invalid field is reported in a single ConfigError.
+func LoadConfig(path string, defaults Config) (*Config, error) {
+	conf := defaults
+	conf.setDefaults()
+
+	if path != "" {
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file: %w", err)
+		}
+		// YAML is a superset of JSON, so both formats are decoded the same way.
+		err = yaml.Unmarshal(b, &conf)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse config file %s: %w", path, err)
+		}
+	}
+
+	var problems []string
+	problems = append(problems, applyEnv(reflect.ValueOf(&conf).Elem())...)
+
+	if conf.WalletPath == "" && conf.OrgNr > 0 {
+		conf.WalletPath = fmt.Sprintf("/fabric/application/wallet/appuser_org%d.id", conf.OrgNr)
+	}
+	for i, file := range conf.JSONFiles {
+		if !filepath.IsAbs(file) {
+			conf.JSONFiles[i] = filepath.Join(conf.DataFolder, file)
+		}
+	}
+
+	if len(conf.Lifecycle.Peers) == 0 && conf.OrgNr > 0 {
+		for peer := 1; peer <= 2; peer++ {
+			endpoint := fmt.Sprintf("org%d-peer%d:8051", conf.OrgNr, peer)
+			conf.Lifecycle.Peers = append(conf.Lifecycle.Peers, GatewayEndpoint{Endpoint: endpoint})
+		}
+	}
+
+	if len(conf.Gateways) == 0 && conf.PeerEndpoint != "" {
+		conf.Gateways = []GatewayEndpoint{{Endpoint: conf.PeerEndpoint, HostOverride: conf.GatewayPeer}}
+	}
+
+	problems = append(problems, conf.validate()...)
+
+	if conf.WalletPath != "" {
+		userConf, err := loadUserConfig(conf.WalletPath)
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		conf.UserConf = userConf
+		if userConf != nil && conf.Signer.Type == "wallet" && userConf.Credentials.PrivateKey == "" {
+			problems = append(problems, fmt.Sprintf("wallet %s has no private key, set signer.type", conf.WalletPath))
+		}
+	}
+
+	if len(problems) > 0 {
+		return nil, &ConfigError{Problems: problems}
+	}
+	return &conf, nil
+}
+
+// ConnectOptions returns the gateway options for the configured timeouts.
+func (t Timeouts) ConnectOptions() []client.ConnectOption {
+	return []client.ConnectOption{
+		client.WithEvaluateTimeout(t.Evaluate),
+		client.WithEndorseTimeout(t.Endorse),
+		client.WithSubmitTimeout(t.Submit),
+		client.WithCommitStatusTimeout(t.CommitStatus),
+	}
+}
+
+func (conf *Config) setDefaults() {
+	if conf.TlsCertPath == "" {
+		conf.TlsCertPath = "/fabric/tlscacerts/tlsca-signcert.pem"
+	}
+	if conf.Log.Format == "" {
+		conf.Log.Format = "json"
+	}
+	if conf.Log.Level == "" {
+		conf.Log.Level = "info"
+	}
+	if conf.Signer.Type == "" {
+		conf.Signer.Type = "wallet"
+	}
+	if conf.Topics.SLA == "" {
+		conf.Topics.SLA = "sla_contracts"
+	}
+	if conf.Topics.Violations == "" {
+		conf.Topics.Violations = "sla_violation"
+	}
+	if conf.Topics.VRU == "" {
+		conf.Topics.VRU = "vru_positions"
+	}
+	if conf.Topics.Parts == "" {
+		conf.Topics.Parts = "uc3-dlt"
+	}
+	if conf.Topics.Approvals == "" {
+		conf.Topics.Approvals = "chaincode_approvals"
+	}
+	if conf.Offsets.Reset == "" {
+		conf.Offsets.Reset = "beginning"
+	}
+	if conf.BatchSize == 0 {
+		conf.BatchSize = 50
+	}
+	if conf.BatchTimeout == 0 {
+		conf.BatchTimeout = 2 * time.Second
+	}
+	if conf.SubmitWorkers == 0 {
+		conf.SubmitWorkers = 4
+	}
+	if conf.SubmitQueueSize == 0 {
+		conf.SubmitQueueSize = 100
+	}
+	if conf.Lifecycle.MSPPath == "" {
+		conf.Lifecycle.MSPPath = "msp"
+	}
+	if conf.Lifecycle.Orderer == "" {
+		conf.Lifecycle.Orderer = "org0-orderer1:8050"
+	}
+	if conf.Lifecycle.OrdererCAPath == "" {
+		conf.Lifecycle.OrdererCAPath = "orderer-cert.pem"
+	}
+	if conf.Lifecycle.Image == "" {
+		conf.Lifecycle.Image = "147.102.19.6/pledger/slasc-bridge"
+	}
+	if conf.Lifecycle.Version == "" {
+		conf.Lifecycle.Version = "1"
+	}
+	if conf.Lifecycle.Timeout == 0 {
+		conf.Lifecycle.Timeout = 2 * time.Minute
+	}
+	if conf.Lifecycle.ApprovalTimeout == 0 {
+		conf.Lifecycle.ApprovalTimeout = 10 * time.Minute
+	}
+	if conf.Lifecycle.Teardown == "" {
+		conf.Lifecycle.Teardown = "delete"
+	}
+	if conf.Lifecycle.Backend == "" {
+		conf.Lifecycle.Backend = "kubernetes"
+	}
+	if conf.Lifecycle.Kubernetes.Namespace == "" {
+		conf.Lifecycle.Kubernetes.Namespace = "pledger-dlt"
+	}
+	if conf.Lifecycle.Local.Host == "" {
+		conf.Lifecycle.Local.Host = "localhost"
+	}
+	if conf.Lifecycle.Local.FirstPort == 0 && conf.Lifecycle.Local.LastPort == 0 {
+		conf.Lifecycle.Local.FirstPort, conf.Lifecycle.Local.LastPort = 9100, 9199
+	}
+	if conf.Refunds.Schedule == "" {
+		conf.Refunds.Schedule = "@midnight"
+	}
+	if conf.Refunds.Timezone == "" {
+		conf.Refunds.Timezone = "Local"
+	}
+	if conf.Refunds.PageSize == 0 {
+		conf.Refunds.PageSize = 100
+	}
+	if conf.Refunds.Lease.Namespace == "" {
+		conf.Refunds.Lease.Namespace = "pledger-dlt"
+	}
+	if conf.Refunds.Lease.Duration == 0 {
+		conf.Refunds.Lease.Duration = 15 * time.Second
+	}
+	if conf.ShutdownTimeout == 0 {
+		conf.ShutdownTimeout = 30 * time.Second
+	}
+	if conf.Health.MaxStall == 0 {
+		conf.Health.MaxStall = 1 * time.Minute
+	}
+	if conf.Keepalive.Time == 0 {
+		conf.Keepalive.Time = 1 * time.Minute
+	}
+	if conf.Keepalive.Timeout == 0 {
+		conf.Keepalive.Timeout = 20 * time.Second
+	}
+	if conf.Timeouts.Evaluate == 0 {
+		conf.Timeouts.Evaluate = 5 * time.Second
+	}
+	if conf.Timeouts.Endorse == 0 {
+		conf.Timeouts.Endorse = 15 * time.Second
+	}
+	if conf.Timeouts.Submit == 0 {
+		conf.Timeouts.Submit = 5 * time.Second
+	}
+	if conf.Timeouts.CommitStatus == 0 {
+		conf.Timeouts.CommitStatus = 1 * time.Minute
+	}
+}
+
+func (conf *Config) validate() []string {
+	var problems []string
+	required := []struct{ name, value string }{
+		{"dataFolder", conf.DataFolder},
+		{"tlsCertPath", conf.TlsCertPath},
+		{"walletPath", conf.WalletPath},
+		{"channelName", conf.ChannelName},
+		{"consumerGroup", conf.ConsumerGroup},
+	}
+	for _, field := range required {
+		if field.value == "" {
+			problems = append(problems, fmt.Sprintf("%s is missing", field.name))
+		}
+	}
+	if len(conf.Gateways) == 0 {
+		problems = append(problems, "one of gateways or peerEndpoint is required")
+	}
+	if (conf.ClientTLS.CertPath == "") != (conf.ClientTLS.KeyPath == "") {
+		problems = append(problems, "clientTls needs both certPath and keyPath")
+	}
+	problems = append(problems, conf.Signer.validate()...)
+	problems = append(problems, conf.Metrics.validate()...)
+	problems = append(problems, conf.Health.validate()...)
+	problems = append(problems, conf.Log.validate()...)
+	problems = append(problems, conf.Lifecycle.validate()...)
+	problems = append(problems, conf.Refunds.validate()...)
+	if conf.OrgNr < 1 {
+		problems = append(problems, "orgNr must be a positive number")
+	}
+	if conf.ChaincodeName == "" && conf.ContractNamePrefix == "" {
+		problems = append(problems, "one of chaincodeName or contractNamePrefix is required")
+	}
+	if !offsetResets[conf.Offsets.Reset] {
+		problems = append(problems, fmt.Sprintf("offsets.reset: invalid value %q", conf.Offsets.Reset))
+	}
+	if conf.Offsets.StartFrom != "" {
+		if _, err := parseStartTime(conf.Offsets.StartFrom); err != nil {
+			problems = append(problems, fmt.Sprintf("offsets.startFrom: %v", err))
+		}
+	}
+	if conf.BatchSize < 1 {
+		problems = append(problems, "batchSize must be positive")
+	}
+	if conf.SubmitWorkers < 1 {
+		problems = append(problems, "submitWorkers must be positive")
+	}
+	if conf.SubmitQueueSize < 0 {
+		problems = append(problems, "submitQueueSize must not be negative")
+	}
+	return problems
+}
+
+var offsetResets = toSet("smallest", "earliest", "beginning", "largest", "latest", "end", "error")
+
+// StartTime returns the time set by StartFrom, or the zero time if it is not set.
+func (o OffsetConfig) StartTime() time.Time {
+	t, _ := parseStartTime(o.StartFrom)
+	return t
+}
+
+// parseStartTime accepts an RFC 3339 timestamp or a date, which stands for its midnight in UTC.
+func parseStartTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither an RFC 3339 timestamp nor a date", s)
+	}
+	return t, nil
+}
+
+func loadUserConfig(path string) (*UserConfig, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read wallet: %v", err)
+	}
+	var userConf UserConfig
+	err = json.Unmarshal(b, &userConf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal wallet %s: %v", path, err)
+	}
+	return &userConf, nil
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// applyEnv overrides the fields of v that have an env tag with the value of
+// the environmental variable, if it is set, and returns the values that could not be parsed.
+func applyEnv(v reflect.Value) []string {
+	var problems []string
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		structField := v.Type().Field(i)
+
+		if field.Kind() == reflect.Struct {
+			problems = append(problems, applyEnv(field)...)
+			continue
+		}
+
+		env := structField.Tag.Get("env")
+		if env == "" {
+			continue
+		}
+		value, ok := os.LookupEnv(env)
+		if !ok || value == "" {
+			continue
+		}
+
+		switch {
+		case field.Type() == durationType:
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s is not a valid duration: %v", env, err))
+				continue
+			}
+			field.SetInt(int64(d))
+		case field.Kind() == reflect.Int:
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s is not a valid integer: %v", env, err))
+				continue
+			}
+			field.SetInt(int64(n))
+		case field.Kind() == reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s is not a valid boolean: %v", env, err))
+				continue
+			}
+			field.SetBool(b)
+		case field.Kind() == reflect.String:
+			field.SetString(value)
+		case field.Kind() == reflect.Slice && field.Type().Elem().Kind() == reflect.String:
+			var values []string
+			for _, s := range strings.Split(value, ",") {
+				values = append(values, strings.TrimSpace(s))
+			}
+			field.Set(reflect.ValueOf(values))
+		case field.Kind() == reflect.Slice && reflect.PtrTo(field.Type().Elem()).Implements(textUnmarshalerType):
+			values := reflect.MakeSlice(field.Type(), 0, 0)
+			for _, s := range strings.Split(value, ",") {
+				elem := reflect.New(field.Type().Elem())
+				err := elem.Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+				if err != nil {
+					problems = append(problems, fmt.Sprintf("%s: %v", env, err))
+					continue
+				}
+				values = reflect.Append(values, elem.Elem())
+			}
+			field.Set(values)
+		}
+	}
+	return problems
 }
 
 // setDiscoveryAsLocalhost sets the environmental variable DISCOVERY_AS_LOCALHOST
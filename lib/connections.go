@@ -1,17 +1,29 @@
 package lib
 
 import (
+	"context"
+	"crypto/tls"
 	"crypto/x509"
 	"fmt"
-	"log"
+	"net"
 	"os"
+	"sync"
+	"time"
 
+	"github.com/hyperledger/fabric-gateway/pkg/client"
 	"github.com/hyperledger/fabric-gateway/pkg/identity"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/resolver"
+	"google.golang.org/grpc/resolver/manual"
 )
 
-// NewGrpcConnection creates a gRPC connection to the Gateway server.
+// NewGrpcConnection creates a gRPC connection to the Gateway servers. The
+// gateways are tried in order, and the connection fails over to the next one
+// when the current one becomes unreachable. Calls wait for a gateway to be
+// available for as long as their timeouts allow.
 func NewGrpcConnection(conf Config) (*grpc.ClientConn, error) {
 	certificate, err := loadCertificate(conf.TlsCertPath)
 	if err != nil {
@@ -20,9 +32,47 @@ func NewGrpcConnection(conf Config) (*grpc.ClientConn, error) {
 
 	certPool := x509.NewCertPool()
 	certPool.AddCert(certificate)
-	transportCredentials := credentials.NewClientTLSFromCert(certPool, "")
+	tlsConfig := &tls.Config{RootCAs: certPool}
+	if conf.ClientTLS.CertPath != "" {
+		// Fail early on a bad pair, rather than on every handshake.
+		if _, err = tls.LoadX509KeyPair(conf.ClientTLS.CertPath, conf.ClientTLS.KeyPath); err != nil {
+			return nil, fmt.Errorf("failed to load client TLS certificate: %w", err)
+		}
+		tlsConfig.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			pair, err := tls.LoadX509KeyPair(conf.ClientTLS.CertPath, conf.ClientTLS.KeyPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load client TLS certificate: %w", err)
+			}
+			return &pair, nil
+		}
+	}
+	transportCredentials := credentials.NewTLS(tlsConfig)
+
+	// Each address carries the name its certificate is verified against.
+	addresses := make([]resolver.Address, len(conf.Gateways))
+	for i, gateway := range conf.Gateways {
+		serverName := gateway.HostOverride
+		if serverName == "" {
+			serverName, _, err = net.SplitHostPort(gateway.Endpoint)
+			if err != nil {
+				return nil, fmt.Errorf("invalid gateway endpoint %s: %w", gateway.Endpoint, err)
+			}
+		}
+		addresses[i] = resolver.Address{Addr: gateway.Endpoint, ServerName: serverName}
+	}
+	gateways := manual.NewBuilderWithScheme("fabric-gateways")
+	gateways.InitialState(resolver.State{Addresses: addresses})
 
-	connection, err := grpc.Dial(conf.PeerEndpoint, grpc.WithTransportCredentials(transportCredentials))
+	connection, err := grpc.Dial(gateways.Scheme()+":///gateways",
+		grpc.WithResolvers(gateways),
+		grpc.WithTransportCredentials(transportCredentials),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                conf.Keepalive.Time,
+			Timeout:             conf.Keepalive.Timeout,
+			PermitWithoutStream: true,
+		}),
+		grpc.WithDefaultCallOptions(grpc.WaitForReady(true)),
+	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create gRPC connection: %w", err)
 	}
@@ -32,7 +82,6 @@ func NewGrpcConnection(conf Config) (*grpc.ClientConn, error) {
 
 // NewIdentity creates a client identity for this Gateway connection using an X.509 certificate.
 func NewIdentity(conf Config) (*identity.X509Identity, error) {
-	log.Print(conf.UserConf.Credentials.Certificate)
 	certificate, err := identity.CertificateFromPEM([]byte(conf.UserConf.Credentials.Certificate))
 	if err != nil {
 		return nil, err
@@ -54,19 +103,126 @@ func loadCertificate(filename string) (*x509.Certificate, error) {
 	return identity.CertificateFromPEM(certificatePEM)
 }
 
-// NewSign creates a function that generates a digital signature from a message digest using a private key.
-func NewSign(conf Config) (identity.Sign, error) {
-	privateKeyPEM := conf.UserConf.Credentials.PrivateKey
+// ConnectionHealth describes the state of the connection to the gateways.
+type ConnectionHealth struct {
+	State   string    `json:"state"`
+	Healthy bool      `json:"healthy"`
+	Since   time.Time `json:"since"`
+}
+
+// ConnectionManager owns the gateway connection of a client. The gRPC
+// connection reconnects and fails over between the configured gateways on its
+// own, so the Gateway, networks and contracts it returns stay valid throughout.
+type ConnectionManager struct {
+	conf       Config
+	connection *grpc.ClientConn
+	gateway    *client.Gateway
+	signer     Signer
+	cancel     context.CancelFunc
+
+	mu     sync.RWMutex
+	health ConnectionHealth
+}
 
-	privateKey, err := identity.PrivateKeyFromPEM([]byte(privateKeyPEM))
+// NewConnectionManager connects to the gateways in conf with the identity of the
+// wallet, the configured signer and timeouts, and starts watching the connection.
+func NewConnectionManager(conf Config) (*ConnectionManager, error) {
+	connection, err := NewGrpcConnection(conf)
 	if err != nil {
 		return nil, err
 	}
 
-	sign, err := identity.NewPrivateKeySign(privateKey)
+	id, err := NewIdentity(conf)
 	if err != nil {
-		return nil, err
+		connection.Close()
+		return nil, fmt.Errorf("failed to create identity: %w", err)
+	}
+
+	signer, err := NewSigner(conf)
+	if err != nil {
+		connection.Close()
+		return nil, fmt.Errorf("failed to create signer: %w", err)
+	}
+
+	options := []client.ConnectOption{
+		client.WithSign(signer.Sign),
+		client.WithClientConnection(connection),
+	}
+	// Default timeouts for different gRPC calls
+	options = append(options, conf.Timeouts.ConnectOptions()...)
+	gateway, err := client.Connect(id, options...)
+	if err != nil {
+		signer.Close()
+		connection.Close()
+		return nil, fmt.Errorf("failed to connect to gateway: %w", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &ConnectionManager{
+		conf:       conf,
+		connection: connection,
+		gateway:    gateway,
+		signer:     signer,
+		cancel:     cancel,
+	}
+	connection.Connect()
+	go m.watch(ctx)
+	return m, nil
+}
+
+func (m *ConnectionManager) Gateway() *client.Gateway {
+	return m.gateway
+}
+
+// Network returns the configured channel.
+func (m *ConnectionManager) Network() *client.Network {
+	return m.gateway.GetNetwork(m.conf.ChannelName)
+}
+
+// Contract returns the configured chaincode on the configured channel.
+func (m *ConnectionManager) Contract() *client.Contract {
+	return m.Network().GetContract(m.conf.ChaincodeName)
+}
+
+func (m *ConnectionManager) Health() ConnectionHealth {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.health
+}
+
+// Close closes the gateway, its connection and the signer.
+func (m *ConnectionManager) Close() {
+	m.cancel()
+	m.gateway.Close()
+	m.connection.Close()
+	if err := m.signer.Close(); err != nil {
+		Error("failed to close the signer", "error", err)
 	}
+}
+
+// watch records the state changes of the connection. An idle connection is
+// reconnected, so that a gateway failure is noticed before the next call.
+func (m *ConnectionManager) watch(ctx context.Context) {
+	for {
+		state := m.connection.GetState()
 
-	return sign, nil
+		m.mu.Lock()
+		healthy := state == connectivity.Ready
+		if healthy != m.health.Healthy || m.health.Since.IsZero() {
+			if healthy {
+				Info("connected to the gateway")
+			} else if !m.health.Since.IsZero() {
+				Warn("lost the connection to the gateway, reconnecting")
+			}
+		}
+		m.health = ConnectionHealth{State: state.String(), Healthy: healthy, Since: time.Now()}
+		m.mu.Unlock()
+
+		if state == connectivity.Idle {
+			m.connection.Connect()
+		}
+		if !m.connection.WaitForStateChange(ctx, state) {
+			return
+		}
+	}
 }
@@ -3,40 +3,213 @@ package lib
 import (
 	"context"
 	"errors"
-	"log"
+	"regexp"
 
 	"github.com/hyperledger/fabric-gateway/pkg/client"
 	"github.com/hyperledger/fabric-protos-go-apiv2/gateway"
+	"github.com/hyperledger/fabric-protos-go-apiv2/peer"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
 
-func HandleError(err error) {
-	if err != nil {
-		switch err := err.(type) {
-		case *client.EndorseError:
-			log.Println(Red("Endorse error with gRPC status %v: %s\n", status.Code(err), err))
-		case *client.SubmitError:
-			log.Println(Red("Submit error with gRPC status %v: %s\n", status.Code(err), err))
-		case *client.CommitStatusError:
-			if errors.Is(err, context.DeadlineExceeded) {
-				log.Println(Red("Timeout waiting for transaction %s commit status: %s", err.TransactionID, err))
-			} else {
-				log.Println(Red("Error obtaining commit status with gRPC status %v: %s\n", status.Code(err), err))
-			}
-		case *client.CommitError:
-			log.Println(Red("Transaction %s failed to commit with status %d: %s\n", err.TransactionID, int32(err.Code), err))
-		default:
-			log.Println(Red("%v", err))
+// Errors returned by the chaincodes for requests that can never succeed.
+// Classified errors match them with errors.Is.
+var (
+	ErrUserExists         = errors.New("user already exists")
+	ErrPublicKeyExists    = errors.New("public key already exists")
+	ErrUserNotFound       = errors.New("user does not exist")
+	ErrContractExists     = errors.New("contract already exists")
+	ErrContractNotFound   = errors.New("contract does not exist")
+	ErrContractCompleted  = errors.New("contract is completed")
+	ErrInsufficientTokens = errors.New("not enough tokens")
+)
+
+// chaincodeErrors maps the messages of the chaincodes to their sentinel errors.
+var chaincodeErrors = []struct {
+	pattern *regexp.Regexp
+	err     error
+}{
+	{regexp.MustCompile(`(?i)user already exists`), ErrUserExists},
+	{regexp.MustCompile(`(?i)public key already exists`), ErrPublicKeyExists},
+	{regexp.MustCompile(`(?i)(provider|client) does not exist`), ErrUserNotFound},
+	{regexp.MustCompile(`(?i)the contract \S+ already exists`), ErrContractExists},
+	{regexp.MustCompile(`(?i)the contract \S+ does not exist`), ErrContractNotFound},
+	{regexp.MustCompile(`(?i)the contract \S+ is completed`), ErrContractCompleted},
+	{regexp.MustCompile(`(?i)does not have enough tokens`), ErrInsufficientTokens},
+}
+
+// chaincodeResponse matches the endorsement errors of the peers that carry the error of a chaincode.
+var chaincodeResponse = regexp.MustCompile(`chaincode response \d+`)
+
+// ErrorCategory tells where a transaction failed.
+type ErrorCategory string
+
+const (
+	// CategoryEndorsement is a proposal the peers would not endorse, or a
+	// transaction that failed the endorsement policy.
+	CategoryEndorsement ErrorCategory = "endorsement"
+	// CategoryMVCCConflict is a transaction that read keys another one changed before it committed.
+	CategoryMVCCConflict ErrorCategory = "mvcc_conflict"
+	// CategoryTimeout is a call that ran out of time. The transaction may still commit.
+	CategoryTimeout ErrorCategory = "timeout"
+	// CategoryChaincode is an error returned by the chaincode itself.
+	CategoryChaincode ErrorCategory = "chaincode"
+	// CategoryConnectivity is a gateway, peer or orderer that could not be reached.
+	CategoryConnectivity ErrorCategory = "connectivity"
+	CategoryUnknown      ErrorCategory = "unknown"
+)
+
+// ErrorDetail is the error of a peer or orderer behind the gateway.
+type ErrorDetail struct {
+	Endpoint string
+	MspID    string
+	Message  string
+}
+
+// ClassifiedError is a transaction error with what is known about its cause.
+type ClassifiedError struct {
+	Err      error
+	Category ErrorCategory
+	// Retryable reports whether submitting the transaction again may succeed.
+	Retryable     bool
+	TransactionID string
+	Details       []ErrorDetail
+	// sentinel is the chaincode error matched by the messages, if any.
+	sentinel error
+}
+
+func (e *ClassifiedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ClassifiedError) Unwrap() error {
+	return e.Err
+}
+
+func (e *ClassifiedError) Is(target error) bool {
+	return e.sentinel != nil && e.sentinel == target
+}
+
+// ClassifyError returns the classification of err, or nil if err is nil.
+func ClassifyError(err error) *ClassifiedError {
+	if err == nil {
+		return nil
+	}
+	var classified *ClassifiedError
+	if errors.As(err, &classified) {
+		return classified
+	}
+
+	classified = &ClassifiedError{Err: err, Category: CategoryUnknown}
+	grpcStatus := statusOf(err)
+	for _, detail := range grpcStatus.Details() {
+		if detail, ok := detail.(*gateway.ErrorDetail); ok {
+			classified.Details = append(classified.Details, ErrorDetail{
+				Endpoint: detail.Address,
+				MspID:    detail.MspId,
+				Message:  detail.Message,
+			})
 		}
+	}
+
+	var endorseErr *client.EndorseError
+	var submitErr *client.SubmitError
+	var commitStatusErr *client.CommitStatusError
+	var commitErr *client.CommitError
+	var commitFailedErr *CommitFailedError
+	switch {
+	case errors.As(err, &commitErr):
+		classified.TransactionID = commitErr.TransactionID
+		classified.classifyCommit(commitErr.Code)
+		return classified
+	case errors.As(err, &commitFailedErr):
+		classified.TransactionID = commitFailedErr.TransactionID
+		classified.classifyCommit(commitFailedErr.Code)
+		return classified
+	case errors.As(err, &endorseErr):
+		classified.TransactionID = endorseErr.TransactionID
+		classified.Category = CategoryEndorsement
+	case errors.As(err, &submitErr):
+		classified.TransactionID = submitErr.TransactionID
+	case errors.As(err, &commitStatusErr):
+		classified.TransactionID = commitStatusErr.TransactionID
+	}
+
+	switch grpcStatus.Code() {
+	case codes.Unavailable:
+		classified.Category = CategoryConnectivity
+		classified.Retryable = true
+		return classified
+	case codes.DeadlineExceeded:
+		classified.Category = CategoryTimeout
+		classified.Retryable = true
+		return classified
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		classified.Category = CategoryTimeout
+		classified.Retryable = true
+		return classified
+	}
 
-		// Any error that originates from a peer or orderer node external to the gateway will have its details
-		// embedded within the gRPC status error. The following code shows how to extract that.
-		statusErr := status.Convert(err)
-		for _, detail := range statusErr.Details() {
-			switch detail := detail.(type) {
-			case *gateway.ErrorDetail:
-				log.Println(Red("Error from endpoint: %s, mspId: %s, message: %s\n", detail.Address, detail.MspId, detail.Message))
+	messages := []string{err.Error()}
+	for _, detail := range classified.Details {
+		messages = append(messages, detail.Message)
+	}
+	for _, message := range messages {
+		for _, chaincodeErr := range chaincodeErrors {
+			if chaincodeErr.pattern.MatchString(message) {
+				classified.Category = CategoryChaincode
+				classified.sentinel = chaincodeErr.err
+				return classified
 			}
 		}
 	}
+	// Chaincode errors reach the gateway as failed endorsements.
+	for _, detail := range classified.Details {
+		if chaincodeResponse.MatchString(detail.Message) {
+			classified.Category = CategoryChaincode
+			break
+		}
+	}
+	return classified
+}
+
+// statusOf returns the gRPC status of err, which may be wrapped.
+func statusOf(err error) *status.Status {
+	var withStatus interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &withStatus) {
+		return withStatus.GRPCStatus()
+	}
+	return status.Convert(err)
+}
+
+func (e *ClassifiedError) classifyCommit(code peer.TxValidationCode) {
+	switch code {
+	case peer.TxValidationCode_MVCC_READ_CONFLICT, peer.TxValidationCode_PHANTOM_READ_CONFLICT:
+		e.Category = CategoryMVCCConflict
+		e.Retryable = true
+	case peer.TxValidationCode_ENDORSEMENT_POLICY_FAILURE:
+		e.Category = CategoryEndorsement
+	}
+}
+
+// HandleError logs and counts err and returns its classification, so that the
+// caller can decide whether to retry, skip or stop. It returns nil if err is nil.
+func HandleError(err error) *ClassifiedError {
+	classified := ClassifyError(err)
+	if classified == nil {
+		return nil
+	}
+
+	observeError(classified.Category)
+
+	args := []any{"category", classified.Category, "retryable", classified.Retryable, "error", classified.Err}
+	if classified.TransactionID != "" {
+		args = append(args, "tx_id", classified.TransactionID)
+	}
+	Error("transaction failed", args...)
+	for _, detail := range classified.Details {
+		Error("error from endpoint", "endpoint", detail.Endpoint, "msp_id", detail.MspID, "message", detail.Message)
+	}
+	return classified
 }
@@ -0,0 +1,194 @@
+package lib
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+// HealthConfig enables the health endpoints of a client.
+type HealthConfig struct {
+	// Listen is the address the endpoints listen on, e.g. :8080. They are
+	// disabled if it is empty.
+	Listen string `yaml:"listen" env:"health_listen"`
+	// MaxStall is how long the main loop may go without a beat before the
+	// client is reported as not alive.
+	MaxStall time.Duration `yaml:"maxStall" env:"health_max_stall"`
+}
+
+func (h HealthConfig) validate() []string {
+	if h.Listen == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(h.Listen); err != nil {
+		return []string{fmt.Sprintf("health.listen: %v", err)}
+	}
+	return nil
+}
+
+// HealthCheck returns an error if a dependency is not ready.
+type HealthCheck func() error
+
+// Health answers the liveness and readiness probes of a process. It is alive
+// while its main loop beats, and ready while all its checks pass.
+type Health struct {
+	maxStall time.Duration
+
+	mu     sync.Mutex
+	beat   time.Time
+	names  []string
+	checks map[string]HealthCheck
+}
+
+// NewHealth creates a Health whose main loop may stall for up to maxStall.
+// With a zero maxStall the process is alive for as long as it serves the probes.
+func NewHealth(maxStall time.Duration) *Health {
+	return &Health{
+		maxStall: maxStall,
+		beat:     time.Now(),
+		checks:   make(map[string]HealthCheck),
+	}
+}
+
+// AddCheck adds a readiness check.
+func (h *Health) AddCheck(name string, check HealthCheck) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, ok := h.checks[name]; !ok {
+		h.names = append(h.names, name)
+	}
+	h.checks[name] = check
+}
+
+// Beat records that the main loop is running.
+func (h *Health) Beat() {
+	h.mu.Lock()
+	h.beat = time.Now()
+	h.mu.Unlock()
+}
+
+// Alive returns an error if the main loop has stalled.
+func (h *Health) Alive() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.maxStall > 0 && time.Since(h.beat) > h.maxStall {
+		return fmt.Errorf("main loop stalled since %s", h.beat.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Ready runs the checks and returns their errors by name.
+func (h *Health) Ready() map[string]error {
+	h.mu.Lock()
+	names := append([]string(nil), h.names...)
+	checks := make([]HealthCheck, len(names))
+	for i, name := range names {
+		checks[i] = h.checks[name]
+	}
+	h.mu.Unlock()
+
+	results := make(map[string]error, len(names))
+	for i, name := range names {
+		results[name] = checks[i]()
+	}
+	return results
+}
+
+// Handler serves the liveness probe on /livez and the readiness probe on /readyz.
+func (h *Health) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/livez", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, map[string]error{"loop": h.Alive()})
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, h.Ready())
+	})
+	return mux
+}
+
+func writeHealth(w http.ResponseWriter, results map[string]error) {
+	response := struct {
+		Status string            `json:"status"`
+		Checks map[string]string `json:"checks"`
+	}{Status: "ok", Checks: make(map[string]string, len(results))}
+
+	status := http.StatusOK
+	for name, err := range results {
+		if err != nil {
+			response.Status = "failing"
+			response.Checks[name] = err.Error()
+			status = http.StatusServiceUnavailable
+		} else {
+			response.Checks[name] = "ok"
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+// ServeHealth serves the probes of h at addr in the background.
+func ServeHealth(addr string, h *Health) *http.Server {
+	server := &http.Server{Addr: addr, Handler: h.Handler(), ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		Info("serving health checks", "address", addr)
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			Error("health endpoint failed", "error", err)
+		}
+	}()
+	return server
+}
+
+// GatewayCheck is ready while the connection to the gateways is up and, if
+// contract is set, its chaincode answers a Ping.
+func GatewayCheck(connection *ConnectionManager, contract *client.Contract) HealthCheck {
+	return func() error {
+		if health := connection.Health(); !health.Healthy {
+			return fmt.Errorf("gateway connection is %s", health.State)
+		}
+		if contract == nil {
+			return nil
+		}
+		_, err := contract.EvaluateTransaction("Ping")
+		if err != nil {
+			return fmt.Errorf("chaincode %s did not answer: %w", contract.ChaincodeName(), err)
+		}
+		return nil
+	}
+}
+
+// ConsumerCheck is ready once the consumer group has assigned partitions to the consumer.
+func ConsumerCheck(consumer *kafka.Consumer) HealthCheck {
+	return func() error {
+		partitions, err := consumer.Assignment()
+		if err != nil {
+			return err
+		}
+		if len(partitions) == 0 {
+			return errors.New("no partitions assigned")
+		}
+		return nil
+	}
+}
+
+// ListenerCheck is ready once a server accepts connections at address.
+func ListenerCheck(address string) HealthCheck {
+	return func() error {
+		conn, err := net.DialTimeout("tcp", address, time.Second)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
@@ -1,66 +1,245 @@
 package lib
 
 import (
-	"bufio"
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/confluentinc/confluent-kafka-go/kafka"
 )
 
-// ReadConfig reads the file specified by configFile and
-// creates a map of key-value pairs that correspond to each
-// line of the file. ReadConfig returns the map on success,
-// or nil and an error
-func ReadConfig(configFile string) (map[string]string, error) {
-	m := make(map[string]string)
+// librdkafkaProperties are the configuration properties accepted by librdkafka
+// and the Go client. Any other key in a properties file is reported as unknown.
+var librdkafkaProperties = toSet(
+	// Global properties
+	"builtin.features", "client.id", "metadata.broker.list", "bootstrap.servers",
+	"message.max.bytes", "message.copy.max.bytes", "receive.message.max.bytes",
+	"max.in.flight.requests.per.connection", "max.in.flight",
+	"topic.metadata.refresh.interval.ms", "metadata.max.age.ms",
+	"topic.metadata.refresh.fast.interval.ms", "topic.metadata.refresh.fast.cnt",
+	"topic.metadata.refresh.sparse", "topic.metadata.propagation.max.ms",
+	"topic.blacklist", "debug", "socket.timeout.ms", "socket.blocking.max.ms",
+	"socket.send.buffer.bytes", "socket.receive.buffer.bytes", "socket.keepalive.enable",
+	"socket.nagle.disable", "socket.max.fails", "broker.address.ttl", "broker.address.family",
+	"socket.connection.setup.timeout.ms", "connections.max.idle.ms",
+	"reconnect.backoff.jitter.ms", "reconnect.backoff.ms", "reconnect.backoff.max.ms",
+	"statistics.interval.ms", "enabled_events", "log_level", "log.queue", "log.thread.name",
+	"enable.random.seed", "log.connection.close", "api.version.request",
+	"api.version.request.timeout.ms", "api.version.fallback.ms", "broker.version.fallback",
+	"allow.auto.create.topics", "security.protocol", "ssl.cipher.suites", "ssl.curves.list",
+	"ssl.sigalgs.list", "ssl.key.location", "ssl.key.password", "ssl.key.pem",
+	"ssl.certificate.location", "ssl.certificate.pem", "ssl.ca.location", "ssl.ca.pem",
+	"ssl.ca.certificate.stores", "ssl.crl.location", "ssl.keystore.location",
+	"ssl.keystore.password", "ssl.providers", "ssl.engine.location", "ssl.engine.id",
+	"enable.ssl.certificate.verification", "ssl.endpoint.identification.algorithm",
+	"sasl.mechanisms", "sasl.mechanism", "sasl.kerberos.service.name",
+	"sasl.kerberos.principal", "sasl.kerberos.kinit.cmd", "sasl.kerberos.keytab",
+	"sasl.kerberos.min.time.before.relogin", "sasl.username", "sasl.password",
+	"sasl.oauthbearer.config", "enable.sasl.oauthbearer.unsecure.jwt",
+	"sasl.oauthbearer.method", "sasl.oauthbearer.client.id", "sasl.oauthbearer.client.secret",
+	"sasl.oauthbearer.scope", "sasl.oauthbearer.extensions", "sasl.oauthbearer.token.endpoint.url",
+	"plugin.library.paths", "client.rack",
+	// Consumer properties
+	"group.id", "group.instance.id", "partition.assignment.strategy", "session.timeout.ms",
+	"heartbeat.interval.ms", "group.protocol.type", "coordinator.query.interval.ms",
+	"max.poll.interval.ms", "enable.auto.commit", "auto.commit.interval.ms",
+	"enable.auto.offset.store", "queued.min.messages", "queued.max.messages.kbytes",
+	"fetch.wait.max.ms", "fetch.message.max.bytes", "max.partition.fetch.bytes",
+	"fetch.max.bytes", "fetch.min.bytes", "fetch.error.backoff.ms", "offset.store.method",
+	"isolation.level", "enable.partition.eof", "check.crcs", "client.software.name",
+	"client.software.version",
+	// Producer properties
+	"transactional.id", "transaction.timeout.ms", "enable.idempotence",
+	"enable.gapless.guarantee", "queue.buffering.max.messages", "queue.buffering.max.kbytes",
+	"queue.buffering.max.ms", "linger.ms", "message.send.max.retries", "retries",
+	"retry.backoff.ms", "queue.buffering.backpressure.threshold", "compression.codec",
+	"compression.type", "batch.num.messages", "batch.size", "delivery.report.only.error",
+	"sticky.partitioning.linger.ms",
+	// Topic properties
+	"request.required.acks", "acks", "request.timeout.ms", "message.timeout.ms",
+	"delivery.timeout.ms", "partitioner", "compression.level", "auto.commit.enable",
+	"auto.offset.reset", "offset.store.path", "offset.store.sync.interval.ms",
+	"consume.callback.max.messages",
+	// Go client properties
+	"go.application.rebalance.enable", "go.events.channel.enable", "go.events.channel.size",
+	"go.delivery.reports", "go.delivery.report.fields", "go.logs.channel.enable",
+)
 
-	file, err := os.Open(configFile)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open file: %v", err)
-	}
-	defer file.Close()
-
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if !strings.HasPrefix(line, "#") && len(line) != 0 {
-			kv := strings.Split(line, "=")
-			parameter := strings.TrimSpace(kv[0])
-			value := strings.TrimSpace(kv[1])
-			m[parameter] = value
-		}
-	}
+// javaOnlyProperties are used by the Java clients, have no librdkafka equivalent
+// and are dropped, so that the same properties file can be shared with them.
+var javaOnlyProperties = toSet(
+	"key.serializer", "value.serializer", "key.deserializer", "value.deserializer",
+	"ssl.truststore.password", "ssl.truststore.type", "ssl.keystore.type",
+	"ssl.protocol", "ssl.enabled.protocols",
+)
 
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("failed to read file: %v", err)
-	}
+var securityProtocols = toSet("plaintext", "ssl", "sasl_plaintext", "sasl_ssl")
 
-	return m, nil
+var saslMechanisms = toSet("GSSAPI", "PLAIN", "SCRAM-SHA-256", "SCRAM-SHA-512", "OAUTHBEARER")
+
+// fileProperties point to files that have to exist when the client is created.
+var fileProperties = []string{
+	"ssl.ca.location", "ssl.certificate.location", "ssl.key.location",
+	"ssl.keystore.location", "ssl.crl.location", "sasl.kerberos.keytab",
 }
 
+var jaasOption = regexp.MustCompile(`(\w+)\s*=\s*"([^"]*)"`)
+
+func toSet(values ...string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
+
+// GetKafkaConfiguration reads a Java properties file and converts it to a
+// librdkafka configuration. Every librdkafka property is passed through as is,
+// while the Java client settings for SASL and SSL are translated to their
+// librdkafka equivalents. Unknown keys and invalid values are reported together.
 func GetKafkaConfiguration(configFile string) (kafka.ConfigMap, error) {
 	conf, err := ReadConfig(configFile)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read config: %v", err)
 	}
-	var kafkaConfig = kafka.ConfigMap{
-		"bootstrap.servers": conf["bootstrap.servers"],
+
+	kafkaConfig, problems := translateKafkaProperties(conf, filepath.Dir(configFile))
+	problems = append(problems, validateKafkaConfiguration(kafkaConfig)...)
+	if len(problems) > 0 {
+		return nil, &ConfigError{Problems: problems}
 	}
+	return kafkaConfig, nil
+}
+
+func translateKafkaProperties(conf map[string]string, configDir string) (kafka.ConfigMap, []string) {
+	var problems []string
+	kafkaConfig := kafka.ConfigMap{}
 
-	if conf["security.protocol"] != "" {
-		truststore_location_slice := strings.Split(conf["ssl.truststore.location"], "/")
-		ca_cert := strings.Join(truststore_location_slice[:len(truststore_location_slice)-1], "/")
-		kafkaConfig.SetKey("ssl.keystore.location", conf["ssl.keystore.location"])
-		kafkaConfig.SetKey("security.protocol", conf["security.protocol"])
-		kafkaConfig.SetKey("ssl.keystore.password", conf["ssl.keystore.password"])
-		kafkaConfig.SetKey("ssl.key.password", conf["ssl.key.password"])
-		kafkaConfig.SetKey("ssl.ca.location", filepath.Join(ca_cert, "server.cer.pem"))
+	keys := make([]string, 0, len(conf))
+	for key := range conf {
+		keys = append(keys, key)
 	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := conf[key]
+		switch {
+		case key == "sasl.mechanism":
+			kafkaConfig["sasl.mechanisms"] = value
 
-	return kafkaConfig, err
+		case key == "sasl.jaas.config":
+			if !strings.Contains(value, "ScramLoginModule") && !strings.Contains(value, "PlainLoginModule") {
+				problems = append(problems, "sasl.jaas.config: only the SCRAM and PLAIN login modules are supported")
+				continue
+			}
+			for _, option := range jaasOption.FindAllStringSubmatch(value, -1) {
+				switch option[1] {
+				case "username":
+					kafkaConfig["sasl.username"] = option[2]
+				case "password":
+					kafkaConfig["sasl.password"] = option[2]
+				}
+			}
+
+		case key == "ssl.truststore.location":
+			if _, ok := conf["ssl.ca.location"]; ok {
+				continue
+			}
+			if strings.EqualFold(conf["ssl.truststore.type"], "PEM") || strings.HasSuffix(value, ".pem") {
+				kafkaConfig["ssl.ca.location"] = value
+				continue
+			}
+			// librdkafka cannot read JKS truststores. scripts/JKS2PEM.sh
+			// converts them to server.cer.pem next to the truststore.
+			converted := filepath.Join(filepath.Dir(value), "server.cer.pem")
+			if exists, _ := FileExists(converted); !exists {
+				problems = append(problems, fmt.Sprintf(
+					"ssl.truststore.location: JKS truststores are not supported, set ssl.ca.location to a PEM file or convert %s with scripts/JKS2PEM.sh", value))
+				continue
+			}
+			kafkaConfig["ssl.ca.location"] = converted
+
+		case key == "ssl.keystore.location" && strings.EqualFold(conf["ssl.keystore.type"], "JKS"):
+			problems = append(problems, "ssl.keystore.location: JKS keystores are not supported, use PKCS#12 or ssl.certificate.location and ssl.key.location")
+
+		case key == "ssl.endpoint.identification.algorithm" && value == "":
+			// The Java clients disable hostname verification with an empty value.
+			kafkaConfig[key] = "none"
+
+		case javaOnlyProperties[key]:
+			continue
+
+		case librdkafkaProperties[key]:
+			kafkaConfig[key] = value
+
+		default:
+			problems = append(problems, fmt.Sprintf("%s: unknown configuration property", key))
+		}
+	}
+
+	// Relative paths are resolved against the directory of the properties file.
+	for _, key := range fileProperties {
+		if value, ok := kafkaConfig[key].(string); ok && value != "" && !filepath.IsAbs(value) {
+			kafkaConfig[key] = filepath.Join(configDir, value)
+		}
+	}
+
+	return kafkaConfig, problems
+}
+
+func validateKafkaConfiguration(kafkaConfig kafka.ConfigMap) []string {
+	var problems []string
+	get := func(key string) string {
+		value, _ := kafkaConfig[key].(string)
+		return value
+	}
+
+	if get("bootstrap.servers") == "" && get("metadata.broker.list") == "" {
+		problems = append(problems, "bootstrap.servers is missing")
+	}
+
+	protocol := strings.ToLower(get("security.protocol"))
+	if protocol != "" {
+		if !securityProtocols[protocol] {
+			problems = append(problems, fmt.Sprintf("security.protocol: invalid value %q", get("security.protocol")))
+		}
+		kafkaConfig["security.protocol"] = protocol
+	}
+
+	mechanism := strings.ToUpper(get("sasl.mechanisms"))
+	if strings.HasPrefix(protocol, "sasl_") && mechanism == "" {
+		problems = append(problems, "sasl.mechanism is required by security.protocol "+protocol)
+	}
+	if mechanism != "" {
+		if !saslMechanisms[mechanism] {
+			problems = append(problems, fmt.Sprintf("sasl.mechanism: invalid value %q", get("sasl.mechanisms")))
+		}
+		if mechanism == "PLAIN" || strings.HasPrefix(mechanism, "SCRAM-") {
+			if get("sasl.username") == "" || get("sasl.password") == "" {
+				problems = append(problems, fmt.Sprintf("sasl.username and sasl.password are required by sasl.mechanism %s", mechanism))
+			}
+		}
+		kafkaConfig["sasl.mechanisms"] = mechanism
+	}
+
+	if (get("ssl.certificate.location") == "") != (get("ssl.key.location") == "") {
+		problems = append(problems, "ssl.certificate.location and ssl.key.location have to be set together")
+	}
+
+	for _, key := range fileProperties {
+		path := get(key)
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", key, err))
+		}
+	}
+	return problems
 }
 
 func CreateProducer(configFile string) (*kafka.Producer, error) {
@@ -90,3 +269,66 @@ func CreateConsumer(configFile, groupId, offset string) (*kafka.Consumer, error)
 	}
 	return consumer, nil
 }
+
+// SubscribeTopics subscribes the consumer to the topics. If start is not the
+// zero time, every partition the consumer group has no committed offset for is
+// moved to its first message at or after start when it is assigned. The others
+// resume from their committed offsets, so that a restart or a rebalance does
+// not replay them.
+func SubscribeTopics(consumer *kafka.Consumer, topics []string, start time.Time) error {
+	if start.IsZero() {
+		return consumer.SubscribeTopics(topics, nil)
+	}
+
+	rebalance := func(c *kafka.Consumer, ev kafka.Event) error {
+		switch e := ev.(type) {
+		case kafka.AssignedPartitions:
+			committed, err := c.Committed(e.Partitions, 10000)
+			if err != nil {
+				return fmt.Errorf("failed to read the committed offsets: %v", err)
+			}
+			var lookup []kafka.TopicPartition
+			for _, tp := range committed {
+				if tp.Offset < 0 {
+					tp.Offset = kafka.Offset(start.UnixMilli())
+					lookup = append(lookup, tp)
+				}
+			}
+			if len(lookup) == 0 {
+				return c.Assign(e.Partitions)
+			}
+
+			offsets, err := c.OffsetsForTimes(lookup, 10000)
+			if err != nil {
+				return fmt.Errorf("failed to look up the offsets at %s: %v", start.Format(time.RFC3339), err)
+			}
+			positions := make(map[string]kafka.Offset, len(offsets))
+			for _, tp := range offsets {
+				if tp.Error != nil {
+					return fmt.Errorf("failed to look up the offset of %s: %v", partitionKey(tp), tp.Error)
+				}
+				positions[partitionKey(tp)] = tp.Offset
+			}
+
+			assignment := make([]kafka.TopicPartition, len(e.Partitions))
+			for i, tp := range e.Partitions {
+				if offset, ok := positions[partitionKey(tp)]; ok {
+					// Partitions without newer messages start at their end.
+					tp.Offset = offset
+					Info("starting partition at offset", "topic", *tp.Topic, "partition", tp.Partition, "offset", int64(offset))
+				}
+				assignment[i] = tp
+			}
+			return c.Assign(assignment)
+
+		case kafka.RevokedPartitions:
+			return c.Unassign()
+		}
+		return nil
+	}
+	return consumer.SubscribeTopics(topics, rebalance)
+}
+
+func partitionKey(tp kafka.TopicPartition) string {
+	return fmt.Sprintf("%s[%d]", *tp.Topic, tp.Partition)
+}
@@ -0,0 +1,26 @@
+// Package kube connects the clients to the Kubernetes cluster they run in.
+package kube
+
+import (
+	"fmt"
+
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Config loads the kubeconfig file, or the configuration inside the cluster
+// if path is empty.
+func Config(path string) (*rest.Config, error) {
+	if path == "" {
+		config, err := rest.InClusterConfig()
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect from inside the cluster, set a kubeconfig outside of it: %w", err)
+		}
+		return config, nil
+	}
+	config, err := clientcmd.BuildConfigFromFlags("", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load kubeconfig %s: %w", path, err)
+	}
+	return config, nil
+}
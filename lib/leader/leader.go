@@ -0,0 +1,113 @@
+// Package leader elects, with a Kubernetes Lease, the one replica of a client
+// that runs a job.
+package leader
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+
+	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib"
+	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib/kube"
+)
+
+// Run runs job while the replica holds the lease, and competes for it again
+// when it is lost, until ctx is done. The ctx of job is done once the lease
+// is lost. Without a lease name, job runs at once. Run returns after job.
+func Run(ctx context.Context, conf lib.LeaseConfig, job func(ctx context.Context)) error {
+	if conf.Name == "" {
+		job(ctx)
+		return nil
+	}
+
+	config, err := kube.Config(conf.Kubeconfig)
+	if err != nil {
+		return fmt.Errorf("refunds.lease: %w", err)
+	}
+	clientset, err := kubernetes.NewForConfig(config)
+	if err != nil {
+		return err
+	}
+	// The pod name tells the replicas apart.
+	identity, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+
+	// The elector starts job in a goroutine of its own, which may not have run
+	// yet when elector.Run returns. The job holds running while it runs, and
+	// skips once the ctx of the lease is done, so that taking running after
+	// elector.Run waits for the job and no job outlives its lease.
+	var running sync.Mutex
+	election := leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.LeaseLock{
+			LeaseMeta:  metav1.ObjectMeta{Name: conf.Name, Namespace: conf.Namespace},
+			Client:     clientset.CoordinationV1(),
+			LockConfig: resourcelock.ResourceLockConfig{Identity: identity},
+		},
+		LeaseDuration:   conf.Duration,
+		RenewDeadline:   conf.Duration * 2 / 3,
+		RetryPeriod:     conf.Duration / 5,
+		ReleaseOnCancel: true,
+		Name:            conf.Name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				running.Lock()
+				defer running.Unlock()
+				if ctx.Err() != nil {
+					return
+				}
+				lib.Info("acquired lease", "lease", conf.Name, "identity", identity)
+				job(ctx)
+			},
+			OnStoppedLeading: func() {
+				lib.Info("released lease", "lease", conf.Name, "identity", identity)
+			},
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					lib.Info("lease is held by another replica", "lease", conf.Name, "leader", leader)
+				}
+			},
+		},
+	}
+	elector, err := leaderelection.NewLeaderElector(election)
+	if err != nil {
+		return fmt.Errorf("invalid lease %s: %w", conf.Name, err)
+	}
+
+	for ctx.Err() == nil {
+		elector.Run(ctx)
+		running.Lock()
+		running.Unlock()
+	}
+	return nil
+}
+
+// Start runs Run in the background. The returned func stops it and waits for
+// job to return, until its ctx is done.
+func Start(conf lib.LeaseConfig, job func(ctx context.Context)) func(context.Context) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := Run(ctx, conf, job); err != nil {
+			lib.Error("leader election failed", "lease", conf.Name, "error", err)
+		}
+	}()
+
+	return func(stop context.Context) error {
+		cancel()
+		select {
+		case <-done:
+			return nil
+		case <-stop.Done():
+			return stop.Err()
+		}
+	}
+}
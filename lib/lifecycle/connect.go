@@ -0,0 +1,129 @@
+package lifecycle
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/hyperledger/fabric-protos-go-apiv2/gateway"
+	"github.com/hyperledger/fabric-protos-go-apiv2/orderer"
+	"github.com/hyperledger/fabric-protos-go-apiv2/peer"
+
+	"github.com/LoniasGR/hyperledger-fabric-sla-chaincode/lib"
+)
+
+// Connect connects to the peers and the orderer of conf.Lifecycle, on the
+// channel of conf, as the admin whose MSP folder is conf.Lifecycle.MSPPath.
+// The admin belongs to the organisation of the wallet.
+func Connect(conf lib.Config) (*Client, error) {
+	if conf.UserConf == nil {
+		return nil, errors.New("the wallet is not loaded")
+	}
+	certificate, err := firstFile(filepath.Join(conf.Lifecycle.MSPPath, "signcerts"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read admin certificate: %w", err)
+	}
+	keyPath, err := firstPath(filepath.Join(conf.Lifecycle.MSPPath, "keystore"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find admin key: %w", err)
+	}
+	adminConf := conf
+	adminConf.Signer = lib.SignerConfig{Type: "pem", KeyPath: keyPath}
+	signer, err := lib.NewSigner(adminConf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load admin key: %w", err)
+	}
+	closers := []io.Closer{signer}
+	closeAll := func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+
+	peers := make([]Peer, len(conf.Lifecycle.Peers))
+	for i, endpoint := range conf.Lifecycle.Peers {
+		peerConf := conf
+		peerConf.Gateways = []lib.GatewayEndpoint{endpoint}
+		connection, err := lib.NewGrpcConnection(peerConf)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("failed to connect to peer %s: %w", endpoint.Endpoint, err)
+		}
+		closers = append(closers, connection)
+		peers[i] = Peer{Address: endpoint.Endpoint, Endorser: peer.NewEndorserClient(connection), Gateway: gateway.NewGatewayClient(connection)}
+	}
+
+	endorsers := make(map[string]Peer, len(conf.Lifecycle.Endorsers))
+	for _, endorser := range conf.Lifecycle.Endorsers {
+		endorserConf := conf
+		endorserConf.Gateways = []lib.GatewayEndpoint{{Endpoint: endorser.Endpoint, HostOverride: endorser.HostOverride}}
+		if endorser.TLSCAPath != "" {
+			endorserConf.TlsCertPath = endorser.TLSCAPath
+		}
+		connection, err := lib.NewGrpcConnection(endorserConf)
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("failed to connect to peer %s of %s: %w", endorser.Endpoint, endorser.MspID, err)
+		}
+		closers = append(closers, connection)
+		endorsers[endorser.MspID] = Peer{Address: endorser.Endpoint, Endorser: peer.NewEndorserClient(connection)}
+	}
+
+	ordererConf := conf
+	ordererConf.TlsCertPath = conf.Lifecycle.OrdererCAPath
+	ordererConf.Gateways = []lib.GatewayEndpoint{{Endpoint: conf.Lifecycle.Orderer}}
+	connection, err := lib.NewGrpcConnection(ordererConf)
+	if err != nil {
+		closeAll()
+		return nil, fmt.Errorf("failed to connect to orderer %s: %w", conf.Lifecycle.Orderer, err)
+	}
+	closers = append(closers, connection)
+
+	identity := Identity{MspID: conf.UserConf.MspID, Certificate: certificate, Sign: signer.Sign}
+	c, err := New(identity, conf.ChannelName, peers, orderer.NewAtomicBroadcastClient(connection))
+	if err != nil {
+		closeAll()
+		return nil, err
+	}
+	c.closers = closers
+	c.Endorsers = endorsers
+	return c, nil
+}
+
+// Close closes the connections opened by Connect.
+func (c *Client) Close() error {
+	var errs []error
+	for _, closer := range c.closers {
+		if err := closer.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("failed to close lifecycle connections: %v", errs)
+	}
+	return nil
+}
+
+// firstPath returns the first file of an MSP subfolder, as the peer does.
+func firstPath(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			return filepath.Join(dir, entry.Name()), nil
+		}
+	}
+	return "", fmt.Errorf("no files in %s", dir)
+}
+
+func firstFile(dir string) ([]byte, error) {
+	path, err := firstPath(dir)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(path)
+}
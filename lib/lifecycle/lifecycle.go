@@ -0,0 +1,409 @@
+// Package lifecycle installs, approves and commits chaincode through the admin
+// APIs of the peers and the orderer, as the peer lifecycle commands do.
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric-protos-go-apiv2/common"
+	"github.com/hyperledger/fabric-protos-go-apiv2/gateway"
+	"github.com/hyperledger/fabric-protos-go-apiv2/orderer"
+	"github.com/hyperledger/fabric-protos-go-apiv2/peer"
+	lb "github.com/hyperledger/fabric-protos-go-apiv2/peer/lifecycle"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrNotCommitted is returned for a chaincode without a committed definition.
+var ErrNotCommitted = errors.New("chaincode definition is not committed")
+
+// Peer is a peer. Endorser and Gateway are usually the clients of a gRPC
+// connection to the peer. The Gateway of the first peer of the organisation
+// reports the status of the transactions; the other peers do not need one.
+type Peer struct {
+	Address  string
+	Endorser peer.EndorserClient
+	Gateway  gateway.GatewayClient
+}
+
+// Definition is the definition of a chaincode on a channel. The default
+// endorsement and validation plugins and the default endorsement policy of the
+// channel are used.
+type Definition struct {
+	Name         string
+	Version      string
+	Sequence     int64
+	PackageID    string
+	InitRequired bool
+}
+
+// InstalledChaincode is a package installed on a peer.
+type InstalledChaincode struct {
+	PackageID string
+	Label     string
+	// Channels lists the chaincode names the package is used by, per channel.
+	Channels map[string][]string
+}
+
+// ProposalError is a proposal that a peer did not endorse.
+type ProposalError struct {
+	Peer    string
+	Status  int32
+	Message string
+}
+
+func (e *ProposalError) Error() string {
+	return fmt.Sprintf("peer %s rejected the proposal with status %d: %s", e.Peer, e.Status, e.Message)
+}
+
+// ApprovalsError reports the organisations that did not approve a definition
+// in time.
+type ApprovalsError struct {
+	Name     string
+	Approved []string
+	Missing  []string
+	Err      error
+}
+
+func (e *ApprovalsError) Error() string {
+	approved := "nobody"
+	if len(e.Approved) > 0 {
+		approved = strings.Join(e.Approved, ", ")
+	}
+	return fmt.Sprintf("%s is still waiting for the approval of %s, approved by %s: %v",
+		e.Name, strings.Join(e.Missing, ", "), approved, e.Err)
+}
+
+func (e *ApprovalsError) Unwrap() error {
+	return e.Err
+}
+
+// TransactionError is a transaction that was committed but invalidated.
+type TransactionError struct {
+	TxID string
+	Code peer.TxValidationCode
+}
+
+func (e *TransactionError) Error() string {
+	return fmt.Sprintf("transaction %s was invalidated with code %s", e.TxID, e.Code)
+}
+
+// Client manages the chaincode of one organisation on one channel.
+type Client struct {
+	identity Identity
+	channel  string
+	peers    []Peer
+	orderer  orderer.AtomicBroadcastClient
+	closers  []io.Closer
+	// Endorsers are peers of the other organisations, by MSP ID, which
+	// endorse the commits together with the first peer of the organisation.
+	Endorsers map[string]Peer
+	// PollInterval is how often the peers are queried while waiting for the
+	// approvals of the other organisations.
+	PollInterval time.Duration
+}
+
+// New creates a Client. Packages are installed on all the peers; the other
+// proposals are endorsed by the first one, which also reports whether the
+// transactions are valid.
+func New(identity Identity, channel string, peers []Peer, orderer orderer.AtomicBroadcastClient) (*Client, error) {
+	if len(peers) == 0 {
+		return nil, errors.New("no peers to manage chaincode on")
+	}
+	return &Client{
+		identity:     identity,
+		channel:      channel,
+		peers:        peers,
+		orderer:      orderer,
+		Endorsers:    map[string]Peer{},
+		PollInterval: time.Second,
+	}, nil
+}
+
+// MspID returns the organisation the client approves for.
+func (c *Client) MspID() string {
+	return c.identity.MspID
+}
+
+// Install installs the package on all the peers. A package that is already
+// installed on a peer is left as it is.
+func (c *Client) Install(ctx context.Context, pkg []byte) (InstalledChaincode, error) {
+	var installed InstalledChaincode
+	args := &lb.InstallChaincodeArgs{ChaincodeInstallPackage: pkg}
+	for _, p := range c.peers {
+		var result lb.InstallChaincodeResult
+		_, err := c.call(ctx, p, "", "InstallChaincode", args, &result)
+		var proposalErr *ProposalError
+		if errors.As(err, &proposalErr) && strings.Contains(proposalErr.Message, "chaincode already successfully installed") {
+			label, _, err := ReadPackage(pkg)
+			if err != nil {
+				return installed, err
+			}
+			installed = InstalledChaincode{PackageID: PackageID(label, pkg), Label: label}
+			continue
+		}
+		if err != nil {
+			return installed, fmt.Errorf("failed to install on %s: %w", p.Address, err)
+		}
+		installed = InstalledChaincode{PackageID: result.PackageId, Label: result.Label}
+	}
+	return installed, nil
+}
+
+// QueryInstalled returns the packages installed on the first peer.
+func (c *Client) QueryInstalled(ctx context.Context) ([]InstalledChaincode, error) {
+	var result lb.QueryInstalledChaincodesResult
+	_, err := c.call(ctx, c.peers[0], "", "QueryInstalledChaincodes", &lb.QueryInstalledChaincodesArgs{}, &result)
+	if err != nil {
+		return nil, err
+	}
+
+	installed := make([]InstalledChaincode, len(result.InstalledChaincodes))
+	for i, cc := range result.InstalledChaincodes {
+		channels := make(map[string][]string, len(cc.References))
+		for channel, refs := range cc.References {
+			for _, ref := range refs.Chaincodes {
+				channels[channel] = append(channels[channel], ref.Name)
+			}
+		}
+		installed[i] = InstalledChaincode{PackageID: cc.PackageId, Label: cc.Label, Channels: channels}
+	}
+	sort.Slice(installed, func(i, j int) bool { return installed[i].Label < installed[j].Label })
+	return installed, nil
+}
+
+// Approve approves the definition for the organisation and waits until the
+// approval is committed.
+func (c *Client) Approve(ctx context.Context, def Definition) error {
+	args := &lb.ApproveChaincodeDefinitionForMyOrgArgs{
+		Name:         def.Name,
+		Version:      def.Version,
+		Sequence:     def.Sequence,
+		InitRequired: def.InitRequired,
+		Source: &lb.ChaincodeSource{
+			Type: &lb.ChaincodeSource_LocalPackage{
+				LocalPackage: &lb.ChaincodeSource_Local{PackageId: def.PackageID},
+			},
+		},
+	}
+	if err := c.submit(ctx, "ApproveChaincodeDefinitionForMyOrg", args, []Peer{c.peers[0]}); err != nil {
+		return fmt.Errorf("failed to approve %s: %w", def.Name, err)
+	}
+	return nil
+}
+
+// CheckCommitReadiness returns which organisations approved the definition.
+func (c *Client) CheckCommitReadiness(ctx context.Context, def Definition) (map[string]bool, error) {
+	args := &lb.CheckCommitReadinessArgs{
+		Name:         def.Name,
+		Version:      def.Version,
+		Sequence:     def.Sequence,
+		InitRequired: def.InitRequired,
+	}
+	var result lb.CheckCommitReadinessResult
+	if _, err := c.call(ctx, c.peers[0], c.channel, "CheckCommitReadiness", args, &result); err != nil {
+		return nil, err
+	}
+	return result.Approvals, nil
+}
+
+// WaitForApprovals waits until all the organisations approved the definition.
+// It fails at once for an organisation that is not a member of the channel.
+func (c *Client) WaitForApprovals(ctx context.Context, def Definition, orgs []string) error {
+	var approvals map[string]bool
+	err := c.waitFor(ctx, func() (bool, error) {
+		current, err := c.CheckCommitReadiness(ctx, def)
+		if err != nil {
+			return false, err
+		}
+		approvals = current
+		for _, org := range orgs {
+			if _, ok := approvals[org]; !ok {
+				return false, fmt.Errorf("%s is not a member of channel %s", org, c.channel)
+			}
+		}
+		return len(missingApprovals(approvals, orgs)) == 0, nil
+	})
+	if err != nil && ctx.Err() != nil {
+		approvalsErr := &ApprovalsError{Name: def.Name, Missing: missingApprovals(approvals, orgs), Err: ctx.Err()}
+		for org, approved := range approvals {
+			if approved {
+				approvalsErr.Approved = append(approvalsErr.Approved, org)
+			}
+		}
+		sort.Strings(approvalsErr.Approved)
+		return approvalsErr
+	}
+	return err
+}
+
+func missingApprovals(approvals map[string]bool, orgs []string) []string {
+	var missing []string
+	for _, org := range orgs {
+		if !approvals[org] {
+			missing = append(missing, org)
+		}
+	}
+	return missing
+}
+
+// Commit commits the definition on the channel and waits until it is
+// committed. The commit is endorsed by the first peer of the organisation and
+// an endorser of every other organisation in orgs, which approved it, so
+// that it satisfies the lifecycle endorsement policy of the channel.
+func (c *Client) Commit(ctx context.Context, def Definition, orgs []string) error {
+	endorsers := []Peer{c.peers[0]}
+	for _, org := range orgs {
+		if org == c.identity.MspID {
+			continue
+		}
+		endorser, ok := c.Endorsers[org]
+		if !ok {
+			return fmt.Errorf("failed to commit %s: no peer of %s to endorse the commit", def.Name, org)
+		}
+		endorsers = append(endorsers, endorser)
+	}
+
+	args := &lb.CommitChaincodeDefinitionArgs{
+		Name:         def.Name,
+		Version:      def.Version,
+		Sequence:     def.Sequence,
+		InitRequired: def.InitRequired,
+	}
+	if err := c.submit(ctx, "CommitChaincodeDefinition", args, endorsers); err != nil {
+		return fmt.Errorf("failed to commit %s: %w", def.Name, err)
+	}
+	return nil
+}
+
+// QueryCommitted returns the committed definition of a chaincode, or
+// ErrNotCommitted if it has none.
+func (c *Client) QueryCommitted(ctx context.Context, name string) (Definition, error) {
+	var result lb.QueryChaincodeDefinitionResult
+	_, err := c.call(ctx, c.peers[0], c.channel, "QueryChaincodeDefinition", &lb.QueryChaincodeDefinitionArgs{Name: name}, &result)
+	var proposalErr *ProposalError
+	if errors.As(err, &proposalErr) && strings.Contains(proposalErr.Message, "not defined") {
+		return Definition{}, fmt.Errorf("%s: %w", name, ErrNotCommitted)
+	}
+	if err != nil {
+		return Definition{}, err
+	}
+	return Definition{
+		Name:         name,
+		Version:      result.Version,
+		Sequence:     result.Sequence,
+		InitRequired: result.InitRequired,
+	}, nil
+}
+
+// call sends a proposal to a peer and decodes its result.
+func (c *Client) call(ctx context.Context, p Peer, channel, fn string, args, result proto.Message) (*peer.ProposalResponse, error) {
+	prop, err := newProposal(c.identity, channel, fn, args)
+	if err != nil {
+		return nil, err
+	}
+	return c.endorse(ctx, p, prop, result)
+}
+
+func (c *Client) endorse(ctx context.Context, p Peer, prop *proposal, result proto.Message) (*peer.ProposalResponse, error) {
+	response, err := p.Endorser.ProcessProposal(ctx, prop.signedProposal)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send proposal to %s: %w", p.Address, err)
+	}
+	if response.Response == nil {
+		return nil, &ProposalError{Peer: p.Address, Message: "empty response"}
+	}
+	if response.Response.Status < 200 || response.Response.Status >= 400 {
+		return nil, &ProposalError{Peer: p.Address, Status: response.Response.Status, Message: response.Response.Message}
+	}
+	if result != nil {
+		if err = proto.Unmarshal(response.Response.Payload, result); err != nil {
+			return nil, fmt.Errorf("failed to decode the result of %s: %w", p.Address, err)
+		}
+	}
+	return response, nil
+}
+
+// submit has the proposal endorsed by the endorsers, sends the transaction to
+// the orderer and waits until the first peer of the organisation committed it.
+func (c *Client) submit(ctx context.Context, fn string, args proto.Message, endorsers []Peer) error {
+	prop, err := newProposal(c.identity, c.channel, fn, args)
+	if err != nil {
+		return err
+	}
+	responses := make([]*peer.ProposalResponse, len(endorsers))
+	for i, endorser := range endorsers {
+		if responses[i], err = c.endorse(ctx, endorser, prop, nil); err != nil {
+			return err
+		}
+	}
+	envelope, err := prop.transaction(c.identity, responses)
+	if err != nil {
+		return err
+	}
+
+	stream, err := c.orderer.Broadcast(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect to the orderer: %w", err)
+	}
+	defer stream.CloseSend()
+	if err = stream.Send(envelope); err != nil {
+		return fmt.Errorf("failed to send transaction %s: %w", prop.txID, err)
+	}
+	broadcast, err := stream.Recv()
+	if err != nil {
+		return fmt.Errorf("failed to send transaction %s: %w", prop.txID, err)
+	}
+	if broadcast.Status != common.Status_SUCCESS {
+		return fmt.Errorf("orderer rejected transaction %s with status %s: %s", prop.txID, broadcast.Status, broadcast.Info)
+	}
+	return c.commitStatus(ctx, prop.txID)
+}
+
+// commitStatus waits until the first peer committed the transaction, and
+// fails if it was invalidated.
+func (c *Client) commitStatus(ctx context.Context, txID string) error {
+	creator, err := c.identity.creator()
+	if err != nil {
+		return err
+	}
+	request, err := proto.Marshal(&gateway.CommitStatusRequest{TransactionId: txID, ChannelId: c.channel, Identity: creator})
+	if err != nil {
+		return err
+	}
+	signature, err := c.identity.sign(request)
+	if err != nil {
+		return fmt.Errorf("failed to sign commit status request: %w", err)
+	}
+
+	status, err := c.peers[0].Gateway.CommitStatus(ctx, &gateway.SignedCommitStatusRequest{Request: request, Signature: signature})
+	if err != nil {
+		return fmt.Errorf("failed to get the commit status of transaction %s: %w", txID, err)
+	}
+	if status.Result != peer.TxValidationCode_VALID {
+		return &TransactionError{TxID: txID, Code: status.Result}
+	}
+	return nil
+}
+
+// waitFor polls done until it returns true, an error, or ctx is done.
+func (c *Client) waitFor(ctx context.Context, done func() (bool, error)) error {
+	ticker := time.NewTicker(c.PollInterval)
+	defer ticker.Stop()
+	for {
+		ok, err := done()
+		if err != nil || ok {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
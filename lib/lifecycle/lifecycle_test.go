@@ -0,0 +1,279 @@
+package lifecycle
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric-protos-go-apiv2/common"
+	"github.com/hyperledger/fabric-protos-go-apiv2/gateway"
+	"github.com/hyperledger/fabric-protos-go-apiv2/orderer"
+	"github.com/hyperledger/fabric-protos-go-apiv2/peer"
+	lb "github.com/hyperledger/fabric-protos-go-apiv2/peer/lifecycle"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// fakeEndorser answers the proposals with respond, by function of _lifecycle.
+type fakeEndorser struct {
+	mu       sync.Mutex
+	calls    []string
+	respond  func(fn string) *peer.Response
+	endorsed int
+}
+
+func (e *fakeEndorser) ProcessProposal(ctx context.Context, signed *peer.SignedProposal, opts ...grpc.CallOption) (*peer.ProposalResponse, error) {
+	fn, err := proposalFunction(signed)
+	if err != nil {
+		return nil, err
+	}
+	e.mu.Lock()
+	e.calls = append(e.calls, fn)
+	e.endorsed++
+	e.mu.Unlock()
+	return &peer.ProposalResponse{
+		Response:    e.respond(fn),
+		Payload:     []byte("result"),
+		Endorsement: &peer.Endorsement{Endorser: []byte("peer"), Signature: []byte("signature")},
+	}, nil
+}
+
+func proposalFunction(signed *peer.SignedProposal) (string, error) {
+	var prop peer.Proposal
+	if err := proto.Unmarshal(signed.ProposalBytes, &prop); err != nil {
+		return "", err
+	}
+	var payload peer.ChaincodeProposalPayload
+	if err := proto.Unmarshal(prop.Payload, &payload); err != nil {
+		return "", err
+	}
+	var spec peer.ChaincodeInvocationSpec
+	if err := proto.Unmarshal(payload.Input, &spec); err != nil {
+		return "", err
+	}
+	return string(spec.ChaincodeSpec.Input.Args[0]), nil
+}
+
+func ok(result proto.Message) *peer.Response {
+	payload, _ := proto.Marshal(result)
+	return &peer.Response{Status: 200, Payload: payload}
+}
+
+// fakeOrderer answers every broadcast with status.
+type fakeOrderer struct {
+	orderer.AtomicBroadcastClient
+	status common.Status
+	sent   int
+}
+
+func (o *fakeOrderer) Broadcast(ctx context.Context, opts ...grpc.CallOption) (orderer.AtomicBroadcast_BroadcastClient, error) {
+	return &fakeBroadcast{orderer: o}, nil
+}
+
+type fakeBroadcast struct {
+	grpc.ClientStream
+	orderer *fakeOrderer
+}
+
+func (b *fakeBroadcast) Send(*common.Envelope) error {
+	b.orderer.sent++
+	return nil
+}
+
+func (b *fakeBroadcast) Recv() (*orderer.BroadcastResponse, error) {
+	return &orderer.BroadcastResponse{Status: b.orderer.status, Info: "fake"}, nil
+}
+
+func (b *fakeBroadcast) CloseSend() error {
+	return nil
+}
+
+// fakeGateway reports every transaction with code.
+type fakeGateway struct {
+	gateway.GatewayClient
+	code peer.TxValidationCode
+}
+
+func (g *fakeGateway) CommitStatus(ctx context.Context, in *gateway.SignedCommitStatusRequest, opts ...grpc.CallOption) (*gateway.CommitStatusResponse, error) {
+	return &gateway.CommitStatusResponse{Result: g.code}, nil
+}
+
+func newTestClient(t *testing.T, endorser *fakeEndorser, o *fakeOrderer, g *fakeGateway) *Client {
+	t.Helper()
+	identity := Identity{
+		MspID:       "Org4MSP",
+		Certificate: []byte("certificate"),
+		Sign:        func(digest []byte) ([]byte, error) { return []byte("signature"), nil },
+	}
+	c, err := New(identity, "mychannel", []Peer{{Address: "org4-peer1:8051", Endorser: endorser, Gateway: g}}, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.PollInterval = 10 * time.Millisecond
+	return c
+}
+
+func TestInstallAlreadyInstalled(t *testing.T) {
+	pkg, err := Package("sla-1", Connection{Address: "localhost:9100", DialTimeout: "10s"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	endorser := &fakeEndorser{respond: func(fn string) *peer.Response {
+		return &peer.Response{Status: 500, Message: "failed to invoke backing implementation of 'InstallChaincode': chaincode already successfully installed"}
+	}}
+	c := newTestClient(t, endorser, &fakeOrderer{}, &fakeGateway{})
+
+	installed, err := c.Install(context.Background(), pkg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := PackageID("sla-1", pkg); installed.PackageID != want || installed.Label != "sla-1" {
+		t.Errorf("installed %+v, want %s", installed, want)
+	}
+}
+
+func TestQueryCommittedNotDefined(t *testing.T) {
+	endorser := &fakeEndorser{respond: func(fn string) *peer.Response {
+		return &peer.Response{Status: 404, Message: "namespace sla-1 is not defined"}
+	}}
+	c := newTestClient(t, endorser, &fakeOrderer{}, &fakeGateway{})
+
+	_, err := c.QueryCommitted(context.Background(), "sla-1")
+	if !errors.Is(err, ErrNotCommitted) {
+		t.Errorf("QueryCommitted = %v, want ErrNotCommitted", err)
+	}
+}
+
+func TestQueryCommitted(t *testing.T) {
+	endorser := &fakeEndorser{respond: func(fn string) *peer.Response {
+		return ok(&lb.QueryChaincodeDefinitionResult{Version: "2", Sequence: 3})
+	}}
+	c := newTestClient(t, endorser, &fakeOrderer{}, &fakeGateway{})
+
+	def, err := c.QueryCommitted(context.Background(), "sla-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if def.Version != "2" || def.Sequence != 3 {
+		t.Errorf("QueryCommitted = %+v", def)
+	}
+}
+
+func TestWaitForApprovalsTimeout(t *testing.T) {
+	endorser := &fakeEndorser{respond: func(fn string) *peer.Response {
+		return ok(&lb.CheckCommitReadinessResult{Approvals: map[string]bool{"Org4MSP": true, "Org1MSP": false, "Org2MSP": false}})
+	}}
+	c := newTestClient(t, endorser, &fakeOrderer{}, &fakeGateway{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := c.WaitForApprovals(ctx, Definition{Name: "sla-1", Version: "1", Sequence: 1}, []string{"Org4MSP", "Org1MSP", "Org2MSP"})
+
+	var approvalsErr *ApprovalsError
+	if !errors.As(err, &approvalsErr) {
+		t.Fatalf("WaitForApprovals = %v, want an ApprovalsError", err)
+	}
+	if strings.Join(approvalsErr.Approved, ",") != "Org4MSP" || strings.Join(approvalsErr.Missing, ",") != "Org1MSP,Org2MSP" {
+		t.Errorf("approved %v, missing %v", approvalsErr.Approved, approvalsErr.Missing)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("WaitForApprovals = %v, want a deadline", err)
+	}
+}
+
+func TestWaitForApprovalsNotMember(t *testing.T) {
+	endorser := &fakeEndorser{respond: func(fn string) *peer.Response {
+		return ok(&lb.CheckCommitReadinessResult{Approvals: map[string]bool{"Org4MSP": true}})
+	}}
+	c := newTestClient(t, endorser, &fakeOrderer{}, &fakeGateway{})
+
+	err := c.WaitForApprovals(context.Background(), Definition{Name: "sla-1"}, []string{"Org4MSP", "Org9MSP"})
+	if err == nil || !strings.Contains(err.Error(), "not a member") {
+		t.Errorf("WaitForApprovals = %v, want not a member", err)
+	}
+}
+
+func TestSubmit(t *testing.T) {
+	def := Definition{Name: "sla-1", Version: "1", Sequence: 1, PackageID: "sla-1:abc"}
+	tests := []struct {
+		name    string
+		respond func(fn string) *peer.Response
+		status  common.Status
+		code    peer.TxValidationCode
+		check   func(err error) bool
+		sent    int
+	}{
+		{
+			name:    "committed",
+			respond: func(fn string) *peer.Response { return ok(&lb.ApproveChaincodeDefinitionForMyOrgResult{}) },
+			status:  common.Status_SUCCESS,
+			code:    peer.TxValidationCode_VALID,
+			check:   func(err error) bool { return err == nil },
+			sent:    1,
+		},
+		{
+			name:    "endorsement rejected",
+			respond: func(fn string) *peer.Response { return &peer.Response{Status: 500, Message: "attempted to redefine"} },
+			check: func(err error) bool {
+				var proposalErr *ProposalError
+				return errors.As(err, &proposalErr) && proposalErr.Status == 500
+			},
+		},
+		{
+			name:    "orderer rejected",
+			respond: func(fn string) *peer.Response { return ok(&lb.ApproveChaincodeDefinitionForMyOrgResult{}) },
+			status:  common.Status_BAD_REQUEST,
+			check:   func(err error) bool { return err != nil && strings.Contains(err.Error(), "orderer rejected") },
+			sent:    1,
+		},
+		{
+			name:    "invalidated",
+			respond: func(fn string) *peer.Response { return ok(&lb.ApproveChaincodeDefinitionForMyOrgResult{}) },
+			status:  common.Status_SUCCESS,
+			code:    peer.TxValidationCode_ENDORSEMENT_POLICY_FAILURE,
+			check: func(err error) bool {
+				var txErr *TransactionError
+				return errors.As(err, &txErr) && txErr.Code == peer.TxValidationCode_ENDORSEMENT_POLICY_FAILURE
+			},
+			sent: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := &fakeOrderer{status: tt.status}
+			c := newTestClient(t, &fakeEndorser{respond: tt.respond}, o, &fakeGateway{code: tt.code})
+
+			err := c.Approve(context.Background(), def)
+			if !tt.check(err) {
+				t.Errorf("Approve = %v", err)
+			}
+			if o.sent != tt.sent {
+				t.Errorf("sent %d transactions, want %d", o.sent, tt.sent)
+			}
+		})
+	}
+}
+
+func TestCommitEndorsers(t *testing.T) {
+	def := Definition{Name: "sla-1", Version: "1", Sequence: 1}
+	respond := func(fn string) *peer.Response { return ok(&lb.CommitChaincodeDefinitionResult{}) }
+	own, other := &fakeEndorser{respond: respond}, &fakeEndorser{respond: respond}
+	c := newTestClient(t, own, &fakeOrderer{status: common.Status_SUCCESS}, &fakeGateway{code: peer.TxValidationCode_VALID})
+
+	err := c.Commit(context.Background(), def, []string{"Org4MSP", "Org1MSP"})
+	if err == nil || !strings.Contains(err.Error(), "no peer of Org1MSP") {
+		t.Fatalf("Commit without an endorser of Org1MSP = %v", err)
+	}
+
+	c.Endorsers["Org1MSP"] = Peer{Address: "org1-peer1:8051", Endorser: other}
+	if err = c.Commit(context.Background(), def, []string{"Org4MSP", "Org1MSP"}); err != nil {
+		t.Fatal(err)
+	}
+	if own.endorsed != 1 || other.endorsed != 1 {
+		t.Errorf("endorsed by own %d and other %d times, want once each", own.endorsed, other.endorsed)
+	}
+}
@@ -0,0 +1,141 @@
+package lifecycle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Connection is the connection.json of a chaincode-as-a-service package, which
+// tells the peers where the chaincode server listens. The address may use the
+// {{.peername}} template, which every peer replaces with its own name.
+type Connection struct {
+	Address            string `json:"address"`
+	DialTimeout        string `json:"dial_timeout"`
+	TLSRequired        bool   `json:"tls_required"`
+	ClientAuthRequired bool   `json:"client_auth_required,omitempty"`
+	ClientKey          string `json:"client_key,omitempty"`
+	ClientCert         string `json:"client_cert,omitempty"`
+	RootCert           string `json:"root_cert,omitempty"`
+}
+
+type metadata struct {
+	Type  string `json:"type"`
+	Label string `json:"label"`
+}
+
+// Package builds the install package of a chaincode-as-a-service: a tarball of
+// metadata.json and code.tar.gz, which holds connection.json. The tarball only
+// depends on its arguments, so the same chaincode always has the same package ID.
+func Package(label string, connection Connection) ([]byte, error) {
+	connectionJSON, err := json.MarshalIndent(connection, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	code, err := tarball(map[string][]byte{"connection.json": connectionJSON})
+	if err != nil {
+		return nil, err
+	}
+	metadataJSON, err := json.MarshalIndent(metadata{Type: "ccaas", Label: label}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return tarball(map[string][]byte{"code.tar.gz": code, "metadata.json": metadataJSON})
+}
+
+// tarball writes the files in a fixed order, without times or owners.
+func tarball(files map[string][]byte) ([]byte, error) {
+	names := []string{"code.tar.gz", "connection.json", "metadata.json"}
+
+	var b bytes.Buffer
+	gz := gzip.NewWriter(&b)
+	tw := tar.NewWriter(gz)
+	for _, name := range names {
+		content, ok := files[name]
+		if !ok {
+			continue
+		}
+		err := tw.WriteHeader(&tar.Header{
+			Name:     name,
+			Mode:     0644,
+			Size:     int64(len(content)),
+			ModTime:  time.Unix(0, 0),
+			Typeflag: tar.TypeReg,
+			Format:   tar.FormatUSTAR,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if _, err = tw.Write(content); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// PackageID returns the ID the peers give to an installed package.
+func PackageID(label string, pkg []byte) string {
+	hash := sha256.Sum256(pkg)
+	return label + ":" + hex.EncodeToString(hash[:])
+}
+
+// ReadPackage returns the label and the connection of a chaincode-as-a-service package.
+func ReadPackage(pkg []byte) (string, Connection, error) {
+	var meta metadata
+	var connection Connection
+
+	files, err := untar(pkg)
+	if err != nil {
+		return "", connection, err
+	}
+	if err = json.Unmarshal(files["metadata.json"], &meta); err != nil {
+		return "", connection, fmt.Errorf("invalid metadata.json: %w", err)
+	}
+	if meta.Type != "ccaas" {
+		return "", connection, fmt.Errorf("package of type %q is not a chaincode-as-a-service", meta.Type)
+	}
+	code, err := untar(files["code.tar.gz"])
+	if err != nil {
+		return "", connection, fmt.Errorf("invalid code.tar.gz: %w", err)
+	}
+	if err = json.Unmarshal(code["connection.json"], &connection); err != nil {
+		return "", connection, fmt.Errorf("invalid connection.json: %w", err)
+	}
+	return meta.Label, connection, nil
+}
+
+func untar(b []byte) (map[string][]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	files := make(map[string][]byte)
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return files, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+		files[header.Name] = content
+	}
+}
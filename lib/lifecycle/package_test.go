@@ -0,0 +1,92 @@
+package lifecycle
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden packages in testdata")
+
+func TestPackageGolden(t *testing.T) {
+	tests := []struct {
+		golden     string
+		label      string
+		connection Connection
+	}{
+		{
+			golden:     "ccaas.tar.gz",
+			label:      "sla-1",
+			connection: Connection{Address: "{{.peername}}-ccaas-sla-1:8999", DialTimeout: "10s"},
+		},
+		{
+			golden: "ccaas-tls.tar.gz",
+			label:  "sla-2",
+			connection: Connection{
+				Address:            "localhost:9100",
+				DialTimeout:        "10s",
+				TLSRequired:        true,
+				ClientAuthRequired: true,
+				RootCert:           "-----BEGIN CERTIFICATE-----\n-----END CERTIFICATE-----\n",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.golden, func(t *testing.T) {
+			pkg, err := Package(tt.label, tt.connection)
+			if err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join("testdata", tt.golden)
+			if *update {
+				if err = os.WriteFile(path, pkg, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			golden, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(pkg, golden) {
+				t.Fatalf("package differs from %s", path)
+			}
+
+			again, err := Package(tt.label, tt.connection)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id := PackageID(tt.label, again); id != PackageID(tt.label, golden) {
+				t.Errorf("package ID %s is not reproducible", id)
+			}
+
+			label, connection, err := ReadPackage(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if label != tt.label || connection != tt.connection {
+				t.Errorf("read %q %+v, want %q %+v", label, connection, tt.label, tt.connection)
+			}
+		})
+	}
+}
+
+func TestPackageID(t *testing.T) {
+	got := PackageID("sla-1", []byte("package"))
+	want := "sla-1:bc4a71180870f7945155fbb02f4b0a2e3faa2a62d6d31b7039013055ed19869a"
+	if got != want {
+		t.Errorf("PackageID = %s, want %s", got, want)
+	}
+}
+
+func TestReadPackageRejectsOtherTypes(t *testing.T) {
+	pkg, err := tarball(map[string][]byte{"metadata.json": []byte(`{"type":"golang","label":"sla-1"}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = ReadPackage(pkg); err == nil {
+		t.Error("a golang package was read as a chaincode-as-a-service")
+	}
+}
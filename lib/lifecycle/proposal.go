@@ -0,0 +1,160 @@
+package lifecycle
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/hyperledger/fabric-protos-go-apiv2/common"
+	"github.com/hyperledger/fabric-protos-go-apiv2/msp"
+	"github.com/hyperledger/fabric-protos-go-apiv2/peer"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// lifecycleName is the system chaincode that manages the chaincode lifecycle.
+const lifecycleName = "_lifecycle"
+
+// Identity signs the proposals and transactions of the lifecycle. It has to
+// be an admin of its organisation.
+type Identity struct {
+	MspID string
+	// Certificate is PEM encoded.
+	Certificate []byte
+	// Sign signs a SHA-256 digest.
+	Sign func(digest []byte) ([]byte, error)
+}
+
+func (id Identity) creator() ([]byte, error) {
+	return proto.Marshal(&msp.SerializedIdentity{Mspid: id.MspID, IdBytes: id.Certificate})
+}
+
+func (id Identity) sign(message []byte) ([]byte, error) {
+	digest := sha256.Sum256(message)
+	return id.Sign(digest[:])
+}
+
+// proposal is a signed proposal together with what is needed to turn its
+// endorsements into a transaction.
+type proposal struct {
+	txID            string
+	header          *common.Header
+	payload         []byte
+	signedProposal  *peer.SignedProposal
+	signatureHeader []byte
+}
+
+// newProposal creates a proposal to call fn of _lifecycle with arg on a
+// channel, or on the peer itself if channel is empty.
+func newProposal(id Identity, channel, fn string, arg proto.Message) (*proposal, error) {
+	creator, err := id.creator()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 24)
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to create nonce: %w", err)
+	}
+	txHash := sha256.Sum256(append(append([]byte{}, nonce...), creator...))
+	txID := hex.EncodeToString(txHash[:])
+
+	argBytes, err := proto.Marshal(arg)
+	if err != nil {
+		return nil, err
+	}
+	chaincodeID := &peer.ChaincodeID{Name: lifecycleName}
+	input, err := proto.Marshal(&peer.ChaincodeInvocationSpec{
+		ChaincodeSpec: &peer.ChaincodeSpec{
+			ChaincodeId: chaincodeID,
+			Input:       &peer.ChaincodeInput{Args: [][]byte{[]byte(fn), argBytes}},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	payload, err := proto.Marshal(&peer.ChaincodeProposalPayload{Input: input})
+	if err != nil {
+		return nil, err
+	}
+
+	extension, err := proto.Marshal(&peer.ChaincodeHeaderExtension{ChaincodeId: chaincodeID})
+	if err != nil {
+		return nil, err
+	}
+	channelHeader, err := proto.Marshal(&common.ChannelHeader{
+		Type:      int32(common.HeaderType_ENDORSER_TRANSACTION),
+		ChannelId: channel,
+		TxId:      txID,
+		Timestamp: timestamppb.Now(),
+		Extension: extension,
+	})
+	if err != nil {
+		return nil, err
+	}
+	signatureHeader, err := proto.Marshal(&common.SignatureHeader{Creator: creator, Nonce: nonce})
+	if err != nil {
+		return nil, err
+	}
+	header := &common.Header{ChannelHeader: channelHeader, SignatureHeader: signatureHeader}
+	headerBytes, err := proto.Marshal(header)
+	if err != nil {
+		return nil, err
+	}
+
+	proposalBytes, err := proto.Marshal(&peer.Proposal{Header: headerBytes, Payload: payload})
+	if err != nil {
+		return nil, err
+	}
+	signature, err := id.sign(proposalBytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign proposal: %w", err)
+	}
+
+	return &proposal{
+		txID:            txID,
+		header:          header,
+		payload:         payload,
+		signedProposal:  &peer.SignedProposal{ProposalBytes: proposalBytes, Signature: signature},
+		signatureHeader: signatureHeader,
+	}, nil
+}
+
+// transaction assembles the endorsements of the proposal into a signed
+// transaction for the orderer. All peers must have returned the same result.
+func (p *proposal) transaction(id Identity, responses []*peer.ProposalResponse) (*common.Envelope, error) {
+	endorsements := make([]*peer.Endorsement, len(responses))
+	for i, response := range responses {
+		if !bytes.Equal(response.Payload, responses[0].Payload) {
+			return nil, fmt.Errorf("the peers returned different results for transaction %s", p.txID)
+		}
+		endorsements[i] = response.Endorsement
+	}
+
+	actionPayload, err := proto.Marshal(&peer.ChaincodeActionPayload{
+		ChaincodeProposalPayload: p.payload,
+		Action: &peer.ChaincodeEndorsedAction{
+			ProposalResponsePayload: responses[0].Payload,
+			Endorsements:            endorsements,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	transaction, err := proto.Marshal(&peer.Transaction{
+		Actions: []*peer.TransactionAction{{Header: p.signatureHeader, Payload: actionPayload}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	payload, err := proto.Marshal(&common.Payload{Header: p.header, Data: transaction})
+	if err != nil {
+		return nil, err
+	}
+	signature, err := id.sign(payload)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign transaction: %w", err)
+	}
+	return &common.Envelope{Payload: payload, Signature: signature}, nil
+}
@@ -0,0 +1,166 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"golang.org/x/exp/slog"
+)
+
+// LogConfig selects the format and the level of the logs of a client.
+type LogConfig struct {
+	// Format is json or text.
+	Format string `yaml:"format" env:"log_format"`
+	// Level is debug, info, warn or error.
+	Level string `yaml:"level" env:"log_level"`
+}
+
+var logFormats = toSet("json", "text")
+
+func (l LogConfig) validate() []string {
+	var problems []string
+	if !logFormats[l.Format] {
+		problems = append(problems, fmt.Sprintf("log.format: invalid value %q", l.Format))
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(l.Level)); err != nil {
+		problems = append(problems, fmt.Sprintf("log.level: invalid value %q", l.Level))
+	}
+	return problems
+}
+
+var (
+	// secretKey matches the fields whose values are never logged. The short
+	// names only match as a whole word, so that e.g. "mapping" is still logged.
+	secretKey = regexp.MustCompile(`(?i)((^|[_.-])(pin|token)|private_?key|passw(or)?d|secret)$`)
+	// secretValue matches the PEM private keys in the logged values.
+	secretValue = regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----[\s\S]*?(-----END [A-Z ]*PRIVATE KEY-----|$)`)
+	// colorCode matches the colours of the messages written for a terminal.
+	colorCode = regexp.MustCompile("\x1b\\[[0-9;]*m")
+)
+
+const redacted = "[REDACTED]"
+
+// SetupLogging makes a structured logger with the given format and level the
+// default one. The log package writes to it as well, at the info level.
+func SetupLogging(conf LogConfig) {
+	var level slog.Level
+	level.UnmarshalText([]byte(conf.Level))
+	options := slog.HandlerOptions{Level: level, ReplaceAttr: redact}
+
+	var handler slog.Handler
+	if conf.Format == "text" {
+		handler = options.NewTextHandler(os.Stderr)
+	} else {
+		handler = options.NewJSONHandler(os.Stderr)
+	}
+	slog.SetDefault(slog.New(handler))
+}
+
+// redact removes the credentials and the terminal colours from the logs.
+func redact(groups []string, a slog.Attr) slog.Attr {
+	if secretKey.MatchString(a.Key) {
+		return slog.String(a.Key, redacted)
+	}
+	switch a.Value.Kind() {
+	case slog.KindString:
+		value := colorCode.ReplaceAllString(a.Value.String(), "")
+		return slog.String(a.Key, secretValue.ReplaceAllString(value, redacted))
+	case slog.KindAny:
+		// The JSON handler marshals the values, the text handler formats them.
+		value := fmt.Sprint(a.Value.Any())
+		if b, err := json.Marshal(a.Value.Any()); err == nil && strings.Contains(string(b), "PRIVATE KEY") {
+			value = string(b)
+		}
+		if strings.Contains(value, "PRIVATE KEY") {
+			return slog.String(a.Key, secretValue.ReplaceAllString(value, redacted))
+		}
+	}
+	return a
+}
+
+func Debug(msg string, args ...any) {
+	slog.Default().Debug(msg, args...)
+}
+
+func Info(msg string, args ...any) {
+	slog.Default().Info(msg, args...)
+}
+
+func Warn(msg string, args ...any) {
+	slog.Default().Warn(msg, args...)
+}
+
+func Error(msg string, args ...any) {
+	slog.Default().Error(msg, args...)
+}
+
+// Fatal logs an error and exits.
+func Fatal(msg string, args ...any) {
+	slog.Default().Error(msg, args...)
+	os.Exit(1)
+}
+
+// With returns the default logger with the given fields.
+func With(args ...any) *slog.Logger {
+	return slog.Default().With(args...)
+}
+
+// MessageLogger returns the default logger with the topic, partition and offset of msg.
+func MessageLogger(msg *kafka.Message) *slog.Logger {
+	return With(
+		"topic", *msg.TopicPartition.Topic,
+		"partition", msg.TopicPartition.Partition,
+		"offset", int64(msg.TopicPartition.Offset),
+	)
+}
+
+// LogValue leaves the credentials out of the logs.
+func (u UserConfig) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.String("mspId", u.MspID),
+		slog.String("type", u.Type),
+		slog.Int("version", u.Version),
+	)
+}
+
+// MarshalJSON leaves the private key out, so that it is redacted from any
+// logged value the credentials are part of. String does the same for the text logs.
+func (c userCredentials) MarshalJSON() ([]byte, error) {
+	return json.Marshal(c.String())
+}
+
+func (c userCredentials) String() string {
+	return fmt.Sprintf("{certificate:%d bytes privateKey:%s}", len(c.Certificate), redacted)
+}
+
+// MarshalJSON leaves the PIN out, as userCredentials does with the private key.
+func (p PKCS11Config) MarshalJSON() ([]byte, error) {
+	type plain PKCS11Config
+	p.Pin = redacted
+	return json.Marshal(plain(p))
+}
+
+func (p PKCS11Config) String() string {
+	return fmt.Sprintf("{library:%s label:%s pin:%s identifier:%s}", p.Library, p.Label, redacted, p.Identifier)
+}
+
+// LogValue logs the settings that tell clients apart, without credentials.
+func (conf Config) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Int("orgNr", conf.OrgNr),
+		slog.String("channelName", conf.ChannelName),
+		slog.String("chaincodeName", conf.ChaincodeName),
+		slog.String("contractNamePrefix", conf.ContractNamePrefix),
+		slog.Any("gateways", conf.Gateways),
+		slog.String("consumerGroup", conf.ConsumerGroup),
+		slog.Any("topics", conf.Topics),
+		slog.String("dataFolder", conf.DataFolder),
+		slog.String("walletPath", conf.WalletPath),
+		slog.String("signer", conf.Signer.Type),
+	)
+}
@@ -0,0 +1,158 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// MetricsConfig enables the Prometheus endpoint of a client.
+type MetricsConfig struct {
+	// Listen is the address the endpoint listens on, e.g. :9100. The endpoint
+	// is disabled if it is empty.
+	Listen string `yaml:"listen" env:"metrics_listen"`
+}
+
+const metricsNamespace = "ledger_client"
+
+var (
+	messagesConsumed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "messages_consumed_total",
+		Help:      "Kafka messages consumed, by topic.",
+	}, []string{"topic"})
+	lastMessage = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_message_timestamp_seconds",
+		Help:      "Time the last Kafka message of a topic was consumed.",
+	}, []string{"topic"})
+	unmarshalFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "unmarshal_failures_total",
+		Help:      "Kafka messages that could not be unmarshalled, by topic.",
+	}, []string{"topic"})
+	consumerLag = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "consumer_lag",
+		Help:      "Messages between the last consumed one and the end of the partition.",
+	}, []string{"topic", "partition"})
+
+	transactionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "transaction_duration_seconds",
+		Help:      "Duration of the endorse, submit and commit phases of the transactions.",
+		Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"phase"})
+	transactionsCommitted = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "transactions_committed_total",
+		Help:      "Transactions committed successfully.",
+	})
+	lastCommit = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_commit_timestamp_seconds",
+		Help:      "Time the last transaction was committed successfully.",
+	})
+	transactionErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "errors_total",
+		Help:      "Errors handled by the client, by category.",
+	}, []string{"category"})
+
+	refundRuns = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "refund_runs_total",
+		Help:      "Runs of the nightly refund job, by outcome.",
+	}, []string{"outcome"})
+	lastRefundRun = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "refund_last_run_timestamp_seconds",
+		Help:      "Time the refund job last finished, by outcome.",
+	}, []string{"outcome"})
+	refundDuration = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "refund_last_run_duration_seconds",
+		Help:      "Duration of the last run of the refund job.",
+	})
+)
+
+// ServeMetrics serves the metrics on /metrics at addr in the background.
+func ServeMetrics(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		Info("serving metrics", "address", addr)
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			Error("metrics endpoint failed", "error", err)
+		}
+	}()
+	return server
+}
+
+// ObserveMessage records a message read by consumer, and the lag of its
+// partition according to the last watermarks the consumer received.
+func ObserveMessage(consumer *kafka.Consumer, msg *kafka.Message) {
+	topic := *msg.TopicPartition.Topic
+	messagesConsumed.WithLabelValues(topic).Inc()
+	lastMessage.WithLabelValues(topic).SetToCurrentTime()
+
+	_, high, err := consumer.GetWatermarkOffsets(topic, msg.TopicPartition.Partition)
+	if err == nil && high >= 0 {
+		lag := high - int64(msg.TopicPartition.Offset) - 1
+		if lag < 0 {
+			lag = 0
+		}
+		partition := strconv.Itoa(int(msg.TopicPartition.Partition))
+		consumerLag.WithLabelValues(topic, partition).Set(float64(lag))
+	}
+}
+
+// ObserveUnmarshalFailure records a message of topic that could not be unmarshalled.
+func ObserveUnmarshalFailure(topic string) {
+	unmarshalFailures.WithLabelValues(topic).Inc()
+}
+
+// ObserveRefundRun records a run of the refund job that started at start and returned err.
+func ObserveRefundRun(start time.Time, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "failure"
+	}
+	refundRuns.WithLabelValues(outcome).Inc()
+	lastRefundRun.WithLabelValues(outcome).SetToCurrentTime()
+	refundDuration.Set(time.Since(start).Seconds())
+}
+
+func observePhase(phase string, start time.Time) {
+	transactionDuration.WithLabelValues(phase).Observe(time.Since(start).Seconds())
+}
+
+func observeCommit() {
+	transactionsCommitted.Inc()
+	lastCommit.SetToCurrentTime()
+}
+
+func observeError(category ErrorCategory) {
+	transactionErrors.WithLabelValues(string(category)).Inc()
+}
+
+func (m MetricsConfig) validate() []string {
+	if m.Listen == "" {
+		return nil
+	}
+	if _, _, err := net.SplitHostPort(m.Listen); err != nil {
+		return []string{fmt.Sprintf("metrics.listen: %v", err)}
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// OffsetTracker commits the offset of a message once every record read from
+// it was submitted, in order per partition. Records waiting in a batch when
+// the client crashes are then read again when it starts, instead of being
+// skipped by an automatic commit.
+type OffsetTracker struct {
+	consumer offsetCommitter
+
+	mu         sync.Mutex
+	partitions map[string]*trackedPartition
+}
+
+// offsetCommitter is the part of a *kafka.Consumer that an OffsetTracker uses.
+type offsetCommitter interface {
+	StoreOffsets(offsets []kafka.TopicPartition) ([]kafka.TopicPartition, error)
+	Commit() ([]kafka.TopicPartition, error)
+}
+
+// trackedPartition holds the messages of a partition that were read but whose
+// offsets are not committed yet, in the order they were read.
+type trackedPartition struct {
+	messages []*trackedMessage
+}
+
+type trackedMessage struct {
+	partition kafka.TopicPartition
+	pending   int
+}
+
+// CreateTrackedConsumer creates a consumer whose offsets are only committed
+// through the returned OffsetTracker, and by StopConsumer.
+func CreateTrackedConsumer(configFile, groupId, offset string) (*kafka.Consumer, *OffsetTracker, error) {
+	kafkaConfig, err := GetKafkaConfiguration(configFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	kafkaConfig.SetKey("group.id", groupId)
+	kafkaConfig.SetKey("auto.offset.reset", offset)
+	kafkaConfig.SetKey("enable.auto.commit", false)
+	kafkaConfig.SetKey("enable.auto.offset.store", false)
+
+	consumer, err := kafka.NewConsumer(&kafkaConfig)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create consumer: %v", err)
+	}
+	return consumer, newOffsetTracker(consumer), nil
+}
+
+func newOffsetTracker(consumer offsetCommitter) *OffsetTracker {
+	return &OffsetTracker{consumer: consumer, partitions: map[string]*trackedPartition{}}
+}
+
+// Track registers a message that the given number of records were read from,
+// and returns the function to call once for each of them after it was
+// submitted, whether it succeeded or not. Records that fail are in the archive
+// and left to -reconcile. A message without records is committed with the
+// next one.
+func (t *OffsetTracker) Track(msg *kafka.Message, records int) func() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	key := partitionKey(msg.TopicPartition)
+	p, ok := t.partitions[key]
+	if !ok {
+		p = &trackedPartition{}
+		t.partitions[key] = p
+	}
+	if n := len(p.messages); n > 0 && p.messages[n-1].partition.Offset >= msg.TopicPartition.Offset {
+		// The partition was assigned again after a rebalance and is read
+		// from its committed offset, so the messages before are read again.
+		p.messages = nil
+	}
+	m := &trackedMessage{partition: msg.TopicPartition, pending: records}
+	p.messages = append(p.messages, m)
+	return func() { t.done(key, m) }
+}
+
+// done counts a record of a message as submitted. Once the messages at the
+// start of the partition have no records left, the offset after them is
+// stored and committed.
+func (t *OffsetTracker) done(key string, m *trackedMessage) {
+	t.mu.Lock()
+	m.pending--
+	p := t.partitions[key]
+	var last *trackedMessage
+	for len(p.messages) > 0 && p.messages[0].pending <= 0 {
+		last, p.messages = p.messages[0], p.messages[1:]
+	}
+	if last == nil {
+		t.mu.Unlock()
+		return
+	}
+	next := last.partition
+	next.Offset++
+	_, err := t.consumer.StoreOffsets([]kafka.TopicPartition{next})
+	t.mu.Unlock()
+	if err != nil {
+		Warn("failed to store offset", "topic", *next.Topic, "partition", next.Partition, "offset", int64(next.Offset), "error", err)
+		return
+	}
+
+	_, err = t.consumer.Commit()
+	var kafkaErr kafka.Error
+	if err != nil && !(errors.As(err, &kafkaErr) && kafkaErr.Code() == kafka.ErrNoOffset) {
+		Warn("failed to commit offsets", "error", err)
+	}
+}
@@ -0,0 +1,105 @@
+package lib
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// fakeCommitter records the offsets stored by an OffsetTracker.
+type fakeCommitter struct {
+	stored  []int64
+	commits int
+}
+
+func (c *fakeCommitter) StoreOffsets(offsets []kafka.TopicPartition) ([]kafka.TopicPartition, error) {
+	for _, tp := range offsets {
+		c.stored = append(c.stored, int64(tp.Offset))
+	}
+	return offsets, nil
+}
+
+func (c *fakeCommitter) Commit() ([]kafka.TopicPartition, error) {
+	c.commits++
+	return nil, nil
+}
+
+// trackStep either tracks the message at offset with records records, or,
+// when done is set, calls the done func of the tracked message at index done-1.
+type trackStep struct {
+	offset  int64
+	records int
+	done    int
+}
+
+func TestOffsetTracker(t *testing.T) {
+	tests := []struct {
+		name   string
+		steps  []trackStep
+		stored []int64
+	}{
+		{
+			name:   "in order",
+			steps:  []trackStep{{offset: 10, records: 1}, {offset: 11, records: 1}, {done: 1}, {done: 2}},
+			stored: []int64{11, 12},
+		},
+		{
+			name: "out of order",
+			steps: []trackStep{
+				{offset: 10, records: 1}, {offset: 11, records: 1}, {offset: 12, records: 1},
+				{done: 3}, {done: 2}, {done: 1},
+			},
+			stored: []int64{13},
+		},
+		{
+			name: "several records",
+			steps: []trackStep{
+				{offset: 10, records: 2}, {offset: 11, records: 1},
+				{done: 1}, {done: 2}, {done: 1},
+			},
+			stored: []int64{12},
+		},
+		{
+			name: "zero records",
+			steps: []trackStep{
+				{offset: 10, records: 1}, {offset: 11, records: 0}, {offset: 12, records: 0}, {offset: 13, records: 1},
+				{done: 1}, {done: 4},
+			},
+			stored: []int64{13, 14},
+		},
+		{
+			name: "rebalance",
+			steps: []trackStep{
+				{offset: 10, records: 1}, {offset: 11, records: 1},
+				// The partition is read again from its committed offset.
+				{offset: 10, records: 1}, {offset: 11, records: 1},
+				{done: 2}, {done: 1}, {done: 3}, {done: 4},
+			},
+			stored: []int64{11, 12},
+		},
+	}
+
+	topic := "sla"
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			committer := &fakeCommitter{}
+			tracker := newOffsetTracker(committer)
+			var dones []func()
+			for _, step := range tt.steps {
+				if step.done > 0 {
+					dones[step.done-1]()
+					continue
+				}
+				msg := &kafka.Message{TopicPartition: kafka.TopicPartition{Topic: &topic, Offset: kafka.Offset(step.offset)}}
+				dones = append(dones, tracker.Track(msg, step.records))
+			}
+			if !reflect.DeepEqual(committer.stored, tt.stored) {
+				t.Errorf("stored offsets %v, want %v", committer.stored, tt.stored)
+			}
+			if committer.commits != len(tt.stored) {
+				t.Errorf("committed %d times, want %d", committer.commits, len(tt.stored))
+			}
+		})
+	}
+}
@@ -0,0 +1,191 @@
+package lib
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/hyperledger/fabric-protos-go-apiv2/peer"
+)
+
+// Transaction is a unit of work for the submission Pipeline.
+type Transaction struct {
+	// Key orders the transactions. Transactions that share a key are
+	// committed one after the other, in the order they were queued.
+	Key      string
+	Contract *client.Contract
+	Name     string
+	Args     []string
+	// Prepare, if set, runs on the worker right before the transaction is
+	// submitted, so that its prerequisites keep the ordering of the key.
+	// Returning an error skips the submission.
+	Prepare func() error
+	// Done, if set, is called with the result of the transaction once it is
+	// committed, or with the error that stopped it, as a *ClassifiedError.
+	Done func(result []byte, err error)
+}
+
+// CommitFailedError reports a transaction that was ordered but marked as invalid by the peers.
+type CommitFailedError struct {
+	TransactionID string
+	Code          peer.TxValidationCode
+}
+
+func (e *CommitFailedError) Error() string {
+	return fmt.Sprintf("transaction %s failed to commit with status code %d (%s)",
+		e.TransactionID, int32(e.Code), peer.TxValidationCode_name[int32(e.Code)])
+}
+
+// Pipeline submits transactions asynchronously through a bounded pool of workers.
+// Every key is always handled by the same worker, which waits for the commit
+// status of a transaction before it moves on to the next one.
+type Pipeline struct {
+	queues []chan Transaction
+	wg     sync.WaitGroup
+
+	mu       sync.Mutex
+	inFlight map[string]*client.Commit
+}
+
+// NewPipeline starts a pipeline with the given number of workers. Each worker
+// queues up to queueSize transactions before Submit starts blocking.
+func NewPipeline(workers, queueSize int) *Pipeline {
+	if workers < 1 {
+		workers = 1
+	}
+	p := &Pipeline{
+		queues:   make([]chan Transaction, workers),
+		inFlight: make(map[string]*client.Commit),
+	}
+	for i := range p.queues {
+		p.queues[i] = make(chan Transaction, queueSize)
+		p.wg.Add(1)
+		go p.work(p.queues[i])
+	}
+	return p
+}
+
+func (p *Pipeline) Workers() int {
+	return len(p.queues)
+}
+
+// Shard returns the worker that handles the key.
+func (p *Pipeline) Shard(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % uint32(len(p.queues)))
+}
+
+// Submit queues the transaction on the worker of its key.
+// It blocks while the queue of that worker is full.
+func (p *Pipeline) Submit(tx Transaction) {
+	p.queues[p.Shard(tx.Key)] <- tx
+}
+
+// InFlight returns the IDs of the transactions that wait for their commit status.
+func (p *Pipeline) InFlight() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ids := make([]string, 0, len(p.inFlight))
+	for id := range p.inFlight {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Close stops accepting transactions and waits until the queued ones are done.
+func (p *Pipeline) Close() {
+	p.Drain(context.Background())
+}
+
+// Drain stops accepting transactions and waits until the queued ones are done,
+// or until ctx is done. In the latter case it returns the transactions that were
+// still waiting for their commit status; their result is unknown.
+func (p *Pipeline) Drain(ctx context.Context) error {
+	for _, queue := range p.queues {
+		close(queue)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("abandoned transactions %v: %w", p.InFlight(), ctx.Err())
+	}
+}
+
+func (p *Pipeline) work(queue chan Transaction) {
+	defer p.wg.Done()
+
+	for tx := range queue {
+		result, err := p.submit(tx)
+		if err != nil {
+			err = ClassifyError(err)
+		}
+		if tx.Done != nil {
+			tx.Done(result, err)
+		}
+	}
+}
+
+func (p *Pipeline) submit(tx Transaction) ([]byte, error) {
+	if tx.Prepare != nil {
+		err := tx.Prepare()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	proposal, err := tx.Contract.NewProposal(tx.Name, client.WithArguments(tx.Args...))
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	transaction, err := proposal.Endorse()
+	observePhase("endorse", start)
+	if err != nil {
+		return nil, err
+	}
+
+	start = time.Now()
+	commit, err := transaction.Submit()
+	observePhase("submit", start)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.inFlight[commit.TransactionID()] = commit
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		delete(p.inFlight, commit.TransactionID())
+		p.mu.Unlock()
+	}()
+
+	start = time.Now()
+	status, err := commit.Status()
+	observePhase("commit", start)
+	if err != nil {
+		return nil, err
+	}
+	if !status.Successful {
+		return nil, &CommitFailedError{TransactionID: status.TransactionID, Code: status.Code}
+	}
+	observeCommit()
+	return transaction.Result(), nil
+}
@@ -0,0 +1,139 @@
+package lib
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ReadConfig reads the Java properties file specified by configFile and
+// creates a map of its key-value pairs. ReadConfig returns the map on success,
+// or nil and an error
+func ReadConfig(configFile string) (map[string]string, error) {
+	file, err := os.Open(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	m, err := ParseProperties(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file %s: %v", configFile, err)
+	}
+	return m, nil
+}
+
+// ParseProperties parses the format of java.util.Properties: comments starting
+// with '#' or '!', keys separated from values by '=', ':' or whitespace, lines
+// continued with a trailing backslash, and backslash escapes including \uXXXX.
+func ParseProperties(r io.Reader) (map[string]string, error) {
+	m := make(map[string]string)
+
+	scanner := bufio.NewScanner(r)
+	lineNr := 0
+	for scanner.Scan() {
+		lineNr++
+		line := strings.TrimLeft(scanner.Text(), " \t\f")
+		if len(line) == 0 || line[0] == '#' || line[0] == '!' {
+			continue
+		}
+
+		// A line that ends in an odd number of backslashes continues on the next one.
+		start := lineNr
+		for endsWithContinuation(line) {
+			line = line[:len(line)-1]
+			if !scanner.Scan() {
+				break
+			}
+			lineNr++
+			line += strings.TrimLeft(scanner.Text(), " \t\f")
+		}
+
+		key, value := splitProperty(line)
+		key, err := unescapeProperty(key)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", start, err)
+		}
+		value, err = unescapeProperty(value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", start, err)
+		}
+		m[key] = value
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func endsWithContinuation(line string) bool {
+	backslashes := 0
+	for i := len(line) - 1; i >= 0 && line[i] == '\\'; i-- {
+		backslashes++
+	}
+	return backslashes%2 == 1
+}
+
+// splitProperty splits a logical line at the first unescaped separator.
+// The key and value are returned still escaped.
+func splitProperty(line string) (string, string) {
+	keyEnd := len(line)
+	for i := 0; i < len(line); i++ {
+		if line[i] == '\\' {
+			i++
+			continue
+		}
+		if line[i] == '=' || line[i] == ':' || line[i] == ' ' || line[i] == '\t' || line[i] == '\f' {
+			keyEnd = i
+			break
+		}
+	}
+
+	rest := strings.TrimLeft(line[keyEnd:], " \t\f")
+	if len(rest) > 0 && (rest[0] == '=' || rest[0] == ':') {
+		rest = strings.TrimLeft(rest[1:], " \t\f")
+	}
+	return line[:keyEnd], rest
+}
+
+func unescapeProperty(s string) (string, error) {
+	if !strings.Contains(s, "\\") {
+		return s, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 'f':
+			b.WriteByte('\f')
+		case 'u':
+			if len(s)-i-1 < 4 {
+				return "", fmt.Errorf("malformed \\uXXXX escape in %q", s)
+			}
+			r, err := strconv.ParseUint(s[i+1:i+5], 16, 16)
+			if err != nil {
+				return "", fmt.Errorf("malformed \\uXXXX escape in %q", s)
+			}
+			b.WriteRune(rune(r))
+			i += 4
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,442 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+)
+
+// ReconcileItem is a record that differs between the local archive and the ledger.
+type ReconcileItem struct {
+	Key    string `json:"key"`
+	Detail string `json:"detail,omitempty"`
+	// Records holds the archived records of the key, so that missing
+	// items can be submitted again.
+	Records []json.RawMessage `json:"-"`
+}
+
+// ReconcileReport lists the differences between a local archive and the ledger.
+// Missing records are archived but not on the ledger, divergent ones are on
+// both but differ, and extra ones are on the ledger but not in the archive.
+type ReconcileReport struct {
+	Archive   string          `json:"archive"`
+	Checked   int             `json:"checked"`
+	Missing   []ReconcileItem `json:"missing"`
+	Divergent []ReconcileItem `json:"divergent"`
+	Extra     []ReconcileItem `json:"extra"`
+}
+
+// Consistent reports whether the archive and the ledger agree.
+func (r *ReconcileReport) Consistent() bool {
+	return len(r.Missing) == 0 && len(r.Divergent) == 0 && len(r.Extra) == 0
+}
+
+// Print writes a human readable summary of the report to w.
+func (r *ReconcileReport) Print(w io.Writer) {
+	fmt.Fprintf(w, "%s: %d checked, %d missing, %d divergent, %d extra\n",
+		r.Archive, r.Checked, len(r.Missing), len(r.Divergent), len(r.Extra))
+	for _, section := range []struct {
+		name  string
+		items []ReconcileItem
+	}{{"missing", r.Missing}, {"divergent", r.Divergent}, {"extra", r.Extra}} {
+		for _, item := range section.items {
+			if item.Detail == "" {
+				fmt.Fprintf(w, "  %-9s %s\n", section.name, item.Key)
+			} else {
+				fmt.Fprintf(w, "  %-9s %s: %s\n", section.name, item.Key, item.Detail)
+			}
+		}
+	}
+}
+
+// SLALedger gives access to the chaincodes that store the SLAs.
+type SLALedger struct {
+	// Contract returns the contract that stores the SLA.
+	Contract func(slaID string) *client.Contract
+	// IDs, if set, lists the SLAs on the ledger. It finds the SLAs missing
+	// from the archive, and the SLAs it does not list are not queried.
+	IDs func() ([]string, error)
+}
+
+// ledgerSLA is the part of the contract stored by the SLA chaincode that is reconciled.
+type ledgerSLA struct {
+	SLA
+	TotalViolations []int `json:"TotalViolations"`
+	DailyViolations []int `json:"DailyViolations"`
+}
+
+func (c ledgerSLA) violations() int {
+	n := 0
+	for _, v := range c.TotalViolations {
+		n += v
+	}
+	for _, v := range c.DailyViolations {
+		n += v
+	}
+	return n
+}
+
+// ReconcileSLAs compares the SLAs in the archive at path with the ledger.
+// An SLA that was archived several times is compared with its latest version.
+func ReconcileSLAs(path string, ledger SLALedger) (*ReconcileReport, error) {
+	report := &ReconcileReport{Archive: path}
+
+	latest := make(map[string]SLA)
+	records := make(map[string][]json.RawMessage)
+	var order []string
+	err := ReadArchive(path, func(record json.RawMessage) error {
+		var sla SLA
+		if err := json.Unmarshal(record, &sla); err != nil {
+			return err
+		}
+		if _, ok := latest[sla.ID]; !ok {
+			order = append(order, sla.ID)
+		}
+		latest[sla.ID] = sla
+		records[sla.ID] = append(records[sla.ID], record)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	onLedger, err := ledger.ids()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range order {
+		report.Checked++
+		contract, found, err := ledger.read(onLedger, id)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			report.Missing = append(report.Missing, ReconcileItem{Key: id, Records: records[id]})
+			continue
+		}
+		if diff := jsonDiff(latest[id], contract.SLA); diff != "" {
+			report.Divergent = append(report.Divergent, ReconcileItem{Key: id, Detail: diff, Records: records[id]})
+		}
+	}
+
+	if onLedger != nil {
+		for _, id := range sortedKeys(onLedger) {
+			if _, ok := latest[id]; !ok {
+				report.Extra = append(report.Extra, ReconcileItem{Key: id})
+			}
+		}
+	}
+	return report, nil
+}
+
+// ReconcileViolations compares the violations in the archive at path with the
+// counters of their SLAs on the ledger. Since the ledger only counts the
+// violations of an SLA, the violations are missing only if their SLA is.
+func ReconcileViolations(path string, ledger SLALedger) (*ReconcileReport, error) {
+	report := &ReconcileReport{Archive: path}
+
+	seen := make(map[string]bool)
+	bySLA := make(map[string][]json.RawMessage)
+	var order []string
+	err := ReadArchive(path, func(record json.RawMessage) error {
+		var v Violation
+		if err := json.Unmarshal(record, &v); err != nil {
+			return err
+		}
+		// A violation that was delivered twice is archived twice.
+		if seen[v.ID] {
+			return nil
+		}
+		seen[v.ID] = true
+		if _, ok := bySLA[v.SLAID]; !ok {
+			order = append(order, v.SLAID)
+		}
+		bySLA[v.SLAID] = append(bySLA[v.SLAID], record)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	onLedger, err := ledger.ids()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range order {
+		archived := bySLA[id]
+		report.Checked += len(archived)
+		contract, found, err := ledger.read(onLedger, id)
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			report.Missing = append(report.Missing, ReconcileItem{
+				Key: id, Detail: fmt.Sprintf("SLA is not on the ledger, %d violations", len(archived)), Records: archived,
+			})
+			continue
+		}
+
+		counted := contract.violations()
+		switch {
+		case counted < len(archived):
+			report.Divergent = append(report.Divergent, ReconcileItem{
+				Key: id, Detail: fmt.Sprintf("%d violations archived, %d counted on the ledger", len(archived), counted), Records: archived,
+			})
+		case counted > len(archived):
+			report.Extra = append(report.Extra, ReconcileItem{
+				Key: id, Detail: fmt.Sprintf("%d violations archived, %d counted on the ledger", len(archived), counted),
+			})
+		}
+	}
+	return report, nil
+}
+
+// ids returns the set of SLAs on the ledger, or nil if the ledger cannot list them.
+func (ledger SLALedger) ids() (map[string]bool, error) {
+	if ledger.IDs == nil {
+		return nil, nil
+	}
+	ids, err := ledger.IDs()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the SLAs on the ledger: %w", err)
+	}
+	set := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		set[id] = true
+	}
+	return set, nil
+}
+
+// read returns the SLA from the ledger. An SLA that is not listed on the
+// ledger is not queried, since its chaincode may not exist.
+func (ledger SLALedger) read(onLedger map[string]bool, id string) (*ledgerSLA, bool, error) {
+	if onLedger != nil && !onLedger[id] {
+		return nil, false, nil
+	}
+
+	contract := ledger.Contract(id)
+	result, err := contract.EvaluateTransaction("ContractExists", id)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to check SLA %s: %w", id, err)
+	}
+	if exists, _ := strconv.ParseBool(string(result)); !exists {
+		return nil, false, nil
+	}
+
+	result, err = contract.EvaluateTransaction("ReadContract", id)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read SLA %s: %w", id, err)
+	}
+	var sla ledgerSLA
+	if err = json.Unmarshal(result, &sla); err != nil {
+		return nil, false, fmt.Errorf("failed to unmarshal SLA %s: %w", id, err)
+	}
+	return &sla, true, nil
+}
+
+// SLAIDs lists the SLAs stored by an SLA chaincode.
+func SLAIDs(contract *client.Contract) ([]string, error) {
+	result, err := contract.EvaluateTransaction("GetAllContracts")
+	if err != nil {
+		return nil, err
+	}
+	var contracts []ledgerSLA
+	if len(result) > 0 {
+		if err = json.Unmarshal(result, &contracts); err != nil {
+			return nil, err
+		}
+	}
+	ids := make([]string, len(contracts))
+	for i, c := range contracts {
+		ids[i] = c.ID
+	}
+	return ids, nil
+}
+
+// ledgerVRU is the record stored by the VRU chaincode for a timestamp.
+type ledgerVRU struct {
+	Timestamp int64    `json:"timestamp"`
+	Trams     []Tram_s `json:"trams"`
+	OBUs      []OBU_s  `json:"obus"`
+}
+
+// ReconcileVRUs compares the VRU records in the archive at path with the ledger.
+// The chaincode merges the records of a timestamp, so each timestamp is
+// compared by the number of trams and OBUs stored for it.
+func ReconcileVRUs(path string, contract *client.Contract) (*ReconcileReport, error) {
+	report := &ReconcileReport{Archive: path}
+
+	archived := make(map[string]*ledgerVRU)
+	records := make(map[string][]json.RawMessage)
+	err := ReadArchive(path, func(record json.RawMessage) error {
+		var vru VRU
+		if err := json.Unmarshal(record, &vru); err != nil {
+			return err
+		}
+		key := strconv.FormatInt(vru.Timestamp, 10)
+		if archived[key] == nil {
+			archived[key] = &ledgerVRU{Timestamp: vru.Timestamp}
+		}
+		archived[key].Trams = append(archived[key].Trams, vru.Tram)
+		archived[key].OBUs = append(archived[key].OBUs, vru.OBUs...)
+		records[key] = append(records[key], record)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(archived) == 0 {
+		return report, nil
+	}
+
+	var first, last int64
+	for _, vru := range archived {
+		if first == 0 || vru.Timestamp < first {
+			first = vru.Timestamp
+		}
+		if vru.Timestamp > last {
+			last = vru.Timestamp
+		}
+	}
+	result, err := contract.EvaluateTransaction("GetAssetByRange",
+		strconv.FormatInt(first, 10), strconv.FormatInt(last+1, 10))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the VRU records: %w", err)
+	}
+	var stored []ledgerVRU
+	if len(result) > 0 {
+		if err = json.Unmarshal(result, &stored); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal the VRU records: %w", err)
+		}
+	}
+	onLedger := make(map[string]ledgerVRU, len(stored))
+	for _, vru := range stored {
+		onLedger[strconv.FormatInt(vru.Timestamp, 10)] = vru
+	}
+
+	for _, key := range sortedKeys(archived) {
+		report.Checked++
+		want := archived[key]
+		got, ok := onLedger[key]
+		if !ok {
+			report.Missing = append(report.Missing, ReconcileItem{Key: key, Records: records[key]})
+			continue
+		}
+		if len(got.Trams) != len(want.Trams) || len(got.OBUs) != len(want.OBUs) {
+			report.Divergent = append(report.Divergent, ReconcileItem{
+				Key: key,
+				Detail: fmt.Sprintf("%d trams and %d OBUs archived, %d and %d on the ledger",
+					len(want.Trams), len(want.OBUs), len(got.Trams), len(got.OBUs)),
+				Records: records[key],
+			})
+		}
+	}
+	for _, key := range sortedKeys(onLedger) {
+		if _, ok := archived[key]; !ok {
+			report.Extra = append(report.Extra, ReconcileItem{Key: key})
+		}
+	}
+	return report, nil
+}
+
+// ReconcileParts compares the parts in the archive at path with the ledger.
+// The chaincode keeps the first part stored for a timestamp, so that is the
+// one compared.
+func ReconcileParts(path string, contract *client.Contract) (*ReconcileReport, error) {
+	report := &ReconcileReport{Archive: path}
+
+	archived := make(map[string]Part)
+	records := make(map[string][]json.RawMessage)
+	err := ReadArchive(path, func(record json.RawMessage) error {
+		var part Part
+		if err := json.Unmarshal(record, &part); err != nil {
+			return err
+		}
+		if _, ok := archived[part.Timestamp]; !ok {
+			archived[part.Timestamp] = part
+		}
+		records[part.Timestamp] = append(records[part.Timestamp], record)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(archived) == 0 {
+		return report, nil
+	}
+
+	keys := sortedKeys(archived)
+	// The range end is exclusive, so it is placed right after the last key.
+	result, err := contract.EvaluateTransaction("GetAssetByRange", keys[0], keys[len(keys)-1]+"\x00")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the parts: %w", err)
+	}
+	var stored []Part
+	if len(result) > 0 {
+		if err = json.Unmarshal(result, &stored); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal the parts: %w", err)
+		}
+	}
+	onLedger := make(map[string]Part, len(stored))
+	for _, part := range stored {
+		onLedger[part.Timestamp] = part
+	}
+
+	for _, key := range keys {
+		report.Checked++
+		got, ok := onLedger[key]
+		if !ok {
+			report.Missing = append(report.Missing, ReconcileItem{Key: key, Records: records[key][:1]})
+			continue
+		}
+		if diff := jsonDiff(archived[key], got); diff != "" {
+			report.Divergent = append(report.Divergent, ReconcileItem{Key: key, Detail: diff})
+		}
+	}
+	for _, key := range sortedKeys(onLedger) {
+		if _, ok := archived[key]; !ok {
+			report.Extra = append(report.Extra, ReconcileItem{Key: key})
+		}
+	}
+	return report, nil
+}
+
+// jsonDiff returns the top-level fields whose JSON encoding differs between a and b.
+func jsonDiff(a, b interface{}) string {
+	var fieldsA, fieldsB map[string]json.RawMessage
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	if bytes.Equal(ja, jb) {
+		return ""
+	}
+	json.Unmarshal(ja, &fieldsA)
+	json.Unmarshal(jb, &fieldsB)
+
+	var diff []string
+	for field, value := range fieldsA {
+		if !bytes.Equal(value, fieldsB[field]) {
+			diff = append(diff, field)
+		}
+	}
+	for field := range fieldsB {
+		if _, ok := fieldsA[field]; !ok {
+			diff = append(diff, field)
+		}
+	}
+	sort.Strings(diff)
+	return fmt.Sprintf("fields %v differ", diff)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,213 @@
+package lib
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/client"
+	"github.com/robfig/cron/v3"
+)
+
+// RefundConfig schedules the settlement of the refunds of the SLAs.
+type RefundConfig struct {
+	// Schedule is a cron expression with five fields, or a descriptor such
+	// as @midnight or @every 12h. Every time it fires, a period ends.
+	Schedule string `yaml:"schedule" env:"refund_schedule"`
+	// Timezone is the location of the schedule, e.g. Europe/Athens, or Local.
+	Timezone string `yaml:"timezone" env:"refund_timezone"`
+	// PageSize is how many SLAs are settled per transaction.
+	PageSize int `yaml:"pageSize" env:"refund_page_size"`
+	// Lease elects the replica that settles the refunds.
+	Lease LeaseConfig `yaml:"lease"`
+}
+
+// LeaseConfig names the Kubernetes Lease that elects the one replica of a
+// client that runs a job. Without a name, every replica runs it.
+type LeaseConfig struct {
+	Name      string `yaml:"name" env:"refund_lease"`
+	Namespace string `yaml:"namespace" env:"refund_lease_namespace"`
+	// Kubeconfig is the kubeconfig file to connect with. The client connects
+	// from inside the cluster if it is empty.
+	Kubeconfig string `yaml:"kubeconfig" env:"refund_lease_kubeconfig"`
+	// Duration is how long the lease lasts without being renewed.
+	Duration time.Duration `yaml:"duration" env:"refund_lease_duration"`
+}
+
+func (r RefundConfig) validate() []string {
+	var problems []string
+	if _, err := cron.ParseStandard(r.Schedule); err != nil {
+		problems = append(problems, fmt.Sprintf("refunds.schedule: %v", err))
+	}
+	if _, err := time.LoadLocation(r.Timezone); err != nil {
+		problems = append(problems, fmt.Sprintf("refunds.timezone: %v", err))
+	}
+	if r.PageSize < 1 {
+		problems = append(problems, "refunds.pageSize must be positive")
+	}
+	if r.Lease.Name != "" && r.Lease.Duration < time.Second {
+		problems = append(problems, "refunds.lease.duration must be at least a second")
+	}
+	return problems
+}
+
+// RefundScheduler settles the refunds of the SLAs every time a period of the
+// schedule ends. Every contract records on its ledger the end of the last
+// period it settled, so that the periods missed while the client was down are
+// caught up when it starts. The refunds of an SLA accumulate until they are
+// settled, so settling the latest missed period settles the earlier ones too.
+type RefundScheduler struct {
+	schedule  cron.Schedule
+	location  *time.Location
+	pageSize  int
+	contracts func() ([]*client.Contract, error)
+}
+
+// refundBatch is the outcome of a batch of settlements, as the SLA chaincode
+// returns it.
+type refundBatch struct {
+	Outcomes []struct {
+		SLAID  string `json:"slaId"`
+		Status string `json:"status"`
+		Error  string `json:"error"`
+	} `json:"outcomes"`
+	Bookmark string `json:"bookmark"`
+}
+
+// NewRefundScheduler creates a RefundScheduler that settles the refunds of the
+// contracts, which are listed again for every period.
+func NewRefundScheduler(conf RefundConfig, contracts func() ([]*client.Contract, error)) (*RefundScheduler, error) {
+	schedule, err := cron.ParseStandard(conf.Schedule)
+	if err != nil {
+		return nil, err
+	}
+	location, err := time.LoadLocation(conf.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	return &RefundScheduler{schedule: schedule, location: location, pageSize: conf.PageSize, contracts: contracts}, nil
+}
+
+// Run catches up with the periods missed and settles every period as it
+// ends, until ctx is done. A settlement that started is finished first.
+func (r *RefundScheduler) Run(ctx context.Context) {
+	r.settleAll(time.Time{})
+	for {
+		next := r.schedule.Next(time.Now().In(r.location))
+		if next.IsZero() {
+			Warn("refund schedule never fires again")
+			<-ctx.Done()
+			return
+		}
+		Info("scheduled refunds", "next", next)
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		r.settleAll(next)
+	}
+}
+
+// settleAll settles the refunds of every contract. ended is the end of the
+// period that just ended, or zero when catching up.
+func (r *RefundScheduler) settleAll(ended time.Time) {
+	start := time.Now()
+	contracts, err := r.contracts()
+	if err != nil {
+		Error("failed to list the contracts to refund", "error", err)
+		ObserveRefundRun(start, err)
+		return
+	}
+
+	var failed int
+	for _, contract := range contracts {
+		if err := r.settle(contract, ended); err != nil {
+			Error("failed to settle refunds", "contract", contract.ChaincodeName(), "error", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		err = fmt.Errorf("%d of %d contracts failed to settle refunds", failed, len(contracts))
+	}
+	ObserveRefundRun(start, err)
+}
+
+// settle settles the latest period of the contract that ended, if it was
+// not settled yet, one batch of SLAs at a time. The SLAs that fail are
+// logged and settled with a later period.
+func (r *RefundScheduler) settle(contract *client.Contract, ended time.Time) error {
+	result, err := contract.EvaluateTransaction("LastSettledPeriod")
+	if err != nil {
+		return err
+	}
+	due, missed, err := r.due(string(result), ended, time.Now())
+	if err != nil || due.IsZero() {
+		return err
+	}
+	if missed > 1 {
+		Warn("catching up with missed refund periods", "contract", contract.ChaincodeName(), "periods", missed, "last_settled", string(result))
+	}
+
+	periodEnd := due.UTC().Format(time.RFC3339)
+	var settled, failed int
+	for {
+		Info("submitting transaction", "name", "SettleRefunds", "contract", contract.ChaincodeName(), "period_end", periodEnd)
+		result, err := contract.SubmitTransaction("SettleRefunds", periodEnd, strconv.Itoa(r.pageSize))
+		if err != nil {
+			return err
+		}
+		var batch refundBatch
+		if err = json.Unmarshal(result, &batch); err != nil {
+			return fmt.Errorf("invalid refund batch: %w", err)
+		}
+		for _, outcome := range batch.Outcomes {
+			switch outcome.Status {
+			case "refunded":
+				settled++
+			case "failed":
+				failed++
+				Error("failed to settle SLA", "contract", contract.ChaincodeName(), "sla_id", outcome.SLAID, "error", outcome.Error)
+			}
+		}
+		if batch.Bookmark == "" {
+			break
+		}
+	}
+
+	Info("settled refunds", "contract", contract.ChaincodeName(), "period_end", periodEnd, "settled", settled, "failed", failed)
+	if failed > 0 {
+		return fmt.Errorf("%d SLAs failed to settle", failed)
+	}
+	return nil
+}
+
+// due returns the end of the latest period that ended by now after the last
+// settled one, and how many periods ended since. Without a settled period,
+// only the period that just ended is due.
+func (r *RefundScheduler) due(last string, ended, now time.Time) (time.Time, int, error) {
+	if last == "" {
+		if ended.IsZero() {
+			return time.Time{}, 0, nil
+		}
+		return ended, 1, nil
+	}
+	lastEnd, err := time.Parse(time.RFC3339, last)
+	if err != nil {
+		return time.Time{}, 0, fmt.Errorf("invalid last settled period %q: %w", last, err)
+	}
+
+	var due time.Time
+	var missed int
+	// Next returns zero if the schedule never fires again.
+	for t := r.schedule.Next(lastEnd.In(r.location)); !t.IsZero() && !t.After(now); t = r.schedule.Next(t) {
+		due = t
+		missed++
+	}
+	return due, missed, nil
+}
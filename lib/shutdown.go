@@ -0,0 +1,121 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/confluentinc/confluent-kafka-go/kafka"
+)
+
+// Shutdown coordinates the graceful stop of a client. Its context is cancelled
+// on SIGINT or SIGTERM, which tells the main loop to stop consuming; Stop then
+// runs the registered steps within a deadline.
+type Shutdown struct {
+	ctx     context.Context
+	cancel  context.CancelFunc
+	timeout time.Duration
+
+	mu    sync.Mutex
+	steps []shutdownStep
+	once  sync.Once
+}
+
+type shutdownStep struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+// NewShutdown creates a Shutdown whose steps must complete within timeout.
+func NewShutdown(timeout time.Duration) *Shutdown {
+	ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	return &Shutdown{ctx: ctx, cancel: cancel, timeout: timeout}
+}
+
+// Context is cancelled once the client starts shutting down.
+func (s *Shutdown) Context() context.Context {
+	return s.ctx
+}
+
+// Done is closed once the client starts shutting down.
+func (s *Shutdown) Done() <-chan struct{} {
+	return s.ctx.Done()
+}
+
+// Check is a HealthCheck that fails once the client starts shutting down, so
+// that no new work is routed to it.
+func (s *Shutdown) Check() error {
+	if s.ctx.Err() != nil {
+		return errors.New("shutting down")
+	}
+	return nil
+}
+
+// OnStop registers a step of the shutdown. Like deferred calls, the steps run
+// in the reverse order of their registration, so a resource registered right
+// after it is created is released after everything that depends on it.
+func (s *Shutdown) OnStop(name string, fn func(ctx context.Context) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.steps = append(s.steps, shutdownStep{name: name, fn: fn})
+}
+
+// OnClose registers a step that closes c.
+func (s *Shutdown) OnClose(name string, c io.Closer) {
+	s.OnStop(name, func(context.Context) error {
+		return c.Close()
+	})
+}
+
+// Stop cancels the context and runs the steps. A step that fails or runs out
+// of time is logged and the next steps still run, so that files are closed
+// either way. A second signal during Stop kills the process.
+func (s *Shutdown) Stop() {
+	s.once.Do(func() {
+		s.cancel()
+		Info("shutting down", "timeout", s.timeout)
+
+		ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+		defer cancel()
+
+		s.mu.Lock()
+		steps := s.steps
+		s.mu.Unlock()
+
+		start := time.Now()
+		for i := len(steps) - 1; i >= 0; i-- {
+			step := steps[i]
+			if err := step.fn(ctx); err != nil {
+				Error("shutdown step failed", "step", step.name, "error", err)
+				continue
+			}
+			Debug("shutdown step done", "step", step.name)
+		}
+		Info("shut down", "duration", time.Since(start))
+	})
+}
+
+// StopConsumer returns a shutdown step that commits the offsets of the consumer
+// and closes it. The step can be called more than once.
+func StopConsumer(consumer *kafka.Consumer) func(ctx context.Context) error {
+	var once sync.Once
+	var err error
+	return func(context.Context) error {
+		once.Do(func() {
+			_, commitErr := consumer.Commit()
+			var kafkaErr kafka.Error
+			if commitErr != nil && !(errors.As(commitErr, &kafkaErr) && kafkaErr.Code() == kafka.ErrNoOffset) {
+				err = fmt.Errorf("failed to commit offsets: %w", commitErr)
+			}
+			if closeErr := consumer.Close(); closeErr != nil && err == nil {
+				err = fmt.Errorf("failed to close consumer: %w", closeErr)
+			}
+		})
+		return err
+	}
+}
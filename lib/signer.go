@@ -0,0 +1,248 @@
+package lib
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hyperledger/fabric-gateway/pkg/identity"
+	"github.com/youmark/pkcs8"
+)
+
+// Signer signs the transaction digests of a client identity.
+type Signer interface {
+	Sign(digest []byte) ([]byte, error)
+	// Close releases the key, its session or its connection.
+	Close() error
+}
+
+// SignerConfig selects where the private key of the client identity is kept.
+// The certificate and MSP ID are always read from the wallet, which needs to
+// hold the private key only for the wallet signer.
+type SignerConfig struct {
+	// Type is one of wallet, pem, pkcs11 or remote.
+	Type string `yaml:"type" env:"signer_type"`
+	// KeyPath is the PEM private key of the pem signer. It may be encrypted,
+	// in which case the password is read from PasswordFile.
+	KeyPath      string       `yaml:"keyPath" env:"signer_key_path"`
+	PasswordFile string       `yaml:"passwordFile" env:"signer_password_file"`
+	PKCS11       PKCS11Config `yaml:"pkcs11"`
+	// Socket is the unix socket of the remote signer.
+	Socket string `yaml:"socket" env:"signer_socket"`
+}
+
+// PKCS11Config locates the key of the pkcs11 signer in an HSM.
+type PKCS11Config struct {
+	Library string `yaml:"library" env:"pkcs11_library"`
+	Label   string `yaml:"label" env:"pkcs11_label"`
+	Pin     string `yaml:"pin" env:"pkcs11_pin"`
+	// Identifier is the hex encoded CKA_ID of the key. It defaults to the
+	// subject key identifier of the certificate, as used by the Fabric tools.
+	Identifier string `yaml:"identifier" env:"pkcs11_identifier"`
+}
+
+var signerTypes = toSet("wallet", "pem", "pkcs11", "remote")
+
+func (s SignerConfig) validate() []string {
+	var problems []string
+	switch s.Type {
+	case "pem":
+		if s.KeyPath == "" {
+			problems = append(problems, "signer.keyPath is required by the pem signer")
+		}
+	case "pkcs11":
+		if s.PKCS11.Library == "" || s.PKCS11.Label == "" || s.PKCS11.Pin == "" {
+			problems = append(problems, "signer.pkcs11 library, label and pin are required by the pkcs11 signer")
+		}
+	case "remote":
+		if s.Socket == "" {
+			problems = append(problems, "signer.socket is required by the remote signer")
+		}
+	}
+	if !signerTypes[s.Type] {
+		problems = append(problems, fmt.Sprintf("signer.type: invalid value %q", s.Type))
+	}
+	return problems
+}
+
+// NewSigner creates the signer selected by the configuration.
+func NewSigner(conf Config) (Signer, error) {
+	switch conf.Signer.Type {
+	case "", "wallet":
+		return newPEMSigner([]byte(conf.UserConf.Credentials.PrivateKey), nil)
+	case "pem":
+		keyPEM, err := os.ReadFile(conf.Signer.KeyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read private key: %w", err)
+		}
+		var password []byte
+		if conf.Signer.PasswordFile != "" {
+			password, err = os.ReadFile(conf.Signer.PasswordFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read private key password: %w", err)
+			}
+			password = []byte(strings.TrimRight(string(password), "\r\n"))
+		}
+		return newPEMSigner(keyPEM, password)
+	case "pkcs11":
+		certificate, err := identity.CertificateFromPEM([]byte(conf.UserConf.Credentials.Certificate))
+		if err != nil {
+			return nil, err
+		}
+		return newPKCS11Signer(conf.Signer.PKCS11, certificate)
+	case "remote":
+		return &remoteSigner{socket: conf.Signer.Socket}, nil
+	}
+	return nil, fmt.Errorf("unknown signer %q", conf.Signer.Type)
+}
+
+// signFunc adapts the signing functions of the fabric-gateway identity package.
+type signFunc struct {
+	sign  identity.Sign
+	close func() error
+}
+
+func (s signFunc) Sign(digest []byte) ([]byte, error) {
+	return s.sign(digest)
+}
+
+func (s signFunc) Close() error {
+	if s.close == nil {
+		return nil
+	}
+	return s.close()
+}
+
+// newPEMSigner signs with a PEM private key, which is decrypted with password
+// if it is a legacy encrypted PEM block or an encrypted PKCS #8 key.
+func newPEMSigner(keyPEM, password []byte) (Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("failed to parse private key PEM")
+	}
+
+	var privateKey crypto.PrivateKey
+	var err error
+	switch {
+	case block.Type == "ENCRYPTED PRIVATE KEY":
+		if password == nil {
+			return nil, errors.New("the private key is encrypted, but no password is set")
+		}
+		privateKey, err = pkcs8.ParsePKCS8PrivateKey(block.Bytes, password)
+	case x509.IsEncryptedPEMBlock(block):
+		if password == nil {
+			return nil, errors.New("the private key is encrypted, but no password is set")
+		}
+		var der []byte
+		// Legacy encrypted keys, as written by openssl without -topk8.
+		der, err = x509.DecryptPEMBlock(block, password)
+		if err == nil {
+			privateKey, err = parsePrivateKey(der)
+		}
+	default:
+		privateKey, err = parsePrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	sign, err := identity.NewPrivateKeySign(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	return signFunc{sign: sign}, nil
+}
+
+func parsePrivateKey(der []byte) (crypto.PrivateKey, error) {
+	if key, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	return nil, errors.New("unsupported private key type")
+}
+
+// remoteSigner sends the digests to a signing service on a unix socket. Each
+// request and response is a line of JSON: {"digest": "<base64>"} is answered
+// with {"signature": "<base64>"} or {"error": "<message>"}.
+type remoteSigner struct {
+	socket string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+type remoteSignRequest struct {
+	Digest []byte `json:"digest"`
+}
+
+type remoteSignResponse struct {
+	Signature []byte `json:"signature"`
+	Error     string `json:"error"`
+}
+
+func (s *remoteSigner) Sign(digest []byte) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	signature, err := s.sign(digest)
+	if err != nil && s.conn != nil {
+		// The connection may be broken, so the next request opens a new one.
+		s.conn.Close()
+		s.conn = nil
+	}
+	return signature, err
+}
+
+func (s *remoteSigner) sign(digest []byte) ([]byte, error) {
+	if s.conn == nil {
+		conn, err := net.DialTimeout("unix", s.socket, 5*time.Second)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to the remote signer: %w", err)
+		}
+		s.conn = conn
+		s.reader = bufio.NewReader(conn)
+	}
+	s.conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	request, _ := json.Marshal(remoteSignRequest{Digest: digest})
+	if _, err := s.conn.Write(append(request, '\n')); err != nil {
+		return nil, fmt.Errorf("failed to send digest to the remote signer: %w", err)
+	}
+	line, err := s.reader.ReadBytes('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signature from the remote signer: %w", err)
+	}
+
+	var response remoteSignResponse
+	if err = json.Unmarshal(line, &response); err != nil {
+		return nil, fmt.Errorf("invalid response from the remote signer: %w", err)
+	}
+	if response.Error != "" {
+		return nil, fmt.Errorf("remote signer: %s", response.Error)
+	}
+	return response.Signature, nil
+}
+
+func (s *remoteSigner) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
@@ -0,0 +1,12 @@
+//go:build !pkcs11
+
+package lib
+
+import (
+	"crypto/x509"
+	"errors"
+)
+
+func newPKCS11Signer(PKCS11Config, *x509.Certificate) (Signer, error) {
+	return nil, errors.New("the pkcs11 signer needs a client built with -tags pkcs11")
+}
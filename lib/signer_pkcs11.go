@@ -0,0 +1,56 @@
+//go:build pkcs11
+
+package lib
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"github.com/hyperledger/fabric-gateway/pkg/identity"
+)
+
+// newPKCS11Signer signs with a key kept in an HSM, through its PKCS #11 library.
+func newPKCS11Signer(conf PKCS11Config, certificate *x509.Certificate) (Signer, error) {
+	var id []byte
+	if conf.Identifier != "" {
+		var err error
+		if id, err = hex.DecodeString(conf.Identifier); err != nil {
+			return nil, fmt.Errorf("signer.pkcs11.identifier is not hexadecimal: %w", err)
+		}
+	} else {
+		publicKey, ok := certificate.PublicKey.(*ecdsa.PublicKey)
+		if !ok {
+			return nil, errors.New("the certificate does not hold an ECDSA public key, set signer.pkcs11.identifier")
+		}
+		// The subject key identifier the Fabric tools give the keys they store in an HSM.
+		ski := sha256.Sum256(elliptic.Marshal(publicKey.Curve, publicKey.X, publicKey.Y))
+		id = ski[:]
+	}
+
+	factory, err := identity.NewHSMSignerFactory(conf.Library)
+	if err != nil {
+		return nil, err
+	}
+	sign, closeSign, err := factory.NewHSMSigner(identity.HSMSignerOptions{
+		Label:      conf.Label,
+		Pin:        conf.Pin,
+		Identifier: string(id),
+	})
+	if err != nil {
+		factory.Dispose()
+		return nil, err
+	}
+	return signFunc{
+		sign: sign,
+		close: func() error {
+			err := closeSign()
+			factory.Dispose()
+			return err
+		},
+	}, nil
+}
@@ -6,6 +6,9 @@ type SLA struct {
 	State      string     `json:"state"`
 	Assessment Assessment `json:"assessment"`
 	Details    Detail     `json:"details"`
+	// Billing is how often the refunds of the SLA are settled: daily, the
+	// default, weekly or monthly.
+	Billing string `json:"billing,omitempty"`
 }
 
 type Detail struct {
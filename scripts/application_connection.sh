@@ -191,6 +191,7 @@ data:
   fabric_org4_gateway_sslHostOverride: org4-peer-gateway-svc
 
   identity_endpoint: http://identity-management:8000
+  sla2_registry_endpoint: http://sla-2-client:8081
 EOF
 
   kubectl -n "$NS" apply -f "build/app-fabric-api-v1-map.yaml"
@@ -204,16 +205,10 @@ function deploy_api() {
     TAG="$(random_chars 5)"
   fi
   push_fn "Building and deploying API"
-  cp -r "${TEMP_DIR}/enrollments/org4/users/org4admin/msp" ./application/api/msp
-  cp config/org4/core.yaml ./application/api/core.yaml
-
   docker build -t "${CONTAINER_REGISTRY_ADDRESS}/api:$TAG" application/api
   docker push "${CONTAINER_REGISTRY_ADDRESS}/api:$TAG"
 
   envsubst <kube/api-deployment.yaml | kubectl -n "$NS" apply -f -
-
-  rm -r ./application/api/msp
-  rm ./application/api/core.yaml
   pop_fn
 }
 
@@ -423,8 +418,6 @@ EOF
   cp config/kafka/kafka.client.truststore.jks application/sla_2.0_client/
   cp config/kafka/server.cer.pem application/sla_2.0_client/
 
-  cp -r config/org4/ application/sla_2.0_client/config
-
   cp -r ${TEMP_DIR}/enrollments/org4/users/org4admin/msp application/sla_2.0_client/msp
 
   cp ${TEMP_DIR}/channel-msp/ordererOrganizations/org0/orderers/org0-orderer1/tls/signcerts/tls-cert.pem application/sla_2.0_client/orderer-cert.pem
@@ -434,7 +427,7 @@ EOF
   construct_application_configmap 4
   push_fn "Creating and deploying container"
 
-  docker build -t "${CONTAINER_REGISTRY_ADDRESS}/sla2-client:latest" application/sla_2.0_client
+  docker build -t "${CONTAINER_REGISTRY_ADDRESS}/sla2-client:latest" -f application/sla_2.0_client/Dockerfile .
   docker push "${CONTAINER_REGISTRY_ADDRESS}/sla2-client:latest"
 
   envsubst <kube/deploy-permissions-rbac.yaml | kubectl -n "${NS}" delete -f - || true
@@ -447,7 +440,6 @@ EOF
 
   # Cleanup
 
-  rm -r application/sla_2.0_client/config
   rm -r application/sla_2.0_client/msp
 
   rm application/sla_2.0_client/consumer.properties
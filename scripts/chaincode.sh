@@ -114,7 +114,8 @@ function build_chaincode_image() {
   local cc_name=$2
 
   push_fn "Building chaincode image ${cc_name}"
-  eval "docker build ${CONTAINER_NAMESPACE} -t ${cc_name} ${cc_folder}"
+  # The chaincodes build against lib, so the context is the root of the repository.
+  eval "docker build ${CONTAINER_NAMESPACE} -t ${cc_name} -f ${cc_folder}/Dockerfile $(dirname ${cc_folder})"
 
   pop_fn
 }
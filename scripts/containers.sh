@@ -13,24 +13,15 @@ function build_containers() {
 
     log "Building client images"
     push_fn "Building $TAG/sla-client image"
-    mkdir -p application/sla_client/kafka
-    cp config/kafka/* application/sla_client/kafka
-    docker build -t "$TAG/sla-client:latest" application/sla_client
-    rm -rf application/sla_client/kafka
+    docker build -t "$TAG/sla-client:latest" -f application/sla_client/Dockerfile .
     pop_fn
 
     push_fn "Building $TAG/vru-client image"
-    mkdir -p application/vru_client/kafka
-    cp config/kafka/* application/vru_client/kafka
-    docker build -t "$TAG/vru-client:latest" application/vru_client
-    rm -rf application/vru_client/kafka
+    docker build -t "$TAG/vru-client:latest" -f application/vru_client/Dockerfile .
     pop_fn
 
     push_fn "Building$TAG/parts-client image"
-    mkdir -p application/parts_client/kafka
-    cp config/kafka/* application/parts_client/kafka
-    docker build -t "$TAG/parts-client:latest" application/parts_client
-    rm -rf application/parts_client/kafka
+    docker build -t "$TAG/parts-client:latest" -f application/parts_client/Dockerfile .
     pop_fn
 
     # push_fn "Building ${TAG}/sla2-client image"
@@ -40,7 +31,7 @@ function build_containers() {
     # cp config/kafka/kafka.client.truststore.jks application/sla_2.0_client/
     # cp config/kafka/server.cer.pem application/sla_2.0_client/
 
-    # docker build -t "${TAG}/sla2-client:latest" application/sla_2.0_client
+    # docker build -t "${TAG}/sla2-client:latest" -f application/sla_2.0_client/Dockerfile .
     # pop_fn
 
     push_fn "Building ${TAG}/identity-management client image"
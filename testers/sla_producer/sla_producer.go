@@ -30,15 +30,16 @@ func main() {
 		log.Fatalf("failed to unmarshal files: %v", err)
 	}
 
-	// Create the topics that will be used
-	topics := make([]string, 2)
-	topics[0] = "sla_contracts"
-	topics[1] = "sla_violation"
-
 	nAssets := flag.Int("a", 5, "Specify how many random assets to produce")
 	nViolations := flag.Int("v", 3, "Specify how many random violations to produce")
+	slaTopic := flag.String("topic-sla", "sla_contracts", "Topic to produce the SLAs to")
+	violationTopic := flag.String("topic-violations", "sla_violation", "Topic to produce the violations to")
 
 	configFile := lib.ParseArgs()
+
+	// Create the topics that will be used
+	topics := []string{*slaTopic, *violationTopic}
+
 	p_sla, err := lib.CreateProducer(*configFile[0])
 	if err != nil {
 		log.Fatalf("Failure at producer: %v", err)